@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// retryInterval is the pause between lookups of a VNI that is not allocated
+// yet, unless the endpoint asks for another one with Retry-After.
+const retryInterval = time.Second
+
+type client struct {
+	conf  *NetConf
+	http  *http.Client
+	token string
+}
+
+func newClient(conf *NetConf) (*client, error) {
+	c := &client{conf: conf, http: &http.Client{Timeout: 10 * time.Second}}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", conf.CAFile)
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	if conf.TokenFile != "" {
+		data, err := os.ReadFile(conf.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = strings.TrimSpace(string(data))
+	}
+	return c, nil
+}
+
+// podVnis asks the endpoint for the VNIs of a pod. While the endpoint cannot
+// be reached or answers 503, e.g. because the VNI of the pod's job is not
+// allocated yet, it retries until the configured timeout.
+func (c *client) podVnis(namespace string, name string) ([]PodVni, error) {
+	target := fmt.Sprintf("%s/api/v1/pods/%s/%s/vni", strings.TrimSuffix(c.conf.Endpoint, "/"),
+		url.PathEscape(namespace), url.PathEscape(name))
+	deadline := time.Now().Add(c.conf.timeout)
+	for {
+		vnis, retryAfter, err := c.get(target)
+		if err == nil {
+			return vnis, nil
+		}
+		if retryAfter == 0 || time.Now().Add(retryAfter).After(deadline) {
+			return nil, fmt.Errorf("looking up VNIs of pod %s/%s: %w", namespace, name, err)
+		}
+		time.Sleep(retryAfter)
+	}
+}
+
+// get returns a retry interval > 0 with errors worth retrying.
+func (c *client) get(target string) ([]PodVni, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, retryInterval, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, retryInterval, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var response struct {
+			Vnis []PodVni `json:"vnis"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, 0, err
+		}
+		return response.Vnis, 0, nil
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		retryAfter := retryInterval
+		if seconds, err := time.ParseDuration(resp.Header.Get("Retry-After") + "s"); err == nil && seconds > 0 {
+			retryAfter = seconds
+		}
+		return nil, retryAfter, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	default:
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
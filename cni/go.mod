@@ -0,0 +1,13 @@
+module vni_cni
+
+go 1.23.3
+
+require (
+	github.com/containernetworking/cni v1.2.3
+	github.com/containernetworking/plugins v1.5.1
+)
+
+require (
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
@@ -0,0 +1,226 @@
+// vni-cni is a chained CNI plugin that looks up the VNIs of a pod at the VNI
+// endpoint when the pod's sandbox is created and records them for the CXI
+// components on the node. It passes the result of the previous plugin on
+// unchanged.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+const (
+	defaultDataDir = "/var/lib/cni/vni"
+	defaultTimeout = 30 * time.Second
+)
+
+// NetConf is the plugin configuration in the network configuration list, e.g.
+//
+//	{"type": "vni-cni", "endpoint": "https://vni-endpoint-service.vni-management:8842",
+//	 "tokenFile": "/etc/cni/net.d/vni-cni/token", "caFile": "/etc/cni/net.d/vni-cni/ca.crt"}
+type NetConf struct {
+	types.NetConf
+	// Endpoint is the base URL of the VNI endpoint
+	Endpoint string `json:"endpoint"`
+	// TokenFile holds a bearer token of a user in the endpoint's
+	// --auth-agent-users
+	TokenFile string `json:"tokenFile,omitempty"`
+	// CAFile verifies the endpoint's certificate
+	CAFile string `json:"caFile,omitempty"`
+	// Timeout bounds the wait for a VNI that is not allocated yet, e.g. "30s"
+	Timeout string `json:"timeout,omitempty"`
+	// DataDir receives a file per container with its VNIs
+	DataDir string `json:"dataDir,omitempty"`
+
+	timeout time.Duration
+}
+
+// K8sArgs are the CNI_ARGS passed by the container runtime for pods.
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// PodVni mirrors the endpoint's type of the same name.
+type PodVni struct {
+	Vni            int            `json:"vni"`
+	VniUid         string         `json:"vniUid"`
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	Limits         map[string]int `json:"limits,omitempty"`
+}
+
+// ContainerVnis is written to <dataDir>/<container id>.json for containers
+// with VNIs.
+type ContainerVnis struct {
+	Namespace   string   `json:"namespace"`
+	Pod         string   `json:"pod"`
+	ContainerID string   `json:"containerID"`
+	Netns       string   `json:"netns"`
+	IfName      string   `json:"ifName"`
+	Vnis        []PodVni `json:"vnis"`
+}
+
+func parseConfig(stdin []byte) (*NetConf, error) {
+	conf := &NetConf{DataDir: defaultDataDir, timeout: defaultTimeout}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
+	}
+	if conf.Endpoint == "" {
+		return nil, errors.New("endpoint is required")
+	}
+	if conf.Timeout != "" {
+		timeout, err := time.ParseDuration(conf.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+		conf.timeout = timeout
+	}
+	if conf.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %w", err)
+		}
+	}
+	return conf, nil
+}
+
+func podArgs(args *skel.CmdArgs) (namespace string, name string, err error) {
+	var k8sArgs K8sArgs
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return "", "", err
+	}
+	return string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), nil
+}
+
+func dataFile(conf *NetConf, containerID string) string {
+	return filepath.Join(conf.DataDir, containerID+".json")
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.PrevResult == nil {
+		return errors.New("vni-cni must be called as a chained plugin")
+	}
+	namespace, name, err := podArgs(args)
+	if err != nil {
+		return err
+	}
+	if namespace == "" || name == "" {
+		// not a Kubernetes pod
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	client, err := newClient(conf)
+	if err != nil {
+		return err
+	}
+	vnis, err := client.podVnis(namespace, name)
+	if err != nil {
+		return err
+	}
+	if len(vnis) > 0 {
+		err := writeContainerVnis(dataFile(conf, args.ContainerID), ContainerVnis{
+			Namespace: namespace, Pod: name, ContainerID: args.ContainerID,
+			Netns: args.Netns, IfName: args.IfName, Vnis: vnis,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+// cmdDel removes the container's file. It must succeed even if ADD never
+// ran, or the endpoint is down.
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(dataFile(conf, args.ContainerID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// cmdCheck verifies that the container's file holds the pod's current VNIs.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.PrevResult == nil {
+		return errors.New("vni-cni must be called as a chained plugin")
+	}
+	namespace, name, err := podArgs(args)
+	if err != nil || namespace == "" || name == "" {
+		return err
+	}
+
+	client, err := newClient(conf)
+	if err != nil {
+		return err
+	}
+	vnis, err := client.podVnis(namespace, name)
+	if err != nil {
+		return err
+	}
+	var recorded ContainerVnis
+	data, err := os.ReadFile(dataFile(conf, args.ContainerID))
+	switch {
+	case errors.Is(err, os.ErrNotExist) && len(vnis) == 0:
+		return nil
+	case err != nil:
+		return err
+	}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return fmt.Errorf("%s: %w", dataFile(conf, args.ContainerID), err)
+	}
+	if len(recorded.Vnis) != len(vnis) {
+		return fmt.Errorf("pod %s/%s has %d VNIs, %d recorded", namespace, name, len(vnis), len(recorded.Vnis))
+	}
+	for i := range vnis {
+		if recorded.Vnis[i].Vni != vnis[i].Vni {
+			return fmt.Errorf("pod %s/%s has VNI %d, %d recorded", namespace, name, vnis[i].Vni, recorded.Vnis[i].Vni)
+		}
+	}
+	return nil
+}
+
+// writeContainerVnis writes the file atomically, so that readers never see
+// a partial one.
+func writeContainerVnis(path string, vnis ContainerVnis) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(vnis)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func main() {
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Del:   cmdDel,
+		Check: cmdCheck,
+	}, version.VersionsStartingFrom("0.4.0"), "vni-cni: VNIs of Kubernetes pods for Slingshot")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+const (
+	testContainerID = "3a4f8e0c9b1d"
+	testToken       = "agent-token"
+)
+
+// prevResult is the result of the plugin before vni-cni in the chain.
+const prevResult = `{"cniVersion": "1.0.0", "interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/cni-1"}],
+	"ips": [{"address": "10.1.2.3/24", "gateway": "10.1.2.1", "interface": 0}]}`
+
+// fakeEndpoint answers the pod lookups with the responses in order, the
+// last one repeatedly.
+type fakeEndpoint struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+type endpointResponse struct {
+	status int
+	body   string
+}
+
+func newFakeEndpoint(t *testing.T, responses ...endpointResponse) *fakeEndpoint {
+	t.Helper()
+	endpoint := &fakeEndpoint{}
+	endpoint.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(endpoint.requests.Add(1))
+		if r.URL.Path != "/api/v1/pods/vnitest/trainer-0/vni" {
+			t.Errorf("lookup of %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			t.Errorf("Authorization %q", r.Header.Get("Authorization"))
+		}
+		response := responses[min(n, len(responses))-1]
+		if response.status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	t.Cleanup(endpoint.Close)
+	return endpoint
+}
+
+func podVniResponse(vnis ...int) endpointResponse {
+	var entries []string
+	for _, vni := range vnis {
+		entries = append(entries, fmt.Sprintf(`{"vni": %d, "vniUid": "vni-%d", "owner": {"kind": "Job", "name": "trainer"},
+			"trafficClasses": ["BEST_EFFORT"]}`, vni, vni))
+	}
+	return endpointResponse{http.StatusOK, `{"namespace": "vnitest", "pod": "trainer-0", "owners": [],
+		"vnis": [` + strings.Join(entries, ",") + `]}`}
+}
+
+// cmdArgs returns the arguments the runtime passes for pod vnitest/trainer-0.
+func cmdArgs(t *testing.T, endpoint string, dataDir string, timeout string) *skel.CmdArgs {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(testToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "k8s-pod-network", "type": "vni-cni",
+		"endpoint": %q, "tokenFile": %q, "timeout": %q, "dataDir": %q, "prevResult": %s}`,
+		endpoint, tokenFile, timeout, dataDir, prevResult)
+	return &skel.CmdArgs{
+		ContainerID: testContainerID,
+		Netns:       "/var/run/netns/cni-1",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=vnitest;K8S_POD_NAME=trainer-0;K8S_POD_INFRA_CONTAINER_ID=" + testContainerID,
+		StdinData:   []byte(conf),
+	}
+}
+
+func readContainerVnis(t *testing.T, dataDir string) (*ContainerVnis, bool) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dataDir, testContainerID+".json"))
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vnis ContainerVnis
+	if err := json.Unmarshal(data, &vnis); err != nil {
+		t.Fatal(err)
+	}
+	return &vnis, true
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []endpointResponse
+		timeout   string
+		// requests is the number of lookups expected
+		requests int
+		// vnis are the VNIs recorded, nil if no file is written
+		vnis []int
+		// err is a substring of the expected error
+		err string
+	}{
+		{name: "VNIs", responses: []endpointResponse{podVniResponse(100, 101)}, timeout: "5s",
+			requests: 1, vnis: []int{100, 101}},
+		{name: "no VNIs", responses: []endpointResponse{podVniResponse()}, timeout: "5s", requests: 1},
+		{
+			name: "retried while not allocated",
+			responses: []endpointResponse{{http.StatusServiceUnavailable, "no VNI allocated yet for Job trainer"},
+				podVniResponse(100)},
+			timeout: "5s", requests: 2, vnis: []int{100},
+		},
+		{
+			// the second lookup fails too and a third would end past the timeout
+			name:      "timeout",
+			responses: []endpointResponse{{http.StatusServiceUnavailable, "no VNI allocated yet for Job trainer"}},
+			timeout:   "1500ms", requests: 2, err: "503 Service Unavailable: no VNI allocated yet for Job trainer",
+		},
+		{name: "not found", responses: []endpointResponse{{http.StatusNotFound, `pods "trainer-0" not found`}},
+			timeout: "5s", requests: 1, err: "404 Not Found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint := newFakeEndpoint(t, test.responses...)
+			dataDir := t.TempDir()
+			args := cmdArgs(t, endpoint.URL, dataDir, test.timeout)
+
+			result, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			if got := int(endpoint.requests.Load()); got != test.requests {
+				t.Errorf("%d lookups, want %d", got, test.requests)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				if _, ok := readContainerVnis(t, dataDir); ok {
+					t.Error("VNIs recorded after an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the previous result is passed on unchanged
+			got, err := types100.GetResult(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.IPs) != 1 || got.IPs[0].Address.String() != "10.1.2.3/24" || len(got.Interfaces) != 1 {
+				t.Errorf("result %+v", got)
+			}
+
+			recorded, ok := readContainerVnis(t, dataDir)
+			if ok != (test.vnis != nil) {
+				t.Fatalf("recorded %+v, want VNIs %v", recorded, test.vnis)
+			}
+			if !ok {
+				return
+			}
+			if recorded.Namespace != "vnitest" || recorded.Pod != "trainer-0" || recorded.ContainerID != testContainerID ||
+				recorded.Netns != args.Netns || recorded.IfName != "eth0" {
+				t.Errorf("recorded %+v", recorded)
+			}
+			if len(recorded.Vnis) != len(test.vnis) {
+				t.Fatalf("recorded %+v, want VNIs %v", recorded.Vnis, test.vnis)
+			}
+			for i, vni := range test.vnis {
+				if recorded.Vnis[i].Vni != vni {
+					t.Errorf("recorded %+v, want VNIs %v", recorded.Vnis, test.vnis)
+				}
+			}
+		})
+	}
+}
+
+func TestDel(t *testing.T) {
+	// DEL must succeed without a preceding ADD and without the endpoint
+	dataDir := t.TempDir()
+	args := cmdArgs(t, "http://127.0.0.1:1", dataDir, "5s")
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatalf("DEL without ADD: %v", err)
+	}
+
+	endpoint := newFakeEndpoint(t, podVniResponse(100))
+	args = cmdArgs(t, endpoint.URL, dataDir, "5s")
+	if _, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readContainerVnis(t, dataDir); ok {
+		t.Error("VNIs still recorded after DEL")
+	}
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatalf("second DEL: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		added   []int
+		current []int
+		err     string
+	}{
+		{name: "match", added: []int{100}, current: []int{100}},
+		{name: "none", current: nil},
+		{name: "VNI changed", added: []int{100}, current: []int{101}, err: "has VNI 101, 100 recorded"},
+		{name: "VNI added", added: []int{100}, current: []int{100, 101}, err: "has 2 VNIs, 1 recorded"},
+		{name: "not recorded", current: []int{100}, err: "no such file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			if test.added != nil {
+				endpoint := newFakeEndpoint(t, podVniResponse(test.added...))
+				args := cmdArgs(t, endpoint.URL, dataDir, "5s")
+				if _, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) }); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			endpoint := newFakeEndpoint(t, podVniResponse(test.current...))
+			args := cmdArgs(t, endpoint.URL, dataDir, "5s")
+			err := testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("CHECK: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("CHECK: %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cListAllocations lists the allocations of the namespace given by the
+// "namespace" query parameter, or of all namespaces.
+func cListAllocations(w http.ResponseWriter, r *http.Request) {
+	allocs, err := store.ListAllocations(r.URL.Query().Get("namespace"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error listing allocations: %v\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(allocs); err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
+
+// cReserve allocates a VNI under an admin-chosen name, without a job or
+// VniClaim owning it. Jobs can join the reservation with the annotation
+// vni: <name>, just as with a VniClaim.
+func cReserve(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	vni, err := acquireVni(name, namespace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reserving VNI: %v\n", err)
+		return
+	}
+	log.Printf("Reserved VNI %d for %s/%s\n", vni, namespace, name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Allocation{VniUid: name, Namespace: namespace, Vni: vni})
+}
+
+// cRelease force-releases an allocation: its users are detached first, so the
+// VNI is released even while jobs still use it. Nodes are kept like in
+// forceDetach, since their CXI services still admit the VNI, and the release
+// fails while any is attached. With ?nodes=true they are detached as well,
+// which describeRelease authorizes separately.
+func cRelease(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	nodes := releaseNodes(r)
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error listing allocations: %v\n", err)
+		return
+	}
+	var kept []string
+	for _, alloc := range allocs {
+		if alloc.VniUid != name {
+			continue
+		}
+		for _, user := range alloc.Users {
+			isNode := strings.HasPrefix(user, cxiNodeUserPrefix)
+			if isNode && !nodes {
+				kept = append(kept, user)
+				continue
+			}
+			if err := store.RemoveUser(name, namespace, user, shouldLog); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				log.Printf("Error removing user: %v\n", err)
+				return
+			}
+			if isNode {
+				log.Printf("Force-detached node %s from %s/%s on behalf of %s\n", user, namespace, name, requestUsername(r))
+			} else {
+				log.Printf("Force-detached user %s from %s/%s\n", user, namespace, name)
+			}
+		}
+	}
+	if len(kept) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("%s/%s is still attached to %s; retry once they have torn down their CXI services, or with ?nodes=true",
+			namespace, name, strings.Join(kept, ", "))))
+		log.Printf("Kept %s/%s for nodes %v\n", namespace, name, kept)
+		return
+	}
+
+	err = store.ReleaseUserCheck(name, namespace, shouldLog)
+	if errors.Is(err, ErrVNINotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error releasing VNI: %v\n", err)
+		return
+	}
+	log.Printf("Force-released %s/%s\n", namespace, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func describeList(r *http.Request) AdminRequest {
+	return AdminRequest{Verb: VerbList, Namespace: r.URL.Query().Get("namespace")}
+}
+
+// releaseNodes reports whether a release should also detach nodes.
+func releaseNodes(r *http.Request) bool {
+	nodes, _ := strconv.ParseBool(r.URL.Query().Get("nodes"))
+	return nodes
+}
+
+// requestUsername names the caller for the log, if it was authenticated.
+func requestUsername(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.Username
+	}
+	return "an unauthenticated caller"
+}
+
+// detaching nodes is authorized as release on vniallocations/nodes, so it
+// can be granted apart from releasing and shows up in the audit log
+func describeRelease(r *http.Request) AdminRequest {
+	request := AdminRequest{Verb: VerbRelease, Namespace: r.PathValue("namespace"), Name: r.PathValue("name")}
+	if releaseNodes(r) {
+		request.Subresource = "nodes"
+	}
+	return request
+}
+
+func describeReserve(r *http.Request) AdminRequest {
+	return AdminRequest{Verb: VerbReserve, Namespace: r.PathValue("namespace"), Name: r.PathValue("name")}
+}
+
+// a backup holds the allocations of all namespaces
+func describeBackup(r *http.Request) AdminRequest {
+	return AdminRequest{Verb: VerbBackup, Subresource: "backup"}
+}
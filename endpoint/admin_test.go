@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReleaseKeepsNodes(t *testing.T) {
+	s := newTestStore(t)
+	acquireTestVni(t, "reserved", "vnitest")
+	node := cxiNodeUser("node-1")
+	for _, user := range []string{jobUid, node} {
+		if err := s.AddUser("reserved", "vnitest", user, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release := func(target string) int {
+		request := httptest.NewRequest(http.MethodPost, target, nil)
+		request.SetPathValue("namespace", "vnitest")
+		request.SetPathValue("name", "reserved")
+		recorder := httptest.NewRecorder()
+		cRelease(recorder, request)
+		return recorder.Code
+	}
+
+	if code := release("/admin/allocations/vnitest/reserved/release"); code != http.StatusConflict {
+		t.Fatalf("release with a node attached: status %d, want %d", code, http.StatusConflict)
+	}
+	allocs, err := s.ListAllocations("vnitest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || len(allocs[0].Users) != 1 || allocs[0].Users[0] != node {
+		t.Fatalf("allocations = %v, want only %s attached", allocs, node)
+	}
+
+	if code := release("/admin/allocations/vnitest/reserved/release?nodes=true"); code != http.StatusNoContent {
+		t.Fatalf("release with nodes=true: status %d, want %d", code, http.StatusNoContent)
+	}
+	if vni, err := s.GetVni("reserved", "vnitest"); err != nil || vni != -1 {
+		t.Errorf("GetVni after release = %d, %v, want -1", vni, err)
+	}
+}
+
+func TestDescribeRelease(t *testing.T) {
+	for target, subresource := range map[string]string{
+		"/admin/allocations/vnitest/reserved/release":             "",
+		"/admin/allocations/vnitest/reserved/release?nodes=false": "",
+		"/admin/allocations/vnitest/reserved/release?nodes=true":  "nodes",
+	} {
+		request := describeRelease(httptest.NewRequest(http.MethodPost, target, nil))
+		if request.Verb != VerbRelease || request.Subresource != subresource {
+			t.Errorf("%s: %+v, want subresource %q", target, request, subresource)
+		}
+	}
+}
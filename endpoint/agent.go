@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// agentReportTimeout bounds a report to the endpoint
+const agentReportTimeout = 10 * time.Second
+
+type AgentConfig struct {
+	NodeName    string
+	Kubeconfig  string
+	Driver      CxiDriver
+	EndpointURL string
+	// TrafficClasses are given to services whose Vni does not name any
+	// traffic classes
+	TrafficClasses []string
+	ResyncPeriod   time.Duration
+}
+
+// Agent is the node agent run as a DaemonSet. It keeps one CXI service per
+// Vni used by the pods on its node, restricted to that VNI and the pods'
+// UIDs and GIDs, and reports the services to the endpoint.
+type Agent struct {
+	config  AgentConfig
+	pods    listerscorev1.PodLister
+	vnis    cache.GenericLister
+	client  *http.Client
+	trigger chan struct{}
+}
+
+func RunAgent(ctx context.Context, config AgentConfig) error {
+	if config.NodeName == "" {
+		return errors.New("no node name given")
+	}
+	kubeClient, err := newKubeClient(config.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := newDynamicClient(config.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	podInformers := informers.NewSharedInformerFactoryWithOptions(kubeClient, config.ResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", config.NodeName).String()
+		}))
+	vniInformers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, config.ResyncPeriod)
+
+	a := &Agent{
+		config:  config,
+		pods:    podInformers.Core().V1().Pods().Lister(),
+		vnis:    vniInformers.ForResource(vniGVR).Lister(),
+		client:  &http.Client{Timeout: agentReportTimeout, Transport: peerTransport},
+		trigger: make(chan struct{}, 1),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { a.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { a.enqueue() },
+		DeleteFunc: func(interface{}) { a.enqueue() },
+	}
+	if _, err := podInformers.Core().V1().Pods().Informer().AddEventHandler(handler); err != nil {
+		return err
+	}
+	if _, err := vniInformers.ForResource(vniGVR).Informer().AddEventHandler(handler); err != nil {
+		return err
+	}
+
+	podInformers.Start(ctx.Done())
+	vniInformers.Start(ctx.Done())
+	podInformers.WaitForCacheSync(ctx.Done())
+	vniInformers.WaitForCacheSync(ctx.Done())
+	log.Printf("Starting CXI agent on node %s\n", config.NodeName)
+
+	ticker := time.NewTicker(config.ResyncPeriod)
+	defer ticker.Stop()
+	for {
+		services, err := a.reconcile(ctx)
+		if err != nil {
+			log.Printf("Error reconciling CXI services: %v\n", err)
+		}
+		if services != nil {
+			if err := a.report(ctx, services); err != nil {
+				log.Printf("Error reporting CXI services: %v\n", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-a.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Agent) enqueue() {
+	select {
+	case a.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// desiredServices returns the services needed by the pods on the node, by
+// Vni namespace/name.
+func (a *Agent) desiredServices() (map[string]CxiServiceSpec, error) {
+	pods, err := a.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	desired := make(map[string]CxiServiceSpec)
+	unrestricted := make(map[string]bool)
+	for _, pod := range pods {
+		// a terminating pod may still use the NIC
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		vni := a.podVni(pod)
+		if vni == nil {
+			continue
+		}
+		number, found, err := unstructured.NestedInt64(vni.Object, "spec", "vni")
+		if err != nil || !found {
+			log.Printf("Vni %s/%s has no spec.vni\n", vni.GetNamespace(), vni.GetName())
+			continue
+		}
+
+		name := vni.GetNamespace() + "/" + vni.GetName()
+		spec, ok := desired[name]
+		if !ok {
+			spec = CxiServiceSpec{Name: name, Vni: int(number), TrafficClasses: a.config.TrafficClasses}
+			if tcs, found, _ := unstructured.NestedStringSlice(vni.Object, "spec", "trafficClasses"); found && len(tcs) > 0 {
+				spec.TrafficClasses = tcs
+			}
+			if limits, found, _ := unstructured.NestedMap(vni.Object, "spec", "limits"); found {
+				spec.Limits = make(map[string]int)
+				for resource, limit := range limits {
+					if value, ok := limit.(int64); ok {
+						spec.Limits[resource] = int(value)
+					}
+				}
+			}
+		}
+		uids, gids := podIds(pod)
+		if uids == nil {
+			unrestricted[name] = true
+		}
+		spec.UIDs = mergeIds(spec.UIDs, uids)
+		spec.GIDs = mergeIds(spec.GIDs, gids)
+		desired[name] = spec
+	}
+	for name := range unrestricted {
+		// some pod may run as any user, so the service cannot be limited
+		spec := desired[name]
+		spec.UIDs, spec.GIDs = nil, nil
+		desired[name] = spec
+	}
+	return desired, nil
+}
+
+// podVni returns the Vni attached to the pod itself or to one of its owners,
+// if any.
+func (a *Agent) podVni(pod *corev1.Pod) *unstructured.Unstructured {
+	uids := []types.UID{pod.UID}
+	for _, owner := range pod.OwnerReferences {
+		uids = append(uids, owner.UID)
+	}
+	for _, uid := range uids {
+		obj, err := a.vnis.ByNamespace(pod.Namespace).Get(fmt.Sprintf("vni-%s", uid))
+		if err != nil {
+			continue
+		}
+		if vni, ok := obj.(*unstructured.Unstructured); ok {
+			return vni
+		}
+	}
+	return nil
+}
+
+// podIds returns the UIDs and GIDs the pod's containers run as. The UIDs are
+// nil if a container may run as the image's user.
+func podIds(pod *corev1.Pod) ([]uint32, []uint32) {
+	var podUser, podGroup *int64
+	if pod.Spec.SecurityContext != nil {
+		podUser, podGroup = pod.Spec.SecurityContext.RunAsUser, pod.Spec.SecurityContext.RunAsGroup
+	}
+	var uids, gids []uint32
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		user, group := podUser, podGroup
+		if container.SecurityContext != nil {
+			if container.SecurityContext.RunAsUser != nil {
+				user = container.SecurityContext.RunAsUser
+			}
+			if container.SecurityContext.RunAsGroup != nil {
+				group = container.SecurityContext.RunAsGroup
+			}
+		}
+		if user == nil {
+			return nil, nil
+		}
+		uids = mergeIds(uids, []uint32{uint32(*user)})
+		if group != nil {
+			gids = mergeIds(gids, []uint32{uint32(*group)})
+		}
+	}
+	return uids, gids
+}
+
+func mergeIds(ids []uint32, more []uint32) []uint32 {
+	for _, id := range more {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// reconcile creates and destroys services until they match the pods, and
+// returns the services on the node afterwards.
+func (a *Agent) reconcile(ctx context.Context) ([]CxiService, error) {
+	desired, err := a.desiredServices()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := a.config.Driver.ListServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	present := make(map[string]bool)
+	for _, service := range existing {
+		spec, ok := desired[service.Spec.Name]
+		if ok && spec.Vni == service.Spec.Vni && !present[service.Spec.Name] {
+			present[service.Spec.Name] = true
+			if !slices.Equal(spec.UIDs, service.Spec.UIDs) || !slices.Equal(spec.GIDs, service.Spec.GIDs) {
+				// recreating the service would cut off the running pods
+				log.Printf("Members of CXI service %d (%s) changed to UIDs %v GIDs %v, keeping UIDs %v GIDs %v\n",
+					service.ID, service.Spec.Name, spec.UIDs, spec.GIDs, service.Spec.UIDs, service.Spec.GIDs)
+			}
+			continue
+		}
+		if err := a.config.Driver.DestroyService(ctx, service.ID); err != nil {
+			errs = append(errs, fmt.Errorf("destroying service %d (%s): %w", service.ID, service.Spec.Name, err))
+			continue
+		}
+		log.Printf("Destroyed CXI service %d for VNI %d (%s)\n", service.ID, service.Spec.Vni, service.Spec.Name)
+	}
+	for name, spec := range desired {
+		if present[name] {
+			continue
+		}
+		service, err := a.config.Driver.CreateService(ctx, spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("creating service for %s: %w", name, err))
+			continue
+		}
+		log.Printf("Created CXI service %d for VNI %d (%s, UIDs %v, GIDs %v, traffic classes %v, limits %v)\n",
+			service.ID, spec.Vni, name, spec.UIDs, spec.GIDs, spec.TrafficClasses, spec.Limits)
+	}
+
+	// report what is actually there, including services that failed to be
+	// destroyed
+	services, err := a.config.Driver.ListServices(ctx)
+	if err != nil {
+		errs = append(errs, err)
+		return nil, errors.Join(errs...)
+	}
+	return services, errors.Join(errs...)
+}
+
+// report sends the services on the node to the endpoint, which keeps their
+// VNIs from being released until they are destroyed.
+func (a *Agent) report(ctx context.Context, services []CxiService) error {
+	report := CxiServiceReport{Node: a.config.NodeName, Vnis: make([]CxiReportedVni, 0, len(services))}
+	for _, service := range services {
+		namespace, _, _ := strings.Cut(service.Spec.Name, "/")
+		report.Vnis = append(report.Vnis, CxiReportedVni{Namespace: namespace, Vni: service.Spec.Vni})
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(a.config.EndpointURL, "/")+"/agent/services", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if peerTokenFile != "" {
+		// re-read on every request, projected tokens are rotated
+		token, err := os.ReadFile(peerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("endpoint answered %s: %s", resp.Status, message)
+	}
+	return nil
+}
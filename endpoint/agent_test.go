@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// reconcileAndReport runs one round of the agent loop and returns the
+// services on the node.
+func reconcileAndReport(t *testing.T, a *Agent) []CxiService {
+	t.Helper()
+	services, err := a.reconcile(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.report(context.TODO(), services); err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func vniUsers(t *testing.T, vniUid string) []string {
+	t.Helper()
+	allocs, err := store.ListAllocations("vnitest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alloc := range allocs {
+		if alloc.VniUid == vniUid {
+			return alloc.Users
+		}
+	}
+	t.Fatalf("no allocation %s", vniUid)
+	return nil
+}
+
+func TestAgentReconcile(t *testing.T) {
+	newTestStore(t)
+	job := newOwnedObject("batch/v1", "Job", "eval", map[string]string{"vni": "true"})
+	vniObject := newVniObject("vni-eval-uid", int64(acquireTestVni(t, "vni-eval-uid", "vnitest")), job)
+	vnis := newTestIndexer()
+	if err := vnis.Add(vniObject); err != nil {
+		t.Fatal(err)
+	}
+
+	user, group := int64(1000), int64(100)
+	controller := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vnitest", Name: "eval-x7k2p", UID: "pod-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "eval",
+				UID: job.GetUID(), Controller: &controller}}},
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{RunAsUser: &user, RunAsGroup: &group},
+			Containers:      []corev1.Container{{Name: "main"}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	pods := newTestIndexer()
+	if err := pods.Add(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(cCxiReport))
+	defer server.Close()
+	driver := newFakeCxiDriver()
+	a := &Agent{
+		config: AgentConfig{NodeName: "node-a", Driver: driver, EndpointURL: server.URL,
+			TrafficClasses: []string{"BEST_EFFORT"}},
+		pods:   listerscorev1.NewPodLister(pods),
+		vnis:   cache.NewGenericLister(vnis, vniGVR.GroupResource()),
+		client: server.Client(),
+	}
+
+	services := reconcileAndReport(t, a)
+	want := CxiServiceSpec{Name: "vnitest/vni-eval-uid", Vni: 100, UIDs: []uint32{1000}, GIDs: []uint32{100},
+		TrafficClasses: []string{"BEST_EFFORT"}}
+	if len(services) != 1 || services[0].Spec.Name != want.Name || services[0].Spec.Vni != want.Vni ||
+		!slices.Equal(services[0].Spec.UIDs, want.UIDs) || !slices.Equal(services[0].Spec.GIDs, want.GIDs) ||
+		!slices.Equal(services[0].Spec.TrafficClasses, want.TrafficClasses) {
+		t.Fatalf("services = %+v, want %+v", services, want)
+	}
+	if users := vniUsers(t, "vni-eval-uid"); !slices.Equal(users, []string{cxiNodeUser("node-a")}) {
+		t.Errorf("users = %v, want the node", users)
+	}
+
+	// an unchanged node keeps its service
+	if again := reconcileAndReport(t, a); len(again) != 1 || again[0].ID != services[0].ID {
+		t.Errorf("services after a second round = %+v", again)
+	}
+
+	// the VNI is held while the node has a service for it
+	if err := store.ReleaseUserCheck("vni-eval-uid", "vnitest", shouldLog); !errors.Is(err, ErrVNIInUse) {
+		t.Fatalf("release with the node attached: %v, want %v", err, ErrVNIInUse)
+	}
+
+	if err := pods.Delete(pod); err != nil {
+		t.Fatal(err)
+	}
+	if services := reconcileAndReport(t, a); len(services) != 0 {
+		t.Fatalf("services after the pod left = %+v", services)
+	}
+	if users := vniUsers(t, "vni-eval-uid"); len(users) != 0 {
+		t.Errorf("users after the service was destroyed = %v", users)
+	}
+	if err := store.ReleaseUserCheck("vni-eval-uid", "vnitest", shouldLog); err != nil {
+		t.Fatalf("release after the node detached: %v", err)
+	}
+}
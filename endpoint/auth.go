@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// tokenReviewCacheTTL bounds how long a successful TokenReview is reused, so
+// that a revoked token stops working soon after.
+const tokenReviewCacheTTL = time.Minute
+
+type UserInfo struct {
+	Username string
+	UID      string
+	Groups   []string
+	Extra    map[string][]string
+}
+
+// nodeNameExtra is the extra of service account tokens bound to a pod that
+// names the pod's node (Kubernetes 1.30 and later).
+const nodeNameExtra = "authentication.kubernetes.io/node-name"
+
+// nodeUserPrefix prefixes the usernames of kubelets, and of static tokens
+// issued to a node.
+const nodeUserPrefix = "system:node:"
+
+// Node returns the node the user's credentials are bound to, if any.
+func (u *UserInfo) Node() (string, bool) {
+	if nodes := u.Extra[nodeNameExtra]; len(nodes) == 1 && nodes[0] != "" {
+		return nodes[0], true
+	}
+	if node, ok := strings.CutPrefix(u.Username, nodeUserPrefix); ok && node != "" {
+		return node, true
+	}
+	return "", false
+}
+
+type userContextKey struct{}
+
+// requestUser returns the user that usersAuth authenticated for r, or nil
+// without an authenticator.
+func requestUser(r *http.Request) *UserInfo {
+	user, _ := r.Context().Value(userContextKey{}).(*UserInfo)
+	return user
+}
+
+// Authenticator maps a bearer token to the calling user. It returns
+// ErrUnauthenticated for tokens it does not accept.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*UserInfo, error)
+}
+
+// staticTokenAuthenticator accepts the tokens of a file in the format of the
+// API server's --token-auth-file: token,user,uid,"group1,group2".
+type staticTokenAuthenticator struct {
+	tokens map[string]UserInfo
+}
+
+func NewStaticTokenAuthenticator(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]UserInfo)
+	for i, record := range records {
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("%s line %d: expected token,user[,uid[,groups]]", path, i+1)
+		}
+		user := UserInfo{Username: record[1]}
+		if len(record) > 2 {
+			user.UID = record[2]
+		}
+		if len(record) > 3 && record[3] != "" {
+			user.Groups = strings.Split(record[3], ",")
+		}
+		tokens[record[0]] = user
+	}
+	return &staticTokenAuthenticator{tokens: tokens}, nil
+}
+
+func (a *staticTokenAuthenticator) Authenticate(_ context.Context, token string) (*UserInfo, error) {
+	for known, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return &user, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+type cachedReview struct {
+	user    UserInfo
+	expires time.Time
+}
+
+// tokenReviewAuthenticator validates tokens, e.g. projected service account
+// tokens, with the API server's TokenReview API.
+type tokenReviewAuthenticator struct {
+	client    kubernetes.Interface
+	audiences []string
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedReview
+}
+
+func NewTokenReviewAuthenticator(client kubernetes.Interface, audiences []string) Authenticator {
+	return &tokenReviewAuthenticator{
+		client:    client,
+		audiences: audiences,
+		cache:     make(map[[sha256.Size]byte]cachedReview),
+	}
+}
+
+func (a *tokenReviewAuthenticator) Authenticate(ctx context.Context, token string) (*UserInfo, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	if ok && now.After(cached.expires) {
+		delete(a.cache, key)
+		ok = false
+	}
+	a.mu.Unlock()
+	if ok {
+		return &cached.user, nil
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, ErrUnauthenticated
+	}
+
+	user := UserInfo{
+		Username: review.Status.User.Username,
+		UID:      review.Status.User.UID,
+		Groups:   review.Status.User.Groups,
+	}
+	for key, values := range review.Status.User.Extra {
+		if user.Extra == nil {
+			user.Extra = make(map[string][]string)
+		}
+		user.Extra[key] = values
+	}
+	a.mu.Lock()
+	// expired entries are dropped on lookup; clear the map if it grows anyway
+	if len(a.cache) > 1000 {
+		a.cache = make(map[[sha256.Size]byte]cachedReview)
+	}
+	a.cache[key] = cachedReview{user: user, expires: now.Add(tokenReviewCacheTTL)}
+	a.mu.Unlock()
+	return &user, nil
+}
+
+// bearerToken returns the token r is sent with. Clients that cannot set
+// headers, like the webhooks of Metacontroller, may put it in the URL as the
+// password (https://hooks:<token>@...), which Go sends as basic auth.
+func bearerToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticate returns the user calling r. The second return value is false if
+// a response has already been written.
+func authenticate(w http.ResponseWriter, r *http.Request) (*UserInfo, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("missing bearer token"))
+		return nil, false
+	}
+	user, err := authenticator.Authenticate(r.Context(), token)
+	if errors.Is(err, ErrUnauthenticated) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid bearer token"))
+		log.Printf("Rejected invalid token from %s for %s\n", r.RemoteAddr, r.URL.Path)
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error authenticating request: %v\n", err)
+		return nil, false
+	}
+	return user, true
+}
+
+// hookAuth wraps a hook handler so that it only serves the users in
+// hookUsers. It is a no-op if no authenticator is configured.
+func hookAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return usersAuth(hookUsers, handler)
+}
+
+// agentAuth wraps a handler for the node agents so that it only serves the
+// users in agentUsers.
+func agentAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return usersAuth(agentUsers, handler)
+}
+
+func usersAuth(users map[string]bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			handler(w, r)
+			return
+		}
+		r, ok := checkUser(w, r, users)
+		if !ok {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// checkUser authenticates the request and checks that its user is in users,
+// if any, answering 401 or 403 if not. The returned request carries the user.
+func checkUser(w http.ResponseWriter, r *http.Request, users map[string]bool) (*http.Request, bool) {
+	user, ok := authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if len(users) > 0 && !users[user.Username] {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("user %s may not call %s", user.Username, r.URL.Path)))
+		log.Printf("Rejected user %s for %s\n", user.Username, r.URL.Path)
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)), true
+}
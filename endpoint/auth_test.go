@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestHookAuthTokenInURL checks that a token in the hook URL, the only way
+// Metacontroller can send one, authenticates the hooks.
+func TestHookAuthTokenInURL(t *testing.T) {
+	oldAuthenticator, oldHookUsers := authenticator, hookUsers
+	defer func() { authenticator, hookUsers = oldAuthenticator, oldHookUsers }()
+	authenticator = mapAuthenticator{"hook-token": {Username: "metacontroller"}}
+	hookUsers = map[string]bool{"metacontroller": true}
+	server := httptest.NewServer(hookAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		user   *url.Userinfo
+		status int
+	}{
+		{name: "token", user: url.UserPassword("hooks", "hook-token"), status: http.StatusOK},
+		{name: "wrong token", user: url.UserPassword("hooks", "other"), status: http.StatusUnauthorized},
+		{name: "no token", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hookURL, err := url.Parse(server.URL + "/sync")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hookURL.User = test.user
+			resp, err := http.Post(hookURL.String(), "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+// newTokenReviewClientset accepts the token "metacontroller-token" for the
+// audience "vni-endpoint", fails on "broken" and counts the reviews.
+func newTokenReviewClientset(reviews *int) *kubefake.Clientset {
+	client := kubefake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		*reviews++
+		switch {
+		case review.Spec.Token == "broken":
+			return true, nil, errors.New("the server is currently unable to handle the request")
+		case review.Spec.Token == "metacontroller-token" && slices.Equal(review.Spec.Audiences, []string{"vni-endpoint"}):
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{
+				Username: "system:serviceaccount:metacontroller:metacontroller",
+				UID:      "1234",
+				Groups:   []string{"system:serviceaccounts"},
+				Extra:    map[string]authenticationv1.ExtraValue{nodeNameExtra: {"node-a"}},
+			}
+		default:
+			review.Status.Error = "invalid bearer token"
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestTokenReviewAuthenticator(t *testing.T) {
+	reviews := 0
+	a := NewTokenReviewAuthenticator(newTokenReviewClientset(&reviews), []string{"vni-endpoint"})
+
+	user, err := a.Authenticate(context.TODO(), "metacontroller-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &UserInfo{Username: "system:serviceaccount:metacontroller:metacontroller", UID: "1234",
+		Groups: []string{"system:serviceaccounts"}, Extra: map[string][]string{nodeNameExtra: {"node-a"}}}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("user = %+v, want %+v", user, want)
+	}
+
+	// accepted tokens are cached until they expire
+	if _, err := a.Authenticate(context.TODO(), "metacontroller-token"); err != nil || reviews != 1 {
+		t.Errorf("second request: %v, %d reviews, want 1", err, reviews)
+	}
+	reviewer := a.(*tokenReviewAuthenticator)
+	for key, cached := range reviewer.cache {
+		cached.expires = time.Now().Add(-time.Second)
+		reviewer.cache[key] = cached
+	}
+	if _, err := a.Authenticate(context.TODO(), "metacontroller-token"); err != nil || reviews != 2 {
+		t.Errorf("after expiry: %v, %d reviews, want 2", err, reviews)
+	}
+
+	if _, err := a.Authenticate(context.TODO(), "stolen"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("rejected token: %v, want %v", err, ErrUnauthenticated)
+	}
+	// rejections are not cached
+	if _, err := a.Authenticate(context.TODO(), "stolen"); !errors.Is(err, ErrUnauthenticated) || reviews != 4 {
+		t.Errorf("rejected token again: %v, %d reviews, want 4", err, reviews)
+	}
+	if _, err := a.Authenticate(context.TODO(), "broken"); err == nil || errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("failed review: %v", err)
+	}
+	// a token reviewed for another audience is not accepted
+	other := NewTokenReviewAuthenticator(newTokenReviewClientset(&reviews), []string{"kubernetes"})
+	if _, err := other.Authenticate(context.TODO(), "metacontroller-token"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("other audience: %v, want %v", err, ErrUnauthenticated)
+	}
+}
+
+func TestHookAuthTokenReview(t *testing.T) {
+	oldAuthenticator, oldHookUsers := authenticator, hookUsers
+	defer func() { authenticator, hookUsers = oldAuthenticator, oldHookUsers }()
+	reviews := 0
+	authenticator = NewTokenReviewAuthenticator(newTokenReviewClientset(&reviews), []string{"vni-endpoint"})
+
+	tests := []struct {
+		name   string
+		users  map[string]bool
+		token  string
+		status int
+	}{
+		{name: "accepted", users: map[string]bool{"system:serviceaccount:metacontroller:metacontroller": true},
+			token: "metacontroller-token", status: http.StatusOK},
+		{name: "accepted, any user", token: "metacontroller-token", status: http.StatusOK},
+		{name: "not a hook user", users: map[string]bool{"system:serviceaccount:other:hooks": true},
+			token: "metacontroller-token", status: http.StatusForbidden},
+		{name: "rejected", token: "stolen", status: http.StatusUnauthorized},
+		{name: "review failed", token: "broken", status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// hookAuth binds hookUsers when wrapping
+			hookUsers = test.users
+			handler := hookAuth(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+			request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+			request.Header.Set("Authorization", "Bearer "+test.token)
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+			if recorder.Code != test.status {
+				t.Errorf("status %d (%s), want %d", recorder.Code, recorder.Body, test.status)
+			}
+		})
+	}
+}
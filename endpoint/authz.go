@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Admin operations are authorized against the virtual resource
+// vniallocations.horizon-opencube.eu, so that they can be granted with
+// ordinary (Cluster)Roles, e.g.
+//
+//	rules:
+//	  - apiGroups: ["horizon-opencube.eu"]
+//	    resources: ["vniallocations"]
+//	    verbs: ["list", "release", "reserve"]
+const (
+	adminGroup    = "horizon-opencube.eu"
+	adminResource = "vniallocations"
+
+	VerbList    = "list"
+	VerbRelease = "release"
+	VerbReserve = "reserve"
+	VerbGet     = "get"
+	VerbBackup  = VerbGet
+)
+
+// AdminRequest is an admin operation to be authorized. An empty Namespace
+// means all namespaces.
+type AdminRequest struct {
+	Verb        string
+	Namespace   string
+	Name        string
+	Subresource string
+}
+
+// Authorizer decides whether user may perform an admin operation. reason
+// explains a denial.
+type Authorizer interface {
+	Authorize(ctx context.Context, user *UserInfo, request AdminRequest) (allowed bool, reason string, err error)
+}
+
+// sarAuthorizer asks the API server with a SubjectAccessReview.
+type sarAuthorizer struct {
+	client kubernetes.Interface
+}
+
+func NewSubjectAccessReviewAuthorizer(client kubernetes.Interface) Authorizer {
+	return &sarAuthorizer{client: client}
+}
+
+func (a *sarAuthorizer) Authorize(ctx context.Context, user *UserInfo, request AdminRequest) (bool, string, error) {
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:       adminGroup,
+				Resource:    adminResource,
+				Verb:        request.Verb,
+				Namespace:   request.Namespace,
+				Name:        request.Name,
+				Subresource: request.Subresource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// adminAuth wraps an admin handler so that it runs only for callers allowed
+// to perform the request returned by describe. Without an authorizer, any
+// user passing hook authentication is allowed. Without an authenticator, it
+// refuses every request; StartServer does not register the admin API then.
+func adminAuth(describe func(r *http.Request) AdminRequest, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("the admin API requires authentication"))
+			log.Printf("Denied admin request %s %s: no authenticator configured\n", r.Method, r.URL.Path)
+			return
+		}
+		if authorizer == nil {
+			hookAuth(handler)(w, r)
+			return
+		}
+
+		user, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		request := describe(r)
+		allowed, reason, err := authorizer.Authorize(r.Context(), user, request)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			log.Printf("Error authorizing request: %v\n", err)
+			return
+		}
+		if !allowed {
+			scope := "all namespaces"
+			if request.Namespace != "" {
+				scope = "namespace " + request.Namespace
+			}
+			message := fmt.Sprintf("user %s may not %s %s in %s", user.Username, request.Verb, adminResource, scope)
+			if reason != "" {
+				message += ": " + reason
+			}
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(message))
+			log.Printf("Denied: %s\n", message)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	}
+}
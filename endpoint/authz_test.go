@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAdminAuthRequiresAuthenticator(t *testing.T) {
+	oldAuthenticator, oldAuthorizer := authenticator, authorizer
+	defer func() { authenticator, authorizer = oldAuthenticator, oldAuthorizer }()
+	authenticator, authorizer = nil, nil
+
+	called := false
+	handler := adminAuth(describeList, func(w http.ResponseWriter, r *http.Request) { called = true })
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/admin/allocations", nil))
+	if called || recorder.Code != http.StatusForbidden {
+		t.Errorf("status %d, handler called: %v", recorder.Code, called)
+	}
+}
+
+// rbacRule grants verbs on vniallocations, or one of its subresources, to a
+// user in a namespace, or in all namespaces if namespace is empty.
+type rbacRule struct {
+	user        string
+	namespace   string
+	subresource string
+	verbs       []string
+}
+
+// newSARClientset answers SubjectAccessReviews from rules and records their
+// resource attributes.
+func newSARClientset(rules []rbacRule, reviewed *[]authorizationv1.ResourceAttributes) *kubefake.Clientset {
+	client := kubefake.NewSimpleClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := *review.Spec.ResourceAttributes
+		*reviewed = append(*reviewed, attributes)
+		if review.Spec.User == "broken" {
+			return true, nil, errors.New("authorization webhook unavailable")
+		}
+		if attributes.Group != adminGroup || attributes.Resource != adminResource {
+			return true, review, nil
+		}
+		for _, rule := range rules {
+			if rule.user == review.Spec.User && (rule.namespace == "" || rule.namespace == attributes.Namespace) &&
+				rule.subresource == attributes.Subresource && slices.Contains(rule.verbs, attributes.Verb) {
+				review.Status.Allowed = true
+				return true, review, nil
+			}
+		}
+		review.Status.Reason = "no RBAC policy matched"
+		return true, review, nil
+	})
+	return client
+}
+
+func TestAdminAuthSubjectAccessReview(t *testing.T) {
+	oldAuthenticator, oldAuthorizer := authenticator, authorizer
+	defer func() { authenticator, authorizer = oldAuthenticator, oldAuthorizer }()
+	authenticator = mapAuthenticator{
+		"alice":  {Username: "alice"},
+		"admin":  {Username: "admin", Groups: []string{"system:masters"}},
+		"broken": {Username: "broken"},
+	}
+	var reviewed []authorizationv1.ResourceAttributes
+	authorizer = NewSubjectAccessReviewAuthorizer(newSARClientset([]rbacRule{
+		{user: "alice", namespace: "team-a", verbs: []string{VerbList, VerbRelease, VerbReserve}},
+		{user: "admin", verbs: []string{VerbList, VerbRelease, VerbReserve}},
+		{user: "admin", subresource: "backup", verbs: []string{VerbGet}},
+		{user: "admin", subresource: "nodes", verbs: []string{VerbRelease}},
+	}, &reviewed))
+
+	served := func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r) == nil {
+			t.Errorf("%s: no user in the request context", r.URL)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/allocations", adminAuth(describeList, served))
+	mux.HandleFunc("POST /admin/allocations/{namespace}/{name}/reserve", adminAuth(describeReserve, served))
+	mux.HandleFunc("POST /admin/allocations/{namespace}/{name}/release", adminAuth(describeRelease, served))
+	mux.HandleFunc("/admin/backup", adminAuth(describeBackup, served))
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		token     string
+		code      int
+		reviewed  *authorizationv1.ResourceAttributes
+		forbidden string
+	}{
+		{
+			name: "no token", method: http.MethodGet, target: "/admin/allocations?namespace=team-a",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid token", method: http.MethodGet, target: "/admin/allocations?namespace=team-a",
+			token: "mallory", code: http.StatusUnauthorized,
+		},
+		{
+			name: "list in own namespace", method: http.MethodGet, target: "/admin/allocations?namespace=team-a",
+			token: "alice", code: http.StatusNoContent,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbList, Namespace: "team-a"},
+		},
+		{
+			name: "list in all namespaces", method: http.MethodGet, target: "/admin/allocations",
+			token: "alice", code: http.StatusForbidden,
+			reviewed:  &authorizationv1.ResourceAttributes{Verb: VerbList},
+			forbidden: "user alice may not list vniallocations in all namespaces: no RBAC policy matched",
+		},
+		{
+			name: "list in all namespaces as admin", method: http.MethodGet, target: "/admin/allocations",
+			token: "admin", code: http.StatusNoContent,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbList},
+		},
+		{
+			name: "reserve in own namespace", method: http.MethodPost, target: "/admin/allocations/team-a/shared/reserve",
+			token: "alice", code: http.StatusNoContent,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbReserve, Namespace: "team-a", Name: "shared"},
+		},
+		{
+			name: "release in other namespace", method: http.MethodPost, target: "/admin/allocations/team-b/shared/release",
+			token: "alice", code: http.StatusForbidden,
+			reviewed:  &authorizationv1.ResourceAttributes{Verb: VerbRelease, Namespace: "team-b", Name: "shared"},
+			forbidden: "user alice may not release vniallocations in namespace team-b: no RBAC policy matched",
+		},
+		{
+			name: "release nodes without the subresource", method: http.MethodPost,
+			target: "/admin/allocations/team-a/shared/release?nodes=true", token: "alice", code: http.StatusForbidden,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbRelease, Namespace: "team-a", Name: "shared",
+				Subresource: "nodes"},
+		},
+		{
+			name: "release nodes as admin", method: http.MethodPost,
+			target: "/admin/allocations/team-a/shared/release?nodes=true", token: "admin", code: http.StatusNoContent,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbRelease, Namespace: "team-a", Name: "shared",
+				Subresource: "nodes"},
+		},
+		{
+			name: "backup", method: http.MethodPost, target: "/admin/backup",
+			token: "alice", code: http.StatusForbidden,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbGet, Subresource: "backup"},
+		},
+		{
+			name: "backup as admin", method: http.MethodPost, target: "/admin/backup",
+			token: "admin", code: http.StatusNoContent,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbGet, Subresource: "backup"},
+		},
+		{
+			name: "authorizer error", method: http.MethodGet, target: "/admin/allocations",
+			token: "broken", code: http.StatusInternalServerError,
+			reviewed: &authorizationv1.ResourceAttributes{Verb: VerbList},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewed = nil
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			if recorder.Code != tt.code {
+				t.Fatalf("status %d (%s), want %d", recorder.Code, recorder.Body, tt.code)
+			}
+			if tt.code == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("401 without a WWW-Authenticate challenge")
+			}
+			if tt.forbidden != "" && recorder.Body.String() != tt.forbidden {
+				t.Errorf("body %q, want %q", recorder.Body, tt.forbidden)
+			}
+			if tt.reviewed == nil {
+				if len(reviewed) > 0 {
+					t.Errorf("reviewed %v for an unauthenticated request", reviewed)
+				}
+				return
+			}
+			want := *tt.reviewed
+			want.Group, want.Resource = adminGroup, adminResource
+			if len(reviewed) != 1 || reviewed[0] != want {
+				t.Errorf("reviewed %+v, want %+v", reviewed, want)
+			}
+		})
+	}
+}
+
+func TestSubjectAccessReviewUser(t *testing.T) {
+	client := kubefake.NewSimpleClientset()
+	var spec authorizationv1.SubjectAccessReviewSpec
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		spec = review.Spec
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	user := &UserInfo{Username: "system:serviceaccount:ops:admin", UID: "1234",
+		Groups: []string{"system:serviceaccounts", "system:serviceaccounts:ops"}}
+	allowed, _, err := NewSubjectAccessReviewAuthorizer(client).Authorize(context.TODO(), user,
+		AdminRequest{Verb: VerbList, Namespace: "ops"})
+	if err != nil || !allowed {
+		t.Fatalf("allowed %v: %v", allowed, err)
+	}
+	if spec.User != user.Username || spec.UID != user.UID || !slices.Equal(spec.Groups, user.Groups) {
+		t.Errorf("reviewed %+v for user %+v", spec, user)
+	}
+}
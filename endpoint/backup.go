@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupPrefix = "vni-backup-"
+const backupSuffix = ".sqlite3"
+
+var ErrInvalidBackup = errors.New("invalid backup file")
+
+// Backup writes a consistent copy of db to path using VACUUM INTO. It can run
+// while the endpoint is serving; writers are only blocked for the duration of
+// the copy.
+func Backup(db *sql.DB, path string) error {
+	_, err := db.ExecContext(context.TODO(), `vacuum into ?;`, path)
+	return err
+}
+
+// BackupToDir writes a timestamped backup of db into dir and removes all but
+// the newest keep backups. It returns the path of the new backup.
+func BackupToDir(db *sql.DB, dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405.000") + backupSuffix
+	path := filepath.Join(dir, name)
+	if err := Backup(db, path); err != nil {
+		return "", err
+	}
+	return path, rotateBackups(dir, keep)
+}
+
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	backups := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	// names embed a sortable UTC timestamp, so lexical order is age order
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		log.Printf("Removed old backup %s\n", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// StartBackups takes a backup into dir every interval until ctx is done.
+func StartBackups(ctx context.Context, filePath *string, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		db, err := open(filePath)
+		if err != nil {
+			log.Printf("Error opening db for backup: %v\n", err)
+			continue
+		}
+		path, err := BackupToDir(db, dir, keep)
+		db.Close()
+		if err != nil {
+			log.Printf("Error writing backup: %v\n", err)
+			continue
+		}
+		log.Printf("Wrote backup %s\n", path)
+	}
+}
+
+// ValidateBackup checks that the file at path is an intact database whose
+// schema version this binary can run on.
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	// mode=ro keeps the driver from creating an empty database on a bad path
+	db, err := sql.Open("sqlite3_with_extensions", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRowContext(context.TODO(), `pragma integrity_check;`).Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("%w: integrity check: %s", ErrInvalidBackup, integrity)
+	}
+
+	version, err := GetSchemaVersion(db)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if version < 1 {
+		return 0, fmt.Errorf("%w: no schema version recorded", ErrInvalidBackup)
+	}
+	if version > schemaVersion() {
+		return version, fmt.Errorf("%w: found %d, expected at most %d", ErrSchemaTooNew, version, schemaVersion())
+	}
+	return version, nil
+}
+
+// Restore replaces the database at filePath with the backup at backupPath.
+// The endpoint must not be running. The previous database is kept next to
+// filePath with a ".pre-restore-<timestamp>" suffix.
+func Restore(filePath *string, backupPath string) error {
+	version, err := ValidateBackup(backupPath)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := *filePath + ".restore"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if _, err := os.Stat(*filePath); err == nil {
+		oldPath := fmt.Sprintf("%s.pre-restore-%s", *filePath, time.Now().UTC().Format("20060102T150405"))
+		if err := os.Rename(*filePath, oldPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		log.Printf("Moved previous DB to %s\n", oldPath)
+	}
+	// stale journals belong to the replaced database
+	os.Remove(*filePath + "-journal")
+	os.Remove(*filePath + "-wal")
+	os.Remove(*filePath + "-shm")
+
+	if err := os.Rename(tmpPath, *filePath); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s (schema version %d)\n", *filePath, backupPath, version)
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cBackup takes an online backup and streams it to the caller.
+func cBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "vni-backup")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error creating backup dir: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sqliteStore, ok := store.(*SQLiteStore)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("backups are only supported for the sqlite store"))
+		return
+	}
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405.000") + backupSuffix
+	path := filepath.Join(tmpDir, name)
+	if err := Backup(sqliteStore.db, path); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error writing backup: %v\n", err)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reading backup: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error streaming backup: %v\n", err)
+	}
+}
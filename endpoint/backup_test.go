@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newPopulatedStore returns a test store holding two allocations, one of them
+// with a user.
+func newPopulatedStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s := newTestStore(t)
+	acquireTestVni(t, "vni-"+jobUid, "vnitest")
+	acquireTestVni(t, "my-claim", "vnitest")
+	if err := s.AddUser("my-claim", "vnitest", jobUid, true); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func backupNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestBackupRotateRestore(t *testing.T) {
+	s := newPopulatedStore(t)
+	want, err := s.ListAllocations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	old := []string{backupPrefix + "20240101T000000.000" + backupSuffix, backupPrefix + "20240102T000000.000" + backupSuffix}
+	for _, name := range append(old, "notes.txt") {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := BackupToDir(s.db, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the oldest backup is rotated out, other files are left alone
+	if names := backupNames(t, dir); !slices.Equal(names, []string{"notes.txt", old[1], filepath.Base(path)}) {
+		t.Errorf("backups after rotation = %v", names)
+	}
+
+	version, err := ValidateBackup(path)
+	if err != nil || version != schemaVersion() {
+		t.Fatalf("ValidateBackup = %d, %v, want %d", version, err, schemaVersion())
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "vni.db")
+	if err := os.WriteFile(dbPath, []byte("damaged"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(&dbPath, path); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(dbPath + ".pre-restore-*")
+	if len(matches) != 1 {
+		t.Errorf("previous DB kept as %v", matches)
+	}
+	restored, err := NewSQLiteStore(&dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	got, err := restored.ListAllocations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored allocations = %v, want %v", got, want)
+	}
+}
+
+func TestValidateBackupRejects(t *testing.T) {
+	s := newPopulatedStore(t)
+	dir := t.TempDir()
+
+	tooNew := filepath.Join(dir, "too-new.sqlite3")
+	if err := Backup(s.db, tooNew); err != nil {
+		t.Fatal(err)
+	}
+	newer, err := open(&tooNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newer.Exec(`insert into schema_version (version, description, ts) values (?, 'from a newer release', '2024-05-02 09:00:00');`,
+		schemaVersion()+1)
+	newer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.sqlite3")
+	if err := os.WriteFile(corrupt, []byte(strings.Repeat("not a database ", 512)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.sqlite3")
+	emptyDB, err := open(&empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = emptyDB.Exec(`create table unrelated (id integer);`)
+	emptyDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want error
+	}{
+		{name: "too new", path: tooNew, want: ErrSchemaTooNew},
+		{name: "corrupt", path: corrupt, want: ErrInvalidBackup},
+		{name: "no schema", path: empty, want: ErrInvalidBackup},
+		{name: "missing", path: filepath.Join(dir, "missing.sqlite3"), want: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ValidateBackup(tt.path); !errors.Is(err, tt.want) {
+				t.Errorf("ValidateBackup: %v, want %v", err, tt.want)
+			}
+			// a rejected backup leaves the database alone
+			dbPath := filepath.Join(t.TempDir(), "vni.db")
+			if err := os.WriteFile(dbPath, []byte("current"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := Restore(&dbPath, tt.path); !errors.Is(err, tt.want) {
+				t.Errorf("Restore: %v, want %v", err, tt.want)
+			}
+			if data, err := os.ReadFile(dbPath); err != nil || string(data) != "current" {
+				t.Errorf("database replaced by a rejected backup: %q, %v", data, err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.sqlite3")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("validating a missing backup created it")
+	}
+}
+
+func TestBackupHandler(t *testing.T) {
+	s := newPopulatedStore(t)
+	want, err := s.ListAllocations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	cBackup(recorder, httptest.NewRequest(http.MethodPost, "/admin/backup", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/vnd.sqlite3" {
+		t.Errorf("Content-Type %s", contentType)
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, backupPrefix) {
+		t.Errorf("Content-Disposition %s", disposition)
+	}
+
+	path := filepath.Join(t.TempDir(), "download.sqlite3")
+	if err := os.WriteFile(path, recorder.Body.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateBackup(path); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := NewSQLiteStore(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloaded.Close()
+	if got, err := downloaded.ListAllocations(""); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("downloaded allocations = %v, %v, want %v", got, err, want)
+	}
+
+	recorder = httptest.NewRecorder()
+	cBackup(recorder, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+
+	store = &KubeStore{}
+	recorder = httptest.NewRecorder()
+	cBackup(recorder, httptest.NewRequest(http.MethodPost, "/admin/backup", nil))
+	if recorder.Code != http.StatusNotImplemented {
+		t.Errorf("kube store: status %d, want %d", recorder.Code, http.StatusNotImplemented)
+	}
+}
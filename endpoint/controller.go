@@ -5,10 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/tidwall/gjson"
-	"io"
+	corev1 "k8s.io/api/core/v1"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func cVersion(w http.ResponseWriter, r *http.Request) {
@@ -18,109 +19,172 @@ func cVersion(w http.ResponseWriter, r *http.Request) {
 
 func cSync(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	body, _ := io.ReadAll(r.Body)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
 
-	var syncHookRequest DecoratorSyncHookRequest
-	err := json.Unmarshal(body, &syncHookRequest)
+	var hookRequest DecoratorHookRequest
+	err := decodeHookRequest(body, &hookRequest)
+	if err == nil {
+		err = validateHookRequest(hookRequest)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
-		log.Printf("Error reading body: %v\n", err.Error())
+		rejectedRequests.WithLabelValues(r.Pattern, reasonInvalid).Inc()
+		log.Printf("Rejected hook request: %v\n", err)
 		return
 	}
-	attachments := syncHookRequest.Attachments
-
-	callerKind := gjson.GetBytes(body, "object.kind").String()
-	callerApiVersion := gjson.GetBytes(body, "object.apiVersion").String()
-	callerUid := gjson.GetBytes(body, "object.metadata.uid").String()
-	callerNamespace := gjson.GetBytes(body, "object.metadata.namespace").String()
-
-	callerAnnotations := gjson.GetBytes(body, "object.metadata.annotations").Map()
-	var callerAnnotationVni string
-	if callerAnnotations != nil {
-		callerAnnotationVni = strings.ToLower(callerAnnotations["vni"].String())
-	}
+	attachments := hookRequest.Attachments
 
-	syncHookResponse := DecoratorSyncHookResponse{}
+	callerUid := string(hookRequest.Object.Metadata.UID)
+	callerNamespace := hookRequest.Object.Metadata.Namespace
+	object := gjson.GetBytes(body, "object")
 
-	db, err := open(DBFilePath)
+	request, requested, err := resolveVniRequest(r.Context(), object)
 	if err != nil {
-		log.Printf("Error opening db: %v\n", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
+		log.Printf("Error resolving VNI request of %s/%s: %v\n", callerNamespace, callerUid, err)
 		return
 	}
-	defer db.Close()
 
-	for k, _ := range attachments {
-		if k == "Vni.horizon-opencube.eu/v1" {
-			var vniUid string
-			if callerApiVersion == "horizon-opencube.eu/v1" && callerKind == "VniClaim" {
-				vniUid = gjson.GetBytes(body, "object.spec.name").String()
-			} else {
-				vniUid = fmt.Sprintf("vni-%s", callerUid)
-			}
+	syncHookResponse := DecoratorSyncHookResponse{Attachments: make([]Vni, 0)}
 
-			if (callerApiVersion == "horizon-opencube.eu/v1" && callerKind == "VniClaim") ||
-				callerAnnotationVni == "true" || callerAnnotationVni == "yes" {
+	for k, observed := range attachments {
+		if k == vniAttachmentKey && requested {
+			if request.Owns {
 				// we own the VNI - create one
-				vni, err := Acquire(db, vniUid, callerNamespace, vniMin, vniMax, shouldLog)
+				vniUid := request.VniUid
+				profile, err := requestedProfile(object)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(err.Error()))
+					log.Printf("Rejected CXI profile: %v\n", err)
+					return
+				}
+				restored, err := restoreAllocation(vniUid, callerNamespace, observed)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(err.Error()))
+					log.Printf("Error restoring VNI: %v\n", err)
+					return
+				}
+				vni, err := acquireVni(vniUid, callerNamespace)
+				if errors.Is(err, ErrNoFreeVNI) {
+					recordEvent(object, corev1.EventTypeWarning, EventPoolExhausted,
+						"No free VNI for namespace %s, retrying", callerNamespace)
+				}
+				if errors.Is(err, ErrNoPool) {
+					recordEvent(object, corev1.EventTypeWarning, EventNoPool,
+						"No VniPool allows namespace %s", callerNamespace)
+				}
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(err.Error()))
 					log.Printf("Error acquiring VNI: %v\n", err)
 					return
 				}
-				newVni := Vni{
-					ApiVersion: "horizon-opencube.eu/v1",
-					Kind:       "Vni",
-					Metadata:   map[string]string{"name": vniUid, "namespace": callerNamespace},
-					Spec:       map[string]int{"vni": vni},
+				err = store.SetProfile(vniUid, callerNamespace, profile)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(err.Error()))
+					log.Printf("Error storing CXI profile: %v\n", err)
+					return
+				}
+				if _, ok := observed[vniUid]; !ok {
+					recordEvent(object, corev1.EventTypeNormal, EventVniAllocated, "Allocated VNI %d as %s", vni, vniUid)
+				}
+				desired := newVni(vniUid, callerNamespace,
+					VniSpec{Vni: vni, TrafficClasses: profile.TrafficClasses, Limits: profile.Limits})
+				lastDrift := gjson.GetBytes(hookRequest.Object.Status, "lastDrift").String()
+				if restored != "" {
+					reportDrift(object, restored, driftRestored)
+					lastDrift = restored
+				} else if drift, kind := compareAttachment(observed, desired); drift != "" {
+					reportDrift(object, drift, kind)
+					lastDrift = drift
+				}
+				syncHookResponse.Attachments = append(syncHookResponse.Attachments, desired)
+				if hookRequest.Object.ApiVersion == vniApiVersion && hookRequest.Object.Kind == "VniClaim" {
+					syncHookResponse.Status = &VniClaimStatus{Phase: ClaimActive, Vni: vni, VniUid: vniUid, LastDrift: lastDrift}
+				}
+			} else {
+				// update target VNI (of a VniClaim, reservation or ancestor) by
+				//  adding callerUid to user table
+				targetVniUid := request.VniUid
+				// switching from its own VNI to the inherited one is no drift
+				switching := false
+				if request.Ancestor != "" {
+					switching = releaseOwnAllocation(callerNamespace, callerUid)
 				}
-				syncHookResponse.Attachments = append(syncHookResponse.Attachments, newVni)
-			} else if callerAnnotationVni != "" {
-				// update target VNI by adding callerUid to user table
-				//  only do that for non-VniClaims
 
-				err := AddUser(db, callerAnnotationVni, callerNamespace, callerUid, shouldLog)
+				err := store.AddUser(targetVniUid, callerNamespace, callerUid, shouldLog)
+				if errors.Is(err, ErrVNINotFound) && request.Ancestor != "" {
+					// the ancestor has not been synced yet
+					log.Printf("Waiting for the VNI of %s (%s %s)\n", request.Ancestor, callerNamespace, callerUid)
+					syncHookResponse.ResyncAfterSeconds = 2
+					continue
+				}
+				if errors.Is(err, ErrVNINotFound) {
+					recordEvent(object, corev1.EventTypeWarning, EventClaimNotFound,
+						"No VniClaim or reservation named %s in namespace %s", targetVniUid, callerNamespace)
+				}
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(err.Error()))
 					log.Printf("Error adding user: %v (%s %s %s)\n",
-						err, callerAnnotationVni, callerNamespace, callerUid)
+						err, targetVniUid, callerNamespace, callerUid)
 					return
 				}
 
-				vni, err := GetVni(db, callerAnnotationVni, callerNamespace)
+				vni, err := store.GetVni(targetVniUid, callerNamespace)
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(err.Error()))
 					log.Printf("Error getting VNI: %s (%s %s)\n",
-						vniUid, callerNamespace, callerUid)
+						targetVniUid, callerNamespace, callerUid)
 					return
 				}
 
 				if vni == -1 {
+					recordEvent(object, corev1.EventTypeWarning, EventClaimNotFound,
+						"No VniClaim or reservation named %s in namespace %s", targetVniUid, callerNamespace)
 					w.WriteHeader(http.StatusNotFound)
-					w.Write([]byte(err.Error()))
+					w.Write([]byte(ErrVNINotFound.Error()))
 					log.Printf("No VNI for VNI UID: %s (%s %s)\n",
-						vniUid, callerNamespace, callerUid)
+						targetVniUid, callerNamespace, callerUid)
+					return
+				}
+
+				// the claim's profile applies to all jobs redeeming it
+				profile, err := store.GetProfile(targetVniUid, callerNamespace)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(err.Error()))
+					log.Printf("Error getting CXI profile: %v\n", err)
 					return
 				}
 
 				virtualVniUid := fmt.Sprintf("vni-%s", callerUid)
-				newVni := Vni{
-					ApiVersion: "horizon-opencube.eu/v1",
-					Kind:       "Vni",
-					Metadata:   map[string]string{"name": virtualVniUid, "namespace": callerNamespace},
-					Spec:       map[string]int{"vni": vni},
+				if _, ok := observed[virtualVniUid]; !ok {
+					source := targetVniUid
+					if request.Ancestor != "" {
+						source = request.Ancestor
+					}
+					recordEvent(object, corev1.EventTypeNormal, EventClaimJoined, "Joined VNI %d of %s", vni, source)
+				}
+				desired := newVni(virtualVniUid, callerNamespace,
+					VniSpec{Vni: vni, TrafficClasses: profile.TrafficClasses, Limits: profile.Limits})
+				if drift, kind := compareAttachment(observed, desired); drift != "" && !switching {
+					reportDrift(object, drift, kind)
 				}
-				syncHookResponse.Attachments = append(syncHookResponse.Attachments, newVni)
+				syncHookResponse.Attachments = append(syncHookResponse.Attachments, desired)
 			}
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(syncHookResponse)
 
@@ -134,126 +198,130 @@ func cSync(w http.ResponseWriter, r *http.Request) {
 
 func cFinalize(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	body, _ := io.ReadAll(r.Body)
-
-	var syncHookRequest DecoratorSyncHookRequest
-	err := json.Unmarshal(body, &syncHookRequest)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		log.Printf("Error reading body: %v\n", err.Error())
+	body, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
-	callerKind := gjson.GetBytes(body, "object.kind").String()
-	callerApiVersion := gjson.GetBytes(body, "object.apiVersion").String()
-
-	callerAnnotations := gjson.GetBytes(body, "object.metadata.annotations").Map()
-	var callerAnnotationVni string
-	if callerAnnotations != nil {
-		callerAnnotationVni = strings.ToLower(callerAnnotations["vni"].String())
+	var hookRequest DecoratorHookRequest
+	err := decodeHookRequest(body, &hookRequest)
+	if err == nil {
+		err = validateHookRequest(hookRequest)
 	}
-
-	callerUid := gjson.GetBytes(body, "object.metadata.uid").String()
-	callerNamespace := gjson.GetBytes(body, "object.metadata.namespace").String()
-
-	db, err := open(DBFilePath)
 	if err != nil {
-		log.Printf("Error opening db: %v\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
+		rejectedRequests.WithLabelValues(r.Pattern, reasonInvalid).Inc()
+		log.Printf("Rejected hook request: %v\n", err)
 		return
 	}
-	defer db.Close()
 
-	finalized := true
-	attachments := syncHookRequest.Attachments
-	for k, attachment := range attachments {
-		if k == "Vni.horizon-opencube.eu/v1" {
-			vni, ok := attachment.(map[string]interface{})
-			if !ok {
-				log.Printf("Error handling VNI attachment: %v\n", attachment)
-				continue
-			}
+	caller := hookRequest.Object
+	callerAnnotationVni := strings.ToLower(caller.Metadata.Annotations["vni"])
+	callerUid := string(caller.Metadata.UID)
+	callerNamespace := caller.Metadata.Namespace
+	object := gjson.GetBytes(body, "object")
+	isClaim := caller.ApiVersion == vniApiVersion && caller.Kind == "VniClaim"
 
-			for vniUid, vniBody := range vni {
+	now := time.Now()
+	since, started := drainingSince(caller.Metadata.Annotations, now)
+	// users of the VNIs that are not released yet
+	var draining []string
+	finalizeHookResponse := DecoratorFinalizeHookResponse{}
+	finalizeHookResponse.Attachments = make([]Vni, 0)
+
+	finalized := true
+	attachments := hookRequest.Attachments
+	for k, observed := range attachments {
+		if k == vniAttachmentKey {
+			for vniUid, vniBody := range observed {
 				// Metacontroller wants to have finalized=false in case the received state
 				//  does not match the desired state, yet
 				//  so if there are still attached VNIs, set finalized to false
 				finalized = false
 
-				vniUidParts := strings.Split(vniUid, "-")
-
-				vniBodyParsed, ok := vniBody.(map[string]interface{})
-				if !ok {
-					log.Printf("Error handling VNI attachment: %v\n", attachment)
-					continue
-				}
+				// validateHookRequest checked it is the parent's
+				vniNamespace := vniBody.Metadata.Namespace
 
-				metadata := vniBodyParsed["metadata"]
-				metadataParsed, ok := metadata.(map[string]interface{})
-				if !ok {
-					log.Printf("Error handling VNI attachment: %v\n", attachment)
-					continue
-				}
-				vniNamespace := metadataParsed["namespace"].(string)
-
-				if callerApiVersion == "horizon-opencube.eu/v1" && callerKind == "VniClaim" {
+				if isClaim {
 					// we are a VniClaim - only release VNI if no other users are using it
 
-					err = ReleaseUserCheck(db, vniUid, vniNamespace, shouldLog)
-					if errors.Is(err, ErrVNINotFound) {
-						continue
-					} else if errors.Is(err, ErrVNIInUse) {
-						w.Write([]byte("VNI still in use, will not release\n"))
-						log.Printf("VNI still in use, will not release\n")
-						finalized = false
-						continue
-					} else if err != nil {
+					released, users, err := releaseOrDrain(object, vniUid, vniNamespace, since, started, now)
+					if err != nil {
 						w.WriteHeader(http.StatusInternalServerError)
 						w.Write([]byte(err.Error()))
 						log.Printf("Error releasing VNI: %v\n", err)
 						return
 					}
-				} else if (callerAnnotationVni == "true" || callerAnnotationVni == "yes") &&
-					(len(vniUidParts) > 1 && strings.Join(vniUidParts[1:], "-") == callerUid) {
-					// we requested a VNI & own it - release it immediately
-
-					err = ReleaseUserCheck(db, vniUid, vniNamespace, shouldLog)
+					if !released {
+						// keep the attachment until the VNI is released
+						draining = append(draining, users...)
+						finalizeHookResponse.Attachments = append(finalizeHookResponse.Attachments, newVni(vniUid, vniNamespace, vniBody.Spec))
+					}
+				} else if fmt.Sprintf("vni-%s", callerUid) == vniUid {
+					// we are a Job et al. that redeemed a VNI Claim or inherited the
+					//  VNI of an ancestor - remove callerUid from the user table
+					err := removeUserEverywhere(callerNamespace, callerUid)
 					if err != nil {
 						w.WriteHeader(http.StatusInternalServerError)
 						w.Write([]byte(err.Error()))
-						log.Printf("Error releasing VNI: %v\n", err)
+						log.Printf("Error removing user: %v\n", err)
 						return
 					}
-				} else if callerAnnotationVni != "" &&
-					!(callerAnnotationVni == "true" || callerAnnotationVni == "yes") &&
-					fmt.Sprintf("vni-%s", callerUid) == vniUid {
-					// we are a Job et al. and redeem a VNI Claim
-					//  update target VNI by removing callerUid from user table
+					if callerAnnotationVni != "true" && callerAnnotationVni != "yes" {
+						continue
+					}
 
-					err := RemoveUser(db, callerAnnotationVni, callerNamespace, callerUid, shouldLog)
+					// we requested a VNI & may own it - release it immediately, together
+					//  with the children that inherited it
+					err = detachInheritors(vniUid, vniNamespace)
 					if err != nil {
 						w.WriteHeader(http.StatusInternalServerError)
 						w.Write([]byte(err.Error()))
-						log.Printf("Error removing user: %v\n", err)
+						log.Printf("Error removing users: %v\n", err)
 						return
 					}
+					released, users, err := releaseOrDrain(object, vniUid, vniNamespace, since, started, now)
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						w.Write([]byte(err.Error()))
+						log.Printf("Error releasing VNI: %v\n", err)
+						return
+					}
+					if !released {
+						// a node still holds a CXI service for the VNI
+						draining = append(draining, users...)
+						finalizeHookResponse.Attachments = append(finalizeHookResponse.Attachments, newVni(vniUid, vniNamespace, vniBody.Spec))
+					}
 				}
 			}
 		}
 	}
 
-	syncHookResponse := DecoratorFinalizeHookResponse{
-		Finalized:   finalized,
-		Attachments: make([]interface{}, 0),
-	}
-	if !finalized {
-		syncHookResponse.ResyncAfterSeconds = 5
+	finalizeHookResponse.Finalized = finalized
+	if len(finalizeHookResponse.Attachments) > 0 {
+		// draining
+		if !started {
+			value := since.Format(time.RFC3339)
+			finalizeHookResponse.Annotations = map[string]*string{drainingSinceAnnotation: &value}
+		}
+		finalizeHookResponse.ResyncAfterSeconds = drainPolicy.resync(since, now).Seconds()
+		if isClaim {
+			finalizeHookResponse.Status = &VniClaimStatus{Phase: ClaimDraining, VniUid: gjson.GetBytes(caller.Spec, "name").String(),
+				Vni: int(gjson.GetBytes(caller.Status, "vni").Int()), Users: draining, DrainingSince: since.Format(time.RFC3339)}
+		}
+	} else {
+		if !finalized {
+			// wait for Metacontroller to delete the attachments
+			finalizeHookResponse.ResyncAfterSeconds = drainPolicy.Backoff.Seconds()
+		}
+		if isClaim {
+			finalizeHookResponse.Status = &VniClaimStatus{Phase: ClaimReleased}
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(syncHookResponse)
+	err = json.NewEncoder(w).Encode(finalizeHookResponse)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -261,3 +329,44 @@ func cFinalize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// releaseOrDrain releases the allocation vniUid of a parent being finalized.
+// While jobs or nodes still use it, released is false and users lists them;
+// once the parent has been draining longer than the drain timeout, the jobs
+// are detached and the VNI is released as soon as no node uses it.
+func releaseOrDrain(object gjson.Result, vniUid string, namespace string,
+	since time.Time, started bool, now time.Time) (released bool, users []string, err error) {
+	err = store.ReleaseUserCheck(vniUid, namespace, shouldLog)
+	if errors.Is(err, ErrVNIInUse) && drainPolicy.expired(since, now) {
+		users, err = forceDetach(vniUid, namespace)
+		if err != nil {
+			return false, nil, err
+		}
+		if len(users) > 0 {
+			log.Printf("Detached %v from %s/%s after draining for %v\n", users, namespace, vniUid, now.Sub(since))
+			recordEvent(object, corev1.EventTypeWarning, EventUsersDetached,
+				"Detached %s from VNI %s after draining for %v", strings.Join(users, ", "), vniUid, now.Sub(since).Round(time.Second))
+		}
+		err = store.ReleaseUserCheck(vniUid, namespace, shouldLog)
+	}
+	switch {
+	case errors.Is(err, ErrVNINotFound):
+		// inherited, or released before
+		return true, nil, nil
+	case errors.Is(err, ErrVNIInUse):
+		users, err = allocationUsers(vniUid, namespace)
+		if err != nil {
+			return false, nil, err
+		}
+		if !started {
+			log.Printf("VNI %s/%s still in use by %v, draining\n", namespace, vniUid, users)
+			recordEvent(object, corev1.EventTypeNormal, EventReleaseDeferred,
+				"VNI %s is still used by %s, release deferred", vniUid, strings.Join(users, ", "))
+		}
+		return false, users, nil
+	case err != nil:
+		return false, nil, err
+	}
+	recordEvent(object, corev1.EventTypeNormal, EventVniReleased, "Released VNI %s", vniUid)
+	return true, nil, nil
+}
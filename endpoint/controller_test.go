@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// The hook requests in testdata/hooks follow the bodies Metacontroller posts
+// for the DecoratorController in config/vni-controller.yml, including
+// managedFields, finalizers and the deletionTimestamp of finalize requests.
+
+const (
+	deploymentUid = "3f9c2a6e-7d41-4e0b-8c1f-2b5d9e7a4c10"
+	jobUid        = "b7e4d1c2-9a3f-4c56-8e21-0f6a5b4c3d2e"
+	claimUid      = "0d6f1e2a-3b4c-4d5e-8f90-a1b2c3d4e5f6"
+	volcanoUid    = "c41a7f90-5e2d-4b8c-9d3e-6f7a8b9c0d1e"
+)
+
+// newTestStore sets the global store to an empty SQLite database and the
+// hooks to their defaults.
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vni.db")
+	s, err := NewSQLiteStore(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	oldStore, oldLog, oldRecorder, oldPodClient := store, shouldLog, eventRecorder, podClient
+	t.Cleanup(func() { store, shouldLog, eventRecorder, podClient = oldStore, oldLog, oldRecorder, oldPodClient })
+	store, shouldLog, eventRecorder, podClient = s, true, nil, nil
+	if err := setAllowedParents(defaultAllowedParents); err != nil {
+		t.Fatal(err)
+	}
+	vniPools.Lock()
+	vniPools.byName = make(map[string]*vniPool)
+	vniPools.Unlock()
+	return s
+}
+
+func readHook(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "hooks", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// callHook posts body to handler and returns the status and response body.
+func callHook(handler http.HandlerFunc, body []byte) (int, []byte) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body)))
+	return recorder.Code, recorder.Body.Bytes()
+}
+
+// assertJSON fails unless got and want encode the same JSON value.
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("response %q: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("expected %q: %v", want, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("response\n  %s\nwant\n  %s", bytes.TrimSpace(got), want)
+	}
+}
+
+func acquireTestVni(t *testing.T, vniUid string, namespace string) int {
+	t.Helper()
+	vni, err := acquireVni(vniUid, namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vni
+}
+
+func TestDecodeHookRequest(t *testing.T) {
+	tests := []struct {
+		file        string
+		apiVersion  string
+		kind        string
+		uid         string
+		namespace   string
+		finalizing  bool
+		attachments []string
+	}{
+		{"sync-deployment.json", "apps/v1", "Deployment", deploymentUid, "vnitest", false, nil},
+		{"sync-job-claim.json", "batch/v1", "Job", jobUid, "vnitest", false, nil},
+		{"sync-vniclaim.json", vniApiVersion, "VniClaim", claimUid, "vnitest", false, nil},
+		{"sync-volcano.json", "batch.volcano.sh/v1alpha1", "Job", volcanoUid, "vnitest", false, []string{"vni-" + volcanoUid}},
+		{"finalize-deployment.json", "apps/v1", "Deployment", deploymentUid, "vnitest", true, []string{"vni-" + deploymentUid}},
+		{"finalize-job-claim.json", "batch/v1", "Job", jobUid, "vnitest", true, []string{"vni-" + jobUid}},
+		{"finalize-vniclaim.json", vniApiVersion, "VniClaim", claimUid, "vnitest", true, []string{"my-claim"}},
+		{"finalize-volcano.json", "batch.volcano.sh/v1alpha1", "Job", volcanoUid, "vnitest", true, []string{"vni-" + volcanoUid}},
+		{"finalize-no-namespace.json", "batch/v1", "Job", jobUid, "", true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			var request DecoratorHookRequest
+			if err := decodeHookRequest(readHook(t, test.file), &request); err != nil {
+				t.Fatal(err)
+			}
+			object := request.Object
+			if object.ApiVersion != test.apiVersion || object.Kind != test.kind {
+				t.Errorf("parent %s %s, want %s %s", object.ApiVersion, object.Kind, test.apiVersion, test.kind)
+			}
+			if string(object.Metadata.UID) != test.uid || object.Metadata.Namespace != test.namespace {
+				t.Errorf("parent %s/%s, want %s/%s", object.Metadata.Namespace, object.Metadata.UID, test.namespace, test.uid)
+			}
+			if request.Finalizing != test.finalizing {
+				t.Errorf("finalizing %v, want %v", request.Finalizing, test.finalizing)
+			}
+			if request.Controller.Kind != "DecoratorController" {
+				t.Errorf("controller kind %s", request.Controller.Kind)
+			}
+			observed, ok := request.Attachments[vniAttachmentKey]
+			if !ok {
+				t.Fatalf("no %s attachments", vniAttachmentKey)
+			}
+			var names []string
+			for name, vni := range observed {
+				names = append(names, name)
+				if vni.Spec.Vni != 100 || vni.Metadata.Namespace != test.namespace {
+					t.Errorf("attachment %s: VNI %d in %q", name, vni.Spec.Vni, vni.Metadata.Namespace)
+				}
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, test.attachments) {
+				t.Errorf("attachments %v, want %v", names, test.attachments)
+			}
+		})
+	}
+}
+
+func TestDecodeHookRequestStrict(t *testing.T) {
+	body := readHook(t, "sync-deployment.json")
+	tests := map[string][]byte{
+		"unknown field":   bytes.Replace(body, []byte(`"finalizing"`), []byte(`"finalising": false, "finalizing"`), 1),
+		"trailing object": append(append([]byte{}, body...), []byte(`{}`)...),
+		"truncated":       body[:len(body)/2],
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			var request DecoratorHookRequest
+			if err := decodeHookRequest(body, &request); err == nil {
+				t.Error("decoded")
+			}
+		})
+	}
+}
+
+func TestHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		file    string
+		// setup prepares the database before the request
+		setup  func(t *testing.T)
+		status int
+		// response is the expected JSON, or a prefix of the error message
+		response string
+		// allocations are the VNI UIDs allocated in vnitest afterwards
+		allocations []string
+	}{
+		{
+			name: "deployment sync", handler: cSync, file: "sync-deployment.json",
+			status: http.StatusOK,
+			response: `{"attachments": [{"apiVersion": "horizon-opencube.eu/v1", "kind": "Vni",
+				"metadata": {"name": "vni-` + deploymentUid + `", "namespace": "vnitest", "creationTimestamp": null},
+				"spec": {"vni": 100}}]}`,
+			allocations: []string{"vni-" + deploymentUid},
+		},
+		{
+			name: "job redeeming a claim", handler: cSync, file: "sync-job-claim.json",
+			setup:  func(t *testing.T) { acquireTestVni(t, "my-claim", "vnitest") },
+			status: http.StatusOK,
+			response: `{"attachments": [{"apiVersion": "horizon-opencube.eu/v1", "kind": "Vni",
+				"metadata": {"name": "vni-` + jobUid + `", "namespace": "vnitest", "creationTimestamp": null},
+				"spec": {"vni": 100}}]}`,
+			allocations: []string{"my-claim"},
+		},
+		{
+			name: "job redeeming a missing claim", handler: cSync, file: "sync-job-claim.json",
+			status:   http.StatusInternalServerError,
+			response: ErrVNINotFound.Error(),
+		},
+		{
+			name: "claim sync", handler: cSync, file: "sync-vniclaim.json",
+			status: http.StatusOK,
+			response: `{"status": {"phase": "Active", "vni": 100, "vniUid": "my-claim"},
+				"attachments": [{"apiVersion": "horizon-opencube.eu/v1", "kind": "Vni",
+				"metadata": {"name": "my-claim", "namespace": "vnitest", "creationTimestamp": null},
+				"spec": {"vni": 100}}]}`,
+			allocations: []string{"my-claim"},
+		},
+		{
+			name: "volcano job resync", handler: cSync, file: "sync-volcano.json",
+			setup:  func(t *testing.T) { acquireTestVni(t, "vni-"+volcanoUid, "vnitest") },
+			status: http.StatusOK,
+			response: `{"attachments": [{"apiVersion": "horizon-opencube.eu/v1", "kind": "Vni",
+				"metadata": {"name": "vni-` + volcanoUid + `", "namespace": "vnitest", "creationTimestamp": null},
+				"spec": {"vni": 100}}]}`,
+			allocations: []string{"vni-" + volcanoUid},
+		},
+		{
+			name: "deployment finalize", handler: cFinalize, file: "finalize-deployment.json",
+			setup:    func(t *testing.T) { acquireTestVni(t, "vni-"+deploymentUid, "vnitest") },
+			status:   http.StatusOK,
+			response: `{"attachments": [], "resyncAfterSeconds": 5, "finalized": false}`,
+		},
+		{
+			// GetVni returns -1 without an error: the allocation is gone,
+			// e.g. released by an earlier finalize
+			name: "deployment finalize without allocation", handler: cFinalize, file: "finalize-deployment.json",
+			status:   http.StatusOK,
+			response: `{"attachments": [], "resyncAfterSeconds": 5, "finalized": false}`,
+		},
+		{
+			name: "job finalize keeps the claim", handler: cFinalize, file: "finalize-job-claim.json",
+			setup: func(t *testing.T) {
+				acquireTestVni(t, "my-claim", "vnitest")
+				if err := store.AddUser("my-claim", "vnitest", jobUid, false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status:      http.StatusOK,
+			response:    `{"attachments": [], "resyncAfterSeconds": 5, "finalized": false}`,
+			allocations: []string{"my-claim"},
+		},
+		{
+			name: "claim finalize", handler: cFinalize, file: "finalize-vniclaim.json",
+			setup:    func(t *testing.T) { acquireTestVni(t, "my-claim", "vnitest") },
+			status:   http.StatusOK,
+			response: `{"status": {"phase": "Released"}, "attachments": [], "resyncAfterSeconds": 5, "finalized": false}`,
+		},
+		{
+			name: "claim finalize while redeemed", handler: cFinalize, file: "finalize-vniclaim.json",
+			setup: func(t *testing.T) {
+				acquireTestVni(t, "my-claim", "vnitest")
+				if err := store.AddUser("my-claim", "vnitest", jobUid, false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status:      http.StatusOK,
+			allocations: []string{"my-claim"},
+		},
+		{
+			name: "volcano job finalize", handler: cFinalize, file: "finalize-volcano.json",
+			setup:    func(t *testing.T) { acquireTestVni(t, "vni-"+volcanoUid, "vnitest") },
+			status:   http.StatusOK,
+			response: `{"attachments": [], "resyncAfterSeconds": 5, "finalized": false}`,
+		},
+		{
+			name: "finalize without namespace", handler: cFinalize, file: "finalize-no-namespace.json",
+			status:   http.StatusBadRequest,
+			response: "invalid hook request: parent has no metadata.namespace",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestStore(t)
+			if test.setup != nil {
+				test.setup(t)
+			}
+			status, response := callHook(test.handler, readHook(t, test.file))
+			if status != test.status {
+				t.Fatalf("status %d, want %d: %s", status, test.status, response)
+			}
+			switch {
+			case test.response == "":
+			case status == http.StatusOK:
+				assertJSON(t, response, test.response)
+			case !strings.HasPrefix(string(response), test.response):
+				t.Errorf("response %q, want %q", response, test.response)
+			}
+
+			allocations, err := store.ListAllocations("vnitest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vniUids []string
+			for _, allocation := range allocations {
+				vniUids = append(vniUids, allocation.VniUid)
+			}
+			if !slices.Equal(vniUids, test.allocations) {
+				t.Errorf("allocations %v, want %v", vniUids, test.allocations)
+			}
+		})
+	}
+}
+
+// TestClaimFinalizeDraining checks the response that keeps a redeemed
+// claim's attachment while it drains.
+func TestClaimFinalizeDraining(t *testing.T) {
+	newTestStore(t)
+	acquireTestVni(t, "my-claim", "vnitest")
+	if err := store.AddUser("my-claim", "vnitest", jobUid, false); err != nil {
+		t.Fatal(err)
+	}
+	status, body := callHook(cFinalize, readHook(t, "finalize-vniclaim.json"))
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var response DecoratorFinalizeHookResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Finalized || len(response.Attachments) != 1 || response.Attachments[0].Metadata.Name != "my-claim" {
+		t.Errorf("finalized %v with attachments %v", response.Finalized, response.Attachments)
+	}
+	if response.Status == nil || response.Status.Phase != ClaimDraining || !slices.Equal(response.Status.Users, []string{jobUid}) {
+		t.Errorf("status %+v", response.Status)
+	}
+	if response.Annotations[drainingSinceAnnotation] == nil {
+		t.Errorf("no %s annotation", drainingSinceAnnotation)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node agents report the VNIs they hold CXI services for. While a node holds
+// a service, it is attached to the allocation as the user cxiNodeUserPrefix +
+// node name, so the VNI is not released, and cannot leave quarantine, before
+// the node has torn the service down.
+const cxiNodeUserPrefix = "cxi-node/"
+
+// CxiServiceReport is sent by a node agent after each reconciliation. Vnis is
+// the complete list of services on the node.
+type CxiServiceReport struct {
+	Node string           `json:"node"`
+	Vnis []CxiReportedVni `json:"vnis"`
+}
+
+type CxiReportedVni struct {
+	Namespace string `json:"namespace"`
+	Vni       int    `json:"vni"`
+}
+
+func cxiNodeUser(node string) string {
+	return cxiNodeUserPrefix + node
+}
+
+// cxiReports remembers when each node last reported, so that the users of
+// nodes whose agent is gone can be detached.
+var cxiReports = struct {
+	mu      sync.Mutex
+	last    map[string]time.Time
+	started time.Time
+}{last: make(map[string]time.Time), started: time.Now()}
+
+// cCxiReport attaches the reporting node to the allocations it holds services
+// for, and detaches it from all others. With authentication, an agent may
+// only report for the node its credentials are bound to.
+func cCxiReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var report CxiServiceReport
+	if err := json.Unmarshal(body, &report); err != nil || report.Node == "" {
+		if err == nil {
+			err = invalidRequest("node missing")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reading body: %v\n", err)
+		return
+	}
+	if user := requestUser(r); user != nil {
+		if node, ok := user.Node(); !ok || node != report.Node {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(fmt.Sprintf("user %s may not report CXI services of node %s", user.Username, report.Node)))
+			log.Printf("Rejected CXI report of node %s from user %s bound to node %q\n", report.Node, user.Username, node)
+			return
+		}
+	}
+
+	held := make(map[string]bool)
+	for _, vni := range report.Vnis {
+		held[cxiVniKey(vni.Namespace, vni.Vni)] = true
+	}
+	if err := syncCxiNodeUser(report.Node, held); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error updating CXI services of node %s: %v\n", report.Node, err)
+		return
+	}
+
+	cxiReports.mu.Lock()
+	cxiReports.last[report.Node] = time.Now()
+	cxiReports.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cxiVniKey(namespace string, vni int) string {
+	return fmt.Sprintf("%s/%d", namespace, vni)
+}
+
+// syncCxiNodeUser makes node a user of exactly the allocations in held.
+func syncCxiNodeUser(node string, held map[string]bool) error {
+	allocs, err := store.ListAllocations("")
+	if err != nil {
+		return err
+	}
+	user := cxiNodeUser(node)
+	for _, alloc := range allocs {
+		attached := false
+		for _, u := range alloc.Users {
+			if u == user {
+				attached = true
+				break
+			}
+		}
+		wanted := held[cxiVniKey(alloc.Namespace, alloc.Vni)]
+		if wanted && !attached {
+			if err := store.AddUser(alloc.VniUid, alloc.Namespace, user, shouldLog); err != nil {
+				return err
+			}
+			log.Printf("Node %s holds a CXI service for VNI %d (%s/%s)\n", node, alloc.Vni, alloc.Namespace, alloc.VniUid)
+		} else if !wanted && attached {
+			if err := store.RemoveUser(alloc.VniUid, alloc.Namespace, user, shouldLog); err != nil {
+				return err
+			}
+			log.Printf("Node %s tore down the CXI service for VNI %d (%s/%s)\n", node, alloc.Vni, alloc.Namespace, alloc.VniUid)
+		}
+	}
+	return nil
+}
+
+// sweepCxiNodes detaches nodes that have not reported within ttl, e.g. because
+// the node is gone. Nodes never seen since startup get ttl to report first.
+func sweepCxiNodes(ttl time.Duration) error {
+	allocs, err := store.ListAllocations("")
+	if err != nil {
+		return err
+	}
+	cxiReports.mu.Lock()
+	stale := make(map[string]bool)
+	for _, alloc := range allocs {
+		for _, user := range alloc.Users {
+			node, ok := strings.CutPrefix(user, cxiNodeUserPrefix)
+			if !ok {
+				continue
+			}
+			last, seen := cxiReports.last[node]
+			if !seen {
+				last = cxiReports.started
+			}
+			if time.Since(last) > ttl {
+				stale[node] = true
+			}
+		}
+	}
+	cxiReports.mu.Unlock()
+
+	for node := range stale {
+		log.Printf("Node %s has not reported CXI services for %v, detaching it\n", node, ttl)
+		if err := syncCxiNodeUser(node, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartCxiNodeSweeper runs sweepCxiNodes on the leader until ctx is done. A
+// non-positive ttl disables it.
+func StartCxiNodeSweeper(ctx context.Context, ttl time.Duration) {
+	if ttl <= 0 {
+		log.Printf("Not detaching silent CXI nodes: report TTL is %v\n", ttl)
+		return
+	}
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !leading() {
+			continue
+		}
+		if err := sweepCxiNodes(ttl); err != nil {
+			log.Printf("Error sweeping CXI nodes: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// mapAuthenticator accepts the tokens in its map.
+type mapAuthenticator map[string]UserInfo
+
+func (a mapAuthenticator) Authenticate(_ context.Context, token string) (*UserInfo, error) {
+	user, ok := a[token]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return &user, nil
+}
+
+func TestCxiReportNodeBinding(t *testing.T) {
+	newTestStore(t)
+	oldAuthenticator, oldAgentUsers := authenticator, agentUsers
+	defer func() { authenticator, agentUsers = oldAuthenticator, oldAgentUsers }()
+	authenticator = mapAuthenticator{
+		"bound": {Username: "system:serviceaccount:vni-management:vni-agent",
+			Extra: map[string][]string{nodeNameExtra: {"node-a"}}},
+		"unbound": {Username: "system:serviceaccount:vni-management:vni-agent"},
+		"node":    {Username: "system:node:node-b"},
+	}
+	agentUsers = nil
+
+	tests := []struct {
+		token  string
+		node   string
+		status int
+	}{
+		{"bound", "node-a", http.StatusNoContent},
+		{"bound", "node-b", http.StatusForbidden},
+		{"unbound", "node-a", http.StatusForbidden},
+		{"node", "node-b", http.StatusNoContent},
+		{"node", "node-a", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.token+" reporting "+test.node, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/agent/services",
+				strings.NewReader(`{"node": "`+test.node+`", "vnis": []}`))
+			request.Header.Set("Authorization", "Bearer "+test.token)
+			recorder := httptest.NewRecorder()
+			agentAuth(cCxiReport)(recorder, request)
+			if recorder.Code != test.status {
+				t.Errorf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestCxiNodeSweeperWithoutTTL(t *testing.T) {
+	// returns instead of panicking in time.NewTicker
+	StartCxiNodeSweeper(context.Background(), 0)
+}
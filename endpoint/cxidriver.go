@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// CxiServiceSpec describes a CXI service restricted to one VNI. Name
+// identifies the Vni object the service belongs to (namespace/name), so that
+// services survive agent restarts. Empty UIDs and GIDs leave the members
+// unrestricted. Limits caps CXI resources (see cxiResources) of the service.
+type CxiServiceSpec struct {
+	Name           string         `json:"name"`
+	Vni            int            `json:"vni"`
+	UIDs           []uint32       `json:"uids,omitempty"`
+	GIDs           []uint32       `json:"gids,omitempty"`
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	Limits         map[string]int `json:"limits,omitempty"`
+}
+
+// CxiService is a service created by a CxiDriver.
+type CxiService struct {
+	ID   int            `json:"id"`
+	Spec CxiServiceSpec `json:"spec"`
+}
+
+// CxiDriver creates and destroys CXI services on the NICs of a node. The
+// services it lists must include those created by earlier agent runs.
+type CxiDriver interface {
+	CreateService(ctx context.Context, spec CxiServiceSpec) (CxiService, error)
+	DestroyService(ctx context.Context, id int) error
+	ListServices(ctx context.Context) ([]CxiService, error)
+}
+
+// cxiDrivers maps the names accepted by --cxi-driver to constructors, which
+// get the value of --cxi-driver-command.
+var cxiDrivers = map[string]func(command string) (CxiDriver, error){
+	"fake": func(string) (CxiDriver, error) { return newFakeCxiDriver(), nil },
+	"exec": newExecCxiDriver,
+}
+
+func NewCxiDriver(name string, command string) (CxiDriver, error) {
+	newDriver, ok := cxiDrivers[name]
+	if !ok {
+		names := make([]string, 0, len(cxiDrivers))
+		for name := range cxiDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown CXI driver %q, expected one of %v", name, names)
+	}
+	return newDriver(command)
+}
+
+// fakeCxiDriver keeps services in memory, for running the agent on nodes
+// without Slingshot NICs.
+type fakeCxiDriver struct {
+	mu       sync.Mutex
+	nextId   int
+	services map[int]CxiService
+}
+
+func newFakeCxiDriver() *fakeCxiDriver {
+	return &fakeCxiDriver{nextId: 1, services: make(map[int]CxiService)}
+}
+
+func (d *fakeCxiDriver) CreateService(ctx context.Context, spec CxiServiceSpec) (CxiService, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	service := CxiService{ID: d.nextId, Spec: spec}
+	d.nextId++
+	d.services[service.ID] = service
+	log.Printf("fake CXI driver: created service %d for VNI %d (%s)\n", service.ID, spec.Vni, spec.Name)
+	return service, nil
+}
+
+func (d *fakeCxiDriver) DestroyService(ctx context.Context, id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.services[id]; !ok {
+		return fmt.Errorf("no CXI service %d", id)
+	}
+	delete(d.services, id)
+	log.Printf("fake CXI driver: destroyed service %d\n", id)
+	return nil
+}
+
+func (d *fakeCxiDriver) ListServices(ctx context.Context) ([]CxiService, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	services := make([]CxiService, 0, len(d.services))
+	for _, service := range d.services {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+// execCxiDriver delegates to a site-provided command wrapping libcxi:
+//
+//	<command> create    reads a CxiServiceSpec on stdin, writes a CxiService
+//	<command> destroy <id>
+//	<command> list      writes a list of CxiService
+//
+// All JSON. A failing command must exit non-zero with the reason on stderr.
+type execCxiDriver struct {
+	command string
+}
+
+func newExecCxiDriver(command string) (CxiDriver, error) {
+	if command == "" {
+		return nil, fmt.Errorf("the exec CXI driver requires --cxi-driver-command")
+	}
+	return &execCxiDriver{command: command}, nil
+}
+
+func (d *execCxiDriver) run(ctx context.Context, input interface{}, output interface{}, args ...string) error {
+	cmd := exec.CommandContext(ctx, d.command, args...)
+	if input != nil {
+		in, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewReader(in)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", d.command, args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if output != nil {
+		return json.Unmarshal(stdout.Bytes(), output)
+	}
+	return nil
+}
+
+func (d *execCxiDriver) CreateService(ctx context.Context, spec CxiServiceSpec) (CxiService, error) {
+	var service CxiService
+	err := d.run(ctx, spec, &service, "create")
+	return service, err
+}
+
+func (d *execCxiDriver) DestroyService(ctx context.Context, id int) error {
+	return d.run(ctx, nil, nil, "destroy", strconv.Itoa(id))
+}
+
+func (d *execCxiDriver) ListServices(ctx context.Context) ([]CxiService, error) {
+	var services []CxiService
+	err := d.run(ctx, nil, &services, "list")
+	return services, err
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"log"
 	"time"
 )
 
@@ -13,98 +14,49 @@ var ErrVNINotFound = errors.New("VNI not found")
 var ErrNoFreeVNI = errors.New("no free VNI available")
 var ErrVNIInUse = errors.New("VNI still in use")
 
+func init() {
+	sql.Register("sqlite3_with_extensions", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.CreateModule("generate_series", &seriesModule{})
+		},
+	})
+}
+
 func open(filePath *string) (db *sql.DB, err error) {
 	db, err = sql.Open("sqlite3_with_extensions", *filePath)
 	return db, err
 }
 
-func Init(db *sql.DB) error {
-	ctx := context.TODO()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-	if err != nil {
-		return err
-	}
-	// vni_allocs
-	_, err = tx.ExecContext(ctx, `
-	CREATE TABLE IF NOT EXISTS 
-    vni_allocs (
-		vniUid string not null,
-		namespace string not null, 
-        vni integer not null,
-        unique (vniUid, namespace, vni), 
-        primary key (vniUid, namespace)
-    );
-	create index if not exists vni_allocs_idx on vni_allocs(vni);
-	create index if not exists vni_allocs_idx2 on vni_allocs(vniUid, namespace, vni);`)
+// InitDB opens the database at filePath, applies pending migrations and
+// closes it again.
+func InitDB(filePath *string) error {
+	db, err := open(filePath)
 	if err != nil {
+		log.Printf("Error opening db: %v\n", err.Error())
 		return err
 	}
+	defer db.Close()
 
-	// vni_allocs_log
-	_, err = tx.ExecContext(ctx, `
-	CREATE TABLE if not exists
-	vni_allocs_log (
-	   vniUid string not null,
-	   namespace string not null, 
-       vni integer not null,
-	   operation text not null,
-	   ts datetime not null
-	);`)
-	if err != nil {
-		return err
-	}
-
-	// vni_users
-	_, err = tx.ExecContext(ctx, `
-	CREATE TABLE IF NOT EXISTS 
-    vni_users (
-		vniUid string not null,
-		namespace string not null, 
-        userId text not null,
-        unique (vniUid, namespace, userId), 
-        primary key (vniUid, namespace, userId)
-    );
-	create index if not exists vni_users_idx on vni_users(vniUid, namespace, userId);`)
-	if err != nil {
-		return err
-	}
-
-	// vni_users_log
-	_, err = tx.ExecContext(ctx, `
-	CREATE TABLE if not exists
-	vni_users_log (
-	   vniUid string not null,
-	   namespace string not null, 
-       userId text not null,
-	   operation text not null,
-	   ts datetime not null
-	);`)
+	err = Init(db)
 	if err != nil {
+		log.Printf("Error initializing DB: %s\n", err)
 		return err
 	}
+	return db.Close()
+}
 
-	// available_vnis
-	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
-	CREATE TABLE if not exists
-	available_vnis (
-		vni int not null primary key,
-		lastReleased datetime,
-		unique (vni),
-	    check (vni >= %d and vni < %d)
-	);`, vniMin, vniMax))
-	if err != nil {
+// Init brings the schema up to date and fills available_vnis with the
+// configured range.
+func Init(db *sql.DB) error {
+	if err := Migrate(db); err != nil {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, `
+	_, err := db.ExecContext(context.TODO(), `
 	insert or ignore into available_vnis (vni, lastReleased)
 	    select value, null as vni from generate_series(?, ?, 1)
 	;`, vniMin, vniMax)
-	if err != nil {
-		return err
-	}
-
-	return tx.Commit()
+	return err
 }
 
 func GetVni(db *sql.DB, vniUid string, namespace string) (int, error) {
@@ -122,8 +74,21 @@ func GetVni(db *sql.DB, vniUid string, namespace string) (int, error) {
 }
 
 func Acquire(db *sql.DB, vniUid string, namespace string,
-	vniMin int, vniMax int,
+	policy AllocationPolicy,
 	doLog bool) (int, error) {
+	return acquireAt(db, vniUid, namespace, policy, doLog, time.Now())
+}
+
+// sqliteTime formats t like SQLite's datetime('now').
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// acquireAt is Acquire with an explicit current time, so that replicas
+// applying the same operation later reach the same result.
+func acquireAt(db *sql.DB, vniUid string, namespace string,
+	policy AllocationPolicy,
+	doLog bool, now time.Time) (int, error) {
 	vni, err := GetVni(db, vniUid, namespace)
 	if err != nil {
 		return -1, err
@@ -134,17 +99,24 @@ func Acquire(db *sql.DB, vniUid string, namespace string,
 
 	ctx := context.TODO()
 
+	order := "vni"
+	if policy.Strategy == StrategyLeastRecentlyReleased {
+		order = "coalesce(unixepoch(lastReleased), 0), vni"
+	}
 	result, err := db.QueryContext(ctx, `
 with free_vnis as (
-	select vni 
+	select vni, lastReleased
 		from available_vnis
-		where unixepoch(datetime('now')) - coalesce(unixepoch(lastReleased), 0) > 60
-	except
-	select vni from vni_allocs
+		where vni >= ? and vni < ?
+			and unixepoch(?) - coalesce(unixepoch(lastReleased), 0) > ?
+			and external is null
+			and vni not in (select vni from vni_allocs)
  ),
 new_vni as (
-	select min(vni) as vni 
+	select vni
 	from free_vnis
+	order by `+order+`
+	limit 1
 )
 
 insert into vni_allocs (vniUid, namespace, vni)
@@ -153,15 +125,18 @@ select
     ?, 
     vni 
 from new_vni
-where vni > 0
 returning vni;
-`, vniUid, namespace)
+`, policy.Min, policy.Max, sqliteTime(now), int64(policy.Quarantine.Seconds()), vniUid, namespace)
 	if err != nil {
 		return -1, err
 	}
 	defer result.Close()
 	if !result.Next() {
-		return -1, errors.New("no result rows in VNI creation")
+		if err := result.Err(); err != nil {
+			return -1, err
+		}
+		// no free VNI, nothing inserted
+		return -1, ErrNoFreeVNI
 	}
 	var newVni int
 	err = result.Scan(&newVni)
@@ -173,14 +148,14 @@ returning vni;
 	}
 	result.Close()
 
-	if !(newVni >= vniMin && newVni < vniMax) {
+	if !(newVni >= policy.Min && newVni < policy.Max) {
 		return -1, errors.New("VNI outside range")
 	}
 
 	if doLog {
 		_, err = db.ExecContext(ctx, `insert into vni_allocs_log(vniUid, namespace, vni, operation, ts) 
 									   values (?,?,?, "acquire", ?);`,
-			vniUid, namespace, newVni, time.Now())
+			vniUid, namespace, newVni, now)
 		if err != nil {
 			return -1, err
 		}
@@ -191,6 +166,11 @@ returning vni;
 
 func ReleaseUserCheck(db *sql.DB, vniUid string, namespace string,
 	doLog bool) error {
+	return releaseUserCheckAt(db, vniUid, namespace, doLog, time.Now())
+}
+
+func releaseUserCheckAt(db *sql.DB, vniUid string, namespace string,
+	doLog bool, now time.Time) error {
 
 	ctx := context.TODO()
 	vni, err := GetVni(db, vniUid, namespace)
@@ -203,13 +183,13 @@ func ReleaseUserCheck(db *sql.DB, vniUid string, namespace string,
 
 	_, err = db.ExecContext(ctx, `
 update available_vnis
-set lastReleased = datetime('now')
+set lastReleased = ?
 where vni in (
     select vni
 	from vni_allocs
 	where vniUid = ? and namespace = ?
 );
-`, vniUid, namespace)
+`, sqliteTime(now), vniUid, namespace)
 	if err != nil {
 		return err
 	}
@@ -245,11 +225,16 @@ returning vni;
 		return ErrVNIInUse
 	}
 
+	_, err = db.ExecContext(ctx, `delete from vni_profiles where vniUid = ? and namespace = ?;`, vniUid, namespace)
+	if err != nil {
+		return err
+	}
+
 	if doLog {
 		for _, vni := range vnis {
 			_, err = db.ExecContext(ctx, `insert into vni_allocs_log(vniUid, namespace, vni, operation, ts) 
 									   values (?,?,?, "release", ?);`,
-				vniUid, namespace, vni, time.Now())
+				vniUid, namespace, vni, now)
 			if err != nil {
 				return err
 			}
@@ -259,6 +244,10 @@ returning vni;
 }
 
 func AddUser(db *sql.DB, vniUid string, namespace string, userId string, doLog bool) error {
+	return addUserAt(db, vniUid, namespace, userId, doLog, time.Now())
+}
+
+func addUserAt(db *sql.DB, vniUid string, namespace string, userId string, doLog bool, now time.Time) error {
 	ctx := context.TODO()
 
 	isPresent, err := getUser(db, vniUid, namespace, userId)
@@ -294,7 +283,7 @@ returning vniUid;`, vniUid, namespace, userId)
 	if doLog {
 		_, err = db.ExecContext(ctx, `insert into vni_users_log(vniUid, namespace, userId, operation, ts) 
 									   values (?,?,?, "add", ?);`,
-			vniUid, namespace, userId, time.Now())
+			vniUid, namespace, userId, now)
 		if err != nil {
 			return err
 		}
@@ -304,6 +293,10 @@ returning vniUid;`, vniUid, namespace, userId)
 }
 
 func RemoveUser(db *sql.DB, vniUid string, namespace string, userId string, doLog bool) error {
+	return removeUserAt(db, vniUid, namespace, userId, doLog, time.Now())
+}
+
+func removeUserAt(db *sql.DB, vniUid string, namespace string, userId string, doLog bool, now time.Time) error {
 	//lock.Lock()
 	//defer lock.Unlock()
 
@@ -323,7 +316,7 @@ func RemoveUser(db *sql.DB, vniUid string, namespace string, userId string, doLo
 	if doLog {
 		_, err = tx.ExecContext(ctx, `insert into vni_users_log(vniUid, namespace, userId, operation, ts) 
 									   values (?,?,?, "remove", ?);`,
-			vniUid, namespace, userId, time.Now())
+			vniUid, namespace, userId, now)
 		if err != nil {
 			return err
 		}
@@ -344,3 +337,163 @@ func getUser(db *sql.DB, vniUid string, namespace string, userId string) (bool,
 
 	return dbEntry != "", err
 }
+
+// SetExternal marks exactly vnis as held by the external allocator owner.
+// VNIs owner no longer holds are quarantined like released ones.
+func SetExternal(db *sql.DB, owner string, vnis []int) error {
+	return setExternalAt(db, owner, vnis, time.Now())
+}
+
+func setExternalAt(db *sql.DB, owner string, vnis []int, now time.Time) error {
+	if vnis == nil {
+		// json_each('null') yields no rows, so nothing would be given up
+		vnis = []int{}
+	}
+	encoded, err := json.Marshal(vnis)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	update available_vnis
+	set external = null, lastReleased = ?
+	where external = ? and vni not in (select value from json_each(?));`,
+		sqliteTime(now), owner, string(encoded))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	update available_vnis
+	set external = ?
+	where vni in (select value from json_each(?)) and external is null;`,
+		owner, string(encoded))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetExternal returns the VNIs held by external allocators, by owner.
+func GetExternal(db *sql.DB) (map[string][]int, error) {
+	rows, err := db.QueryContext(context.TODO(), `
+	select external, vni
+	from available_vnis
+	where external is not null
+	order by vni;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	external := make(map[string][]int)
+	for rows.Next() {
+		var owner string
+		var vni int
+		if err := rows.Scan(&owner, &vni); err != nil {
+			return nil, err
+		}
+		external[owner] = append(external[owner], vni)
+	}
+	return external, rows.Close()
+}
+
+// SetProfile stores the CXI profile of an allocation, replacing any previous
+// one.
+func SetProfile(db *sql.DB, vniUid string, namespace string, profile CxiProfile) error {
+	vni, err := GetVni(db, vniUid, namespace)
+	if err != nil {
+		return err
+	}
+	if vni == -1 {
+		return ErrVNINotFound
+	}
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(context.TODO(), `
+	insert into vni_profiles (vniUid, namespace, profile)
+	values (?, ?, ?)
+	on conflict (vniUid, namespace) do update set profile = excluded.profile;`,
+		vniUid, namespace, string(encoded))
+	return err
+}
+
+// GetProfile returns the CXI profile of an allocation, which is empty if none
+// was set.
+func GetProfile(db *sql.DB, vniUid string, namespace string) (CxiProfile, error) {
+	var profile CxiProfile
+	var encoded string
+	err := db.QueryRowContext(context.TODO(), `
+	select profile
+	from vni_profiles
+	where vniUid = ? and namespace = ?;`, vniUid, namespace).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile, nil
+	}
+	if err != nil {
+		return profile, err
+	}
+	err = json.Unmarshal([]byte(encoded), &profile)
+	return profile, err
+}
+
+// ListAllocations returns all allocations in namespace, or in all namespaces
+// if namespace is empty.
+func ListAllocations(db *sql.DB, namespace string) ([]Allocation, error) {
+	return listAllocations(db, `
+	select vniUid, namespace, vni
+	from vni_allocs
+	where ? = '' or namespace = ?
+	order by namespace, vniUid;`, `
+	select vniUid, namespace, userId
+	from vni_users
+	where ? = '' or namespace = ?
+	order by userId;`, namespace)
+}
+
+// listAllocations runs allocQuery and usersQuery, which both take namespace
+// twice, and joins their results.
+func listAllocations(db *sql.DB, allocQuery string, usersQuery string, namespace string) ([]Allocation, error) {
+	ctx := context.TODO()
+	rows, err := db.QueryContext(ctx, allocQuery, namespace, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allocs := make([]Allocation, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		var alloc Allocation
+		if err := rows.Scan(&alloc.VniUid, &alloc.Namespace, &alloc.Vni); err != nil {
+			return nil, err
+		}
+		index[allocKey(alloc.VniUid, alloc.Namespace)] = len(allocs)
+		allocs = append(allocs, alloc)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, usersQuery, namespace, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var vniUid, userNamespace, userId string
+		if err := rows.Scan(&vniUid, &userNamespace, &userId); err != nil {
+			return nil, err
+		}
+		if i, ok := index[allocKey(vniUid, userNamespace)]; ok {
+			allocs[i].Users = append(allocs[i].Users, userId)
+		}
+	}
+	return allocs, rows.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phases of a VniClaim, reported in its status. A deleted claim is Draining
+// while jobs or nodes still use its VNI, and Released once the VNI is freed.
+const (
+	ClaimActive   = "Active"
+	ClaimDraining = "Draining"
+	ClaimReleased = "Released"
+)
+
+// drainingSinceAnnotation records on a parent being finalized when it started
+// waiting for the users of its VNI. It is written once, so that waiting does
+// not cause updates that trigger more hooks.
+const drainingSinceAnnotation = "vni.horizon-opencube.eu/draining-since"
+
+// DrainPolicy decides how long finalize waits for the users of a VNI.
+type DrainPolicy struct {
+	// Backoff is the first resync interval while draining. It doubles with
+	// the time spent draining, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout, if > 0, is the time after which the remaining users are
+	// detached and the VNI released anyway.
+	Timeout time.Duration
+}
+
+var drainPolicy = DrainPolicy{Backoff: 5 * time.Second, MaxBackoff: 5 * time.Minute}
+
+// VniClaimStatus is the status of a VniClaim.
+type VniClaimStatus struct {
+	Phase  string `json:"phase"`
+	Vni    int    `json:"vni,omitempty"`
+	VniUid string `json:"vniUid,omitempty"`
+	// Users still holding the VNI of a Draining claim
+	Users         []string `json:"users,omitempty"`
+	DrainingSince string   `json:"drainingSince,omitempty"`
+	// LastDrift describes the last divergence of the claim's Vni from the
+	// database that sync corrected
+	LastDrift string `json:"lastDrift,omitempty"`
+}
+
+// drainingSince returns when the parent started draining, or now if it has
+// not before.
+func drainingSince(annotations map[string]string, now time.Time) (since time.Time, started bool) {
+	since, err := time.Parse(time.RFC3339, annotations[drainingSinceAnnotation])
+	if err != nil || since.After(now) {
+		return now, false
+	}
+	return since, true
+}
+
+// resync returns the interval until the next check of a parent draining
+// since since: twice the time spent so far, so that checks get exponentially
+// rarer.
+func (p DrainPolicy) resync(since time.Time, now time.Time) time.Duration {
+	interval := max(p.Backoff, now.Sub(since))
+	if p.MaxBackoff > 0 {
+		interval = min(interval, p.MaxBackoff)
+	}
+	if p.Timeout > 0 {
+		// check again right when the timeout expires
+		interval = min(interval, max(since.Add(p.Timeout).Sub(now), time.Second))
+	}
+	return interval
+}
+
+// expired reports whether a parent draining since since should stop waiting.
+func (p DrainPolicy) expired(since time.Time, now time.Time) bool {
+	return p.Timeout > 0 && now.Sub(since) >= p.Timeout
+}
+
+// allocationUsers returns the users of the allocation vniUid.
+func allocationUsers(vniUid string, namespace string) ([]string, error) {
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, alloc := range allocs {
+		if alloc.VniUid == vniUid {
+			return alloc.Users, nil
+		}
+	}
+	return nil, nil
+}
+
+// forceDetach detaches the users of the allocation vniUid and returns them.
+// Nodes are kept: their CXI services still admit the VNI, so it must not be
+// reused until the node reports the teardown or the sweeper expires it.
+func forceDetach(vniUid string, namespace string) ([]string, error) {
+	users, err := allocationUsers(vniUid, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var detached []string
+	for _, user := range users {
+		if strings.HasPrefix(user, cxiNodeUserPrefix) {
+			continue
+		}
+		if err := store.RemoveUser(vniUid, namespace, user, shouldLog); err != nil {
+			return nil, fmt.Errorf("detaching %s from %s: %w", user, vniUid, err)
+		}
+		detached = append(detached, user)
+	}
+	return detached, nil
+}
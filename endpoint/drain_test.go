@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"k8s.io/client-go/tools/record"
+)
+
+// TestDrainTimeout checks that an expired drain detaches the jobs but keeps
+// the VNI while a node still has a CXI service for it.
+func TestDrainTimeout(t *testing.T) {
+	newTestStore(t)
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	defer func(policy DrainPolicy) { drainPolicy = policy }(drainPolicy)
+	drainPolicy.Timeout = time.Hour
+
+	acquireTestVni(t, "my-claim", "vnitest")
+	node := cxiNodeUser("node-a")
+	for _, user := range []string{jobUid, node} {
+		if err := store.AddUser("my-claim", "vnitest", user, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	object := gjson.GetBytes(readHook(t, "finalize-vniclaim.json"), "object")
+	now := time.Now()
+
+	released, users, err := releaseOrDrain(object, "my-claim", "vnitest", now.Add(-2*time.Hour), true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released || !slices.Equal(users, []string{node}) {
+		t.Fatalf("released %v, users %v, want draining on %s", released, users, node)
+	}
+	want := []string{"Warning UsersForceDetached Detached " + jobUid + " from VNI my-claim after draining for 2h0m0s"}
+	if events := recordedEvents(recorder); !slices.Equal(events, want) {
+		t.Errorf("events %v, want %v", events, want)
+	}
+
+	// once the node reports the teardown the VNI is released
+	if err := store.RemoveUser("my-claim", "vnitest", node, false); err != nil {
+		t.Fatal(err)
+	}
+	released, _, err = releaseOrDrain(object, "my-claim", "vnitest", now.Add(-2*time.Hour), true, now)
+	if err != nil || !released {
+		t.Fatalf("released %v: %v", released, err)
+	}
+	want = []string{"Normal VNIReleased Released VNI my-claim"}
+	if events := recordedEvents(recorder); !slices.Equal(events, want) {
+		t.Errorf("events %v, want %v", events, want)
+	}
+}
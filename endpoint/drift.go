@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tidwall/gjson"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Sync compares the observed Vni attachments with the database, which is
+// authoritative: a Vni whose spec was edited by hand is set back. An
+// allocation the database lost, e.g. after restoring an older backup, is
+// restored from the attachment if its VNI is still free, so that the job
+// keeps its VNI.
+
+// Kinds of drift
+const (
+	// the attachment has another VNI than the allocation
+	driftVni = "vni"
+	// the attachment has other traffic classes or limits than the allocation
+	driftProfile = "profile"
+	// the allocation was missing and restored from the attachment
+	driftRestored = "restored"
+)
+
+var vniDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "vni_drift_total",
+	Help: "Divergences between the database and Vni attachments found by sync, by kind.",
+}, []string{"kind"})
+
+func init() {
+	for _, kind := range []string{driftVni, driftProfile, driftRestored} {
+		vniDrift.WithLabelValues(kind)
+	}
+}
+
+// restoreAllocation allocates the VNI of the observed attachment vniUid to
+// (vniUid, namespace) again if the database has no allocation for it and the
+// namespace may still use that VNI. It returns a description of the drift if
+// it restored the allocation.
+func restoreAllocation(vniUid string, namespace string, observed map[string]Vni) (string, error) {
+	attachment, ok := observed[vniUid]
+	if !ok || attachment.Spec.Vni <= 0 {
+		return "", nil
+	}
+	current, err := store.GetVni(vniUid, namespace)
+	if err != nil || current != -1 {
+		return "", err
+	}
+	vni := attachment.Spec.Vni
+	if !poolAllows(namespace, vni) {
+		// e.g. its pool was removed or narrowed - the caller allocates a new one
+		return "", nil
+	}
+	// the quarantine protects other jobs, not the one that held the VNI
+	policy := AllocationPolicy{Min: vni, Max: vni + 1, Strategy: StrategyLowestFirst}
+	_, err = store.Acquire(vniUid, namespace, policy, shouldLog)
+	if errors.Is(err, ErrNoFreeVNI) {
+		// taken by another job meanwhile - the caller allocates a new one
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("allocation %s was missing from the database, restored VNI %d", vniUid, vni), nil
+}
+
+// compareAttachment returns a description of how the observed attachment
+// differs from the desired one, and its kind.
+func compareAttachment(observed map[string]Vni, desired Vni) (drift string, kind string) {
+	attachment, ok := observed[desired.Metadata.Name]
+	if !ok {
+		return "", ""
+	}
+	switch {
+	case attachment.Spec.Vni != desired.Spec.Vni:
+		return fmt.Sprintf("Vni %s had VNI %d, the database %d", desired.Metadata.Name,
+			attachment.Spec.Vni, desired.Spec.Vni), driftVni
+	case !slices.Equal(attachment.Spec.TrafficClasses, desired.Spec.TrafficClasses) ||
+		!maps.Equal(attachment.Spec.Limits, desired.Spec.Limits):
+		return fmt.Sprintf("Vni %s had traffic classes %v and limits %v, the database %v and %v", desired.Metadata.Name,
+			attachment.Spec.TrafficClasses, attachment.Spec.Limits, desired.Spec.TrafficClasses, desired.Spec.Limits), driftProfile
+	}
+	return "", ""
+}
+
+// reportDrift logs, counts and records an Event for a drift that sync
+// corrects.
+func reportDrift(object gjson.Result, drift string, kind string) {
+	vniDrift.WithLabelValues(kind).Inc()
+	log.Printf("Drift of %s/%s: %s\n", object.Get("metadata.namespace").String(), object.Get("metadata.name").String(), drift)
+	recordEvent(object, corev1.EventTypeWarning, EventVniDrift, "%s; corrected", drift)
+}
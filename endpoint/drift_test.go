@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestRestoreAllocation(t *testing.T) {
+	tests := []struct {
+		name string
+		// pools are the ranges of the pools and their namespaces, none if nil
+		pools    []*vniPool
+		vni      int
+		restored bool
+	}{
+		{name: "no pools", vni: 200, restored: true},
+		{name: "out of range", vni: vniMax + 10},
+		{
+			name: "in the namespace's pool", vni: 200, restored: true,
+			pools: []*vniPool{{name: "team", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 200, Max: 300}},
+				Namespaces: []string{"vnitest"}}}},
+		},
+		{
+			name: "in a pool for all namespaces", vni: 200, restored: true,
+			pools: []*vniPool{{name: "shared", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 200, Max: 300}}}}},
+		},
+		{
+			name: "outside the namespace's pool", vni: 400,
+			pools: []*vniPool{{name: "team", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 200, Max: 300}},
+				Namespaces: []string{"vnitest"}}}},
+		},
+		{
+			name: "in another namespace's pool", vni: 200,
+			pools: []*vniPool{{name: "other", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 200, Max: 300}},
+				Namespaces: []string{"other"}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestStore(t)
+			for _, pool := range test.pools {
+				if err := setPool(pool); err != nil {
+					t.Fatal(err)
+				}
+			}
+			observed := map[string]Vni{"my-claim": {Spec: VniSpec{Vni: test.vni}}}
+			drift, err := restoreAllocation("my-claim", "vnitest", observed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored := drift != ""; restored != test.restored {
+				t.Fatalf("restored %v (%q), want %v", restored, drift, test.restored)
+			}
+			vni, err := store.GetVni("my-claim", "vnitest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.restored && vni != test.vni || !test.restored && vni != -1 {
+				t.Errorf("VNI %d in the database", vni)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"github.com/tidwall/gjson"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Events recorded on hook parents
+const (
+	EventVniAllocated    = "VNIAllocated"
+	EventVniReleased     = "VNIReleased"
+	EventClaimJoined     = "ClaimJoined"
+	EventClaimNotFound   = "ClaimNotFound"
+	EventPoolExhausted   = "PoolExhausted"
+	EventNoPool          = "NoVniPool"
+	EventReleaseDeferred = "ReleaseDeferred"
+	EventUsersDetached   = "UsersForceDetached"
+	EventVniDrift        = "VNIDrift"
+	// recorded on VniPools
+	EventExhaustionForecast = "ExhaustionForecast"
+)
+
+// eventRecorder records Events on the parents of hook requests, so that users
+// see why their job has no VNI. It is nil if events are disabled; tests can
+// use a record.FakeRecorder.
+var eventRecorder record.EventRecorder
+
+// NewEventRecorder returns a recorder sending Events to the API server until
+// ctx is done. Events of each parent are rate-limited to qps with bursts of
+// burst, and repeated Events are aggregated.
+func NewEventRecorder(ctx context.Context, client kubernetes.Interface, qps float32, burst int) record.EventRecorder {
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx),
+		record.WithCorrelatorOptions(record.CorrelatorOptions{QPS: qps, BurstSize: burst}))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "vni-endpoint"})
+}
+
+// parentRef references the parent object of a hook request.
+func parentRef(object gjson.Result) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion:      object.Get("apiVersion").String(),
+		Kind:            object.Get("kind").String(),
+		Namespace:       object.Get("metadata.namespace").String(),
+		Name:            object.Get("metadata.name").String(),
+		UID:             types.UID(object.Get("metadata.uid").String()),
+		ResourceVersion: object.Get("metadata.resourceVersion").String(),
+	}
+}
+
+// recordEvent records an Event on the parent object of a hook request.
+func recordEvent(object gjson.Result, eventtype string, reason string, messageFmt string, args ...interface{}) {
+	if eventRecorder == nil {
+		return
+	}
+	eventRecorder.Eventf(parentRef(object), eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+)
+
+// recordedEvents drains the events recorded so far.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestHookEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		file    string
+		setup   func(t *testing.T)
+		status  int
+		// events are the expected events as "<type> <reason> <message>"
+		events []string
+	}{
+		{
+			name: "allocated", handler: cSync, file: "sync-deployment.json",
+			status: http.StatusOK,
+			events: []string{"Normal VNIAllocated Allocated VNI 100 as vni-" + deploymentUid},
+		},
+		{
+			// only the first sync of an allocation records it
+			name: "resynced", handler: cSync, file: "sync-volcano.json",
+			setup:  func(t *testing.T) { acquireTestVni(t, "vni-"+volcanoUid, "vnitest") },
+			status: http.StatusOK,
+		},
+		{
+			name: "claim joined", handler: cSync, file: "sync-job-claim.json",
+			setup:  func(t *testing.T) { acquireTestVni(t, "my-claim", "vnitest") },
+			status: http.StatusOK,
+			events: []string{"Normal ClaimJoined Joined VNI 100 of my-claim"},
+		},
+		{
+			name: "claim not found", handler: cSync, file: "sync-job-claim.json",
+			status: http.StatusInternalServerError,
+			events: []string{"Warning ClaimNotFound No VniClaim or reservation named my-claim in namespace vnitest"},
+		},
+		{
+			name: "pool exhausted", handler: cSync, file: "sync-deployment.json",
+			setup: func(t *testing.T) {
+				pool := &vniPool{name: "tiny", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 100, Max: 101}},
+					Namespaces: []string{"vnitest"}}}
+				if err := setPool(pool); err != nil {
+					t.Fatal(err)
+				}
+				acquireTestVni(t, "vni-other", "vnitest")
+			},
+			status: http.StatusInternalServerError,
+			events: []string{"Warning PoolExhausted No free VNI for namespace vnitest, retrying"},
+		},
+		{
+			name: "released", handler: cFinalize, file: "finalize-deployment.json",
+			setup:  func(t *testing.T) { acquireTestVni(t, "vni-"+deploymentUid, "vnitest") },
+			status: http.StatusOK,
+			events: []string{"Normal VNIReleased Released VNI vni-" + deploymentUid},
+		},
+		{
+			name: "release deferred", handler: cFinalize, file: "finalize-vniclaim.json",
+			setup: func(t *testing.T) {
+				acquireTestVni(t, "my-claim", "vnitest")
+				if err := store.AddUser("my-claim", "vnitest", jobUid, false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusOK,
+			events: []string{"Normal ReleaseDeferred VNI my-claim is still used by " + jobUid + ", release deferred"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestStore(t)
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+			if test.setup != nil {
+				test.setup(t)
+			}
+			status, response := callHook(test.handler, readHook(t, test.file))
+			if status != test.status {
+				t.Fatalf("status %d, want %d: %s", status, test.status, response)
+			}
+			events := recordedEvents(recorder)
+			if !slices.Equal(events, test.events) {
+				t.Errorf("events\n  %s\nwant\n  %s", strings.Join(events, "\n  "), strings.Join(test.events, "\n  "))
+			}
+		})
+	}
+}
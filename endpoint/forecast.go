@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// webhookTimeout bounds the delivery of a forecast warning.
+const webhookTimeout = 10 * time.Second
+
+// HistoryReader is implemented by stores that keep vni_allocs_log, which
+// they fill if the endpoint runs with --log.
+type HistoryReader interface {
+	AllocationHistory(ctx context.Context, since time.Time) ([]AllocationLogEntry, error)
+}
+
+// AllocationLogEntry is an acquire, release or recover in vni_allocs_log.
+type AllocationLogEntry struct {
+	VniUid    string
+	Namespace string
+	Vni       int
+	Operation string
+	Ts        time.Time
+}
+
+// ForecastConfig decides how capacity is forecast.
+type ForecastConfig struct {
+	// Interval between forecasts, disabled if 0
+	Interval time.Duration
+	// Window of history the rates are computed over
+	Window time.Duration
+	// Warning, if > 0, is the projected time to exhaustion below which a
+	// pool gets a warning Event and Webhook, if set, is posted the forecast
+	Warning time.Duration
+	Webhook string
+}
+
+// PoolForecast is the projected usage of a VniPool, or of the whole range
+// (Pool "") without pools.
+type PoolForecast struct {
+	Pool      string `json:"pool"`
+	Size      int    `json:"size"`
+	Allocated int    `json:"allocated"`
+	Available int    `json:"available"`
+	// Allocations and releases per hour over the window
+	AllocationRate float64 `json:"allocationsPerHour"`
+	ReleaseRate    float64 `json:"releasesPerHour"`
+	// MeanHoldSeconds is the mean time a VNI is held, by Little's law the
+	// mean allocated VNIs over the window divided by the allocation rate
+	MeanHoldSeconds float64 `json:"meanHoldSeconds,omitempty"`
+	// ExhaustionSeconds is the projected time until no VNI is available if
+	// allocations keep outpacing releases as over the window; nil otherwise
+	ExhaustionSeconds *float64 `json:"exhaustionSeconds,omitempty"`
+	// Warning is set if ExhaustionSeconds is below the warning threshold
+	Warning bool `json:"warning"`
+}
+
+// ForecastReport is the outcome of a forecast.
+type ForecastReport struct {
+	Time   time.Time      `json:"time"`
+	Window string         `json:"window"`
+	Pools  []PoolForecast `json:"pools,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+var lastForecast = struct {
+	mu     sync.Mutex
+	report *ForecastReport
+	// warned holds the pools warned about, until their forecast recovers
+	warned map[string]bool
+}{warned: make(map[string]bool)}
+
+var (
+	poolAllocationRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_allocation_rate",
+		Help: "Allocations per second from a VniPool over the forecast window.",
+	}, []string{"pool"})
+	poolMeanHold = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_mean_hold_seconds",
+		Help: "Mean time VNIs of a VniPool are held over the forecast window.",
+	}, []string{"pool"})
+	poolExhaustion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_exhaustion_seconds",
+		Help: "Projected time until a VniPool has no available VNI, +Inf if its usage is not growing.",
+	}, []string{"pool"})
+)
+
+func allocationHistory(db *sql.DB, query string, since interface{}) ([]AllocationLogEntry, error) {
+	rows, err := db.QueryContext(context.TODO(), query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AllocationLogEntry
+	for rows.Next() {
+		var entry AllocationLogEntry
+		if err := rows.Scan(&entry.VniUid, &entry.Namespace, &entry.Vni, &entry.Operation, &entry.Ts); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// AllocationHistory returns the entries of vni_allocs_log since since,
+// oldest first.
+func AllocationHistory(db *sql.DB, since time.Time) ([]AllocationLogEntry, error) {
+	return allocationHistory(db, `
+	select vniUid, namespace, vni, operation, ts
+	from vni_allocs_log
+	where unixepoch(ts) >= ?
+	order by unixepoch(ts);`, since.Unix())
+}
+
+func (s *SQLiteStore) AllocationHistory(ctx context.Context, since time.Time) ([]AllocationLogEntry, error) {
+	return AllocationHistory(s.db, since)
+}
+
+func (s *RaftStore) AllocationHistory(ctx context.Context, since time.Time) ([]AllocationLogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return AllocationHistory(s.db, since)
+}
+
+func (s *PostgresStore) AllocationHistory(ctx context.Context, since time.Time) ([]AllocationLogEntry, error) {
+	return allocationHistory(s.db, `
+	select vniUid, namespace, vni, operation, ts
+	from vni_allocs_log
+	where ts >= $1
+	order by ts;`, since)
+}
+
+// forecastPools returns the pools to forecast, or the whole range as an
+// unnamed pool without pools.
+func forecastPools() []*vniPool {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	if len(vniPools.byName) == 0 {
+		return []*vniPool{{spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: vniMin, Max: vniMax}}}}}
+	}
+	pools := make([]*vniPool, 0, len(vniPools.byName))
+	for _, pool := range vniPools.byName {
+		pools = append(pools, pool)
+	}
+	slices.SortFunc(pools, func(a, b *vniPool) int { return strings.Compare(a.name, b.name) })
+	return pools
+}
+
+// forecastPool projects the usage of a pool from entries, the allocation
+// log of the window before now, oldest first.
+func forecastPool(pool *vniPool, entries []AllocationLogEntry, allocated int, available int,
+	window time.Duration, now time.Time) PoolForecast {
+	forecast := PoolForecast{Pool: pool.name, Size: pool.spec.size(), Allocated: allocated, Available: available}
+	if window <= 0 {
+		// no rates over an empty window
+		return forecast
+	}
+
+	acquired, released := 0, 0
+	// VNIs allocated over time, going back from now
+	count := allocated
+	area := 0.0
+	until := now
+	for _, entry := range slices.Backward(entries) {
+		if !pool.spec.contains(entry.Vni) {
+			continue
+		}
+		area += float64(count) * until.Sub(entry.Ts).Seconds()
+		until = entry.Ts
+		switch entry.Operation {
+		case "acquire":
+			acquired++
+			count = max(count-1, 0)
+		case "recover":
+			// not a new allocation, but did not exist before
+			count = max(count-1, 0)
+		case "release":
+			released++
+			count++
+		}
+	}
+	area += float64(count) * max(until.Sub(now.Add(-window)).Seconds(), 0)
+
+	hours := window.Hours()
+	forecast.AllocationRate = float64(acquired) / hours
+	forecast.ReleaseRate = float64(released) / hours
+	if acquired > 0 {
+		forecast.MeanHoldSeconds = area / float64(acquired)
+	}
+	if growth := float64(acquired-released) / window.Seconds(); growth > 0 {
+		exhaustion := float64(available) / growth
+		forecast.ExhaustionSeconds = &exhaustion
+	}
+	return forecast
+}
+
+// Forecast projects the usage of every pool from the history of the window
+// before now.
+func Forecast(ctx context.Context, config ForecastConfig, now time.Time) ForecastReport {
+	report := ForecastReport{Time: now, Window: config.Window.String()}
+	reader, ok := store.(HistoryReader)
+	if config.Window <= 0 {
+		report.Error = "the forecast window must be positive"
+		return report
+	}
+	if !shouldLog {
+		report.Error = "the allocation history is only kept with --log"
+		return report
+	}
+	if !ok {
+		report.Error = "the store keeps no allocation history"
+		return report
+	}
+	entries, err := reader.AllocationHistory(ctx, now.Add(-config.Window))
+	if err != nil {
+		report.Error = fmt.Sprintf("reading the allocation history: %v", err)
+		return report
+	}
+	for _, pool := range forecastPools() {
+		allocated, external, err := pool.spec.usage()
+		if err != nil {
+			report.Error = fmt.Sprintf("counting the allocations: %v", err)
+			return report
+		}
+		available := max(pool.spec.size()-allocated-external, 0)
+		forecast := forecastPool(pool, entries, allocated, available, config.Window, now)
+		forecast.Warning = config.Warning > 0 && forecast.ExhaustionSeconds != nil &&
+			*forecast.ExhaustionSeconds < config.Warning.Seconds()
+		report.Pools = append(report.Pools, forecast)
+	}
+	return report
+}
+
+// exportForecast sets the forecast metrics.
+func exportForecast(report ForecastReport) {
+	for _, forecast := range report.Pools {
+		poolAllocationRate.WithLabelValues(forecast.Pool).Set(forecast.AllocationRate / 3600)
+		poolMeanHold.WithLabelValues(forecast.Pool).Set(forecast.MeanHoldSeconds)
+		exhaustion := math.Inf(1)
+		if forecast.ExhaustionSeconds != nil {
+			exhaustion = *forecast.ExhaustionSeconds
+		}
+		poolExhaustion.WithLabelValues(forecast.Pool).Set(exhaustion)
+	}
+}
+
+// warnExhaustion records an Event on, and posts to webhook, each pool that
+// is newly projected to run dry within the warning threshold.
+func warnExhaustion(report ForecastReport, webhook string) {
+	lastForecast.mu.Lock()
+	defer lastForecast.mu.Unlock()
+	for _, forecast := range report.Pools {
+		if !forecast.Warning {
+			delete(lastForecast.warned, forecast.Pool)
+			continue
+		}
+		if lastForecast.warned[forecast.Pool] {
+			continue
+		}
+		lastForecast.warned[forecast.Pool] = true
+
+		exhaustion := (time.Duration(*forecast.ExhaustionSeconds) * time.Second).Round(time.Minute)
+		name := forecast.Pool
+		if name == "" {
+			name = "the VNI range"
+		}
+		log.Printf("Warning: %s is projected to run out of VNIs in %v (%d available, %.1f allocations/h, %.1f releases/h)\n",
+			name, exhaustion, forecast.Available, forecast.AllocationRate, forecast.ReleaseRate)
+		if eventRecorder != nil && forecast.Pool != "" {
+			ref := &corev1.ObjectReference{APIVersion: vniApiVersion, Kind: "VniPool", Name: forecast.Pool}
+			eventRecorder.Eventf(ref, corev1.EventTypeWarning, EventExhaustionForecast,
+				"Projected to run out of VNIs in %v, %d available", exhaustion, forecast.Available)
+		}
+		if webhook != "" {
+			if err := postForecast(webhook, forecast); err != nil {
+				log.Printf("Error posting forecast of %s to webhook: %v\n", name, err)
+			}
+		}
+	}
+}
+
+// postForecast posts forecast as JSON to webhook.
+func postForecast(webhook string, forecast PoolForecast) error {
+	body, err := json.Marshal(forecast)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	response, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return nil
+}
+
+// StartForecast forecasts the capacity of the pools every config.Interval
+// until ctx is done, while this replica leads.
+func StartForecast(ctx context.Context, config ForecastConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	lastErr := ""
+	for {
+		if leading() {
+			report := Forecast(ctx, config, time.Now())
+			if report.Error != "" && report.Error != lastErr {
+				// e.g. the endpoint runs without --log, logged once
+				log.Printf("Error forecasting capacity: %s\n", report.Error)
+			}
+			lastErr = report.Error
+			exportForecast(report)
+			warnExhaustion(report, config.Webhook)
+			lastForecast.mu.Lock()
+			lastForecast.report = &report
+			lastForecast.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cForecast serves the last forecast.
+func cForecast(w http.ResponseWriter, r *http.Request) {
+	lastForecast.mu.Lock()
+	report := lastForecast.report
+	lastForecast.mu.Unlock()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no forecast on this replica yet"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
+
+// the forecast covers all namespaces
+func describeForecast(r *http.Request) AdminRequest {
+	return AdminRequest{Verb: VerbGet, Subresource: "forecast"}
+}
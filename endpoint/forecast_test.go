@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecastPool(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	at := func(hoursAgo float64) time.Time { return now.Add(-time.Duration(hoursAgo * float64(time.Hour))) }
+	pool := &vniPool{name: "team-a", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 100, Max: 200}}}}
+	hours := func(h float64) *float64 { seconds := h * 3600; return &seconds }
+
+	tests := []struct {
+		name      string
+		entries   []AllocationLogEntry
+		allocated int
+		window    time.Duration
+		// expected rates per hour, mean hold and exhaustion in seconds
+		allocationRate float64
+		releaseRate    float64
+		meanHold       float64
+		exhaustion     *float64
+	}{
+		{
+			// two VNIs held 6h each: Little's law gives back the hold time
+			name: "growing",
+			entries: []AllocationLogEntry{
+				{VniUid: "a", Vni: 100, Operation: "acquire", Ts: at(8)},
+				{VniUid: "b", Vni: 101, Operation: "acquire", Ts: at(6)},
+				{VniUid: "a", Vni: 100, Operation: "release", Ts: at(2)},
+			},
+			allocated: 1, window: 10 * time.Hour,
+			allocationRate: 0.2, releaseRate: 0.1, meanHold: 6 * 3600,
+			// 99 available at a net one allocation per 10h
+			exhaustion: hours(990),
+		},
+		{
+			name: "other pools ignored",
+			entries: []AllocationLogEntry{
+				{VniUid: "a", Vni: 100, Operation: "acquire", Ts: at(8)},
+				{VniUid: "x", Vni: 300, Operation: "acquire", Ts: at(7)},
+				{VniUid: "b", Vni: 101, Operation: "acquire", Ts: at(6)},
+				{VniUid: "x", Vni: 300, Operation: "release", Ts: at(5)},
+				{VniUid: "a", Vni: 100, Operation: "release", Ts: at(2)},
+			},
+			allocated: 1, window: 10 * time.Hour,
+			allocationRate: 0.2, releaseRate: 0.1, meanHold: 6 * 3600,
+			exhaustion: hours(990),
+		},
+		{
+			// held since before the window; recovered allocations are no
+			// new ones
+			name: "steady",
+			entries: []AllocationLogEntry{
+				{VniUid: "r", Vni: 150, Operation: "recover", Ts: at(9)},
+				{VniUid: "a", Vni: 100, Operation: "acquire", Ts: at(4)},
+				{VniUid: "a", Vni: 100, Operation: "release", Ts: at(1)},
+			},
+			allocated: 2, window: 10 * time.Hour,
+			// 1 VNI for 1h, 2 for 5h, 3 for 3h and 2 for 1h: 22 VNI-hours
+			allocationRate: 0.1, releaseRate: 0.1, meanHold: 22 * 3600,
+		},
+		{
+			name: "shrinking",
+			entries: []AllocationLogEntry{
+				{VniUid: "a", Vni: 100, Operation: "release", Ts: at(3)},
+				{VniUid: "b", Vni: 101, Operation: "release", Ts: at(2)},
+			},
+			allocated: 0, window: 4 * time.Hour,
+			releaseRate: 0.5,
+		},
+		{
+			name:      "idle",
+			allocated: 3, window: 24 * time.Hour,
+		},
+		{
+			name: "empty window",
+			entries: []AllocationLogEntry{
+				{VniUid: "a", Vni: 100, Operation: "acquire", Ts: now},
+			},
+			allocated: 1, window: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			available := pool.spec.size() - test.allocated
+			forecast := forecastPool(pool, test.entries, test.allocated, available, test.window, now)
+			if forecast.Pool != "team-a" || forecast.Size != 100 || forecast.Allocated != test.allocated ||
+				forecast.Available != available {
+				t.Errorf("forecast of %s: size %d, allocated %d, available %d", forecast.Pool, forecast.Size,
+					forecast.Allocated, forecast.Available)
+			}
+			near := func(got float64, want float64) bool { return math.Abs(got-want) < 1e-6 }
+			if !near(forecast.AllocationRate, test.allocationRate) || !near(forecast.ReleaseRate, test.releaseRate) {
+				t.Errorf("rates %v/h and %v/h, want %v/h and %v/h", forecast.AllocationRate, forecast.ReleaseRate,
+					test.allocationRate, test.releaseRate)
+			}
+			if !near(forecast.MeanHoldSeconds, test.meanHold) {
+				t.Errorf("mean hold %vs, want %vs", forecast.MeanHoldSeconds, test.meanHold)
+			}
+			switch {
+			case test.exhaustion == nil && forecast.ExhaustionSeconds != nil:
+				t.Errorf("exhaustion in %vs, want none", *forecast.ExhaustionSeconds)
+			case test.exhaustion != nil && (forecast.ExhaustionSeconds == nil || !near(*forecast.ExhaustionSeconds, *test.exhaustion)):
+				t.Errorf("exhaustion in %v, want %vs", forecast.ExhaustionSeconds, *test.exhaustion)
+			}
+			// cForecast serves the forecast as JSON, which has no NaN or Inf
+			if _, err := json.Marshal(forecast); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
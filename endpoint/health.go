@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readyTimeout bounds the checks of a single /readyz request
+const readyTimeout = 3 * time.Second
+
+// shuttingDown makes /readyz fail while in-flight requests are drained, so
+// that the replica is taken out of the Service first.
+var shuttingDown atomic.Bool
+
+// readyRequiresLeader makes /readyz fail on followers, for setups where they
+// cannot proxy to the leader.
+var readyRequiresLeader bool
+
+// HealthChecker is implemented by stores that can tell whether they are able
+// to serve requests.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+type readyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkDB checks that db answers, that its database/sql connection pool is not
+// exhausted and that its schema is at the expected version.
+func checkDB(ctx context.Context, db *sql.DB, version func(ctx context.Context) (int, error), expected int) error {
+	// before the ping, which would wait for a free connection
+	stats := db.Stats()
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		return fmt.Errorf("database connection pool exhausted (%d of %d connections in use)", stats.InUse, stats.MaxOpenConnections)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+	current, err := version(ctx)
+	if err != nil {
+		return err
+	}
+	if current != expected {
+		return fmt.Errorf("schema at version %d, expected %d", current, expected)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CheckHealth(ctx context.Context) error {
+	return checkDB(ctx, s.db, func(ctx context.Context) (int, error) {
+		return GetSchemaVersion(s.db)
+	}, schemaVersion())
+}
+
+func (s *PostgresStore) CheckHealth(ctx context.Context) error {
+	return checkDB(ctx, s.db, func(ctx context.Context) (int, error) {
+		var version int
+		err := s.db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_version;`).Scan(&version)
+		return version, err
+	}, pgMigrations[len(pgMigrations)-1].version)
+}
+
+func (s *KubeStore) CheckHealth(ctx context.Context) error {
+	_, err := s.client.Resource(vniRangeAllocationGVR).Get(ctx, s.name, metav1.GetOptions{})
+	return err
+}
+
+func (s *RaftStore) CheckHealth(ctx context.Context) error {
+	s.mu.RLock()
+	err := checkDB(ctx, s.db, func(ctx context.Context) (int, error) {
+		return GetSchemaVersion(s.db)
+	}, schemaVersion())
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if leader, _ := s.raft.LeaderWithID(); leader == "" {
+		return errors.New("no Raft leader known")
+	}
+	return nil
+}
+
+func readyChecks() []readyCheck {
+	checks := []readyCheck{{"shutdown", func(ctx context.Context) error {
+		if shuttingDown.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}}}
+	if checker, ok := store.(HealthChecker); ok {
+		checks = append(checks, readyCheck{"store", checker.CheckHealth})
+	}
+	if readyRequiresLeader && elector != nil {
+		checks = append(checks, readyCheck{"leader", func(ctx context.Context) error {
+			if !elector.IsLeader() {
+				return fmt.Errorf("not the leader, current leader: %q", elector.Leader())
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// exhaustedPools returns the names of the VniPools without a VNI left, or
+// "all VNIs" for the whole range without pools.
+func exhaustedPools() ([]string, error) {
+	var exhausted []string
+	for _, pool := range forecastPools() {
+		allocated, external, err := pool.spec.usage()
+		if err != nil {
+			return nil, err
+		}
+		if allocated+external < pool.spec.size() {
+			continue
+		}
+		if pool.name == "" {
+			exhausted = append(exhausted, "all VNIs")
+		} else {
+			exhausted = append(exhausted, pool.name)
+		}
+	}
+	return exhausted, nil
+}
+
+// cHealthz reports that the process is alive.
+func cHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// cReadyz reports whether this replica can serve the hooks, listing the
+// result of each check.
+func cReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	var report strings.Builder
+	ready := true
+	for _, check := range readyChecks() {
+		if err := check.check(ctx); err != nil {
+			ready = false
+			fmt.Fprintf(&report, "[-]%s failed: %v\n", check.name, err)
+		} else {
+			fmt.Fprintf(&report, "[+]%s ok\n", check.name)
+		}
+	}
+	if elector != nil {
+		fmt.Fprintf(&report, "leader: %v (%s)\n", elector.IsLeader(), elector.Leader())
+	}
+	// reported only: an exhausted replica must still finalize to free VNIs
+	if exhausted, err := exhaustedPools(); err != nil {
+		fmt.Fprintf(&report, "VNI pools: %v\n", err)
+	} else if len(exhausted) > 0 {
+		fmt.Fprintf(&report, "VNI pools exhausted: %s\n", strings.Join(exhausted, ", "))
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		report.WriteString("readyz check failed\n")
+		log.Printf("Not ready:\n%s", report.String())
+	} else {
+		w.WriteHeader(http.StatusOK)
+		report.WriteString("ok\n")
+	}
+	w.Write([]byte(report.String()))
+}
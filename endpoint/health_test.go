@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckDB(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// with every connection in use, requests would queue
+	s.db.SetMaxOpenConns(1)
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	err = s.CheckHealth(ctx)
+	if err == nil || !strings.Contains(err.Error(), "database connection pool exhausted") {
+		t.Errorf("CheckHealth with all connections in use: %v", err)
+	}
+}
+
+func TestReadyzPools(t *testing.T) {
+	newTestStore(t)
+	pool := &vniPool{name: "tiny", spec: VniPoolSpec{Ranges: []VniPoolRange{{Min: 100, Max: 101}}}}
+	if err := setPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	readyz := func() (int, string) {
+		recorder := httptest.NewRecorder()
+		cReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, report := readyz(); code != http.StatusOK || strings.Contains(report, "exhausted") {
+		t.Fatalf("readyz %d:\n%s", code, report)
+	}
+	acquireTestVni(t, "vni-other", "vnitest")
+	// still ready, so that finalize can free VNIs
+	code, report := readyz()
+	if code != http.StatusOK || !strings.Contains(report, "VNI pools exhausted: tiny\n") {
+		t.Errorf("readyz %d:\n%s", code, report)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cronJobVniAnnotation decides whether the Jobs of a CronJob annotated with
+// vni: true share one VNI ("shared") or get one each ("per-job", the
+// default). With per-job, the Jobs request their VNI through the annotations
+// of the jobTemplate.
+const cronJobVniAnnotation = "vni.horizon-opencube.eu/cronjob-vni"
+
+// vniRequest is the allocation a parent uses: its own one named VniUid, or
+// the allocation VniUid of a VniClaim, reservation or ancestor it joins.
+type vniRequest struct {
+	VniUid string
+	Owns   bool
+	// Ancestor is the owner ("Kind name") whose VNI the parent inherits
+	Ancestor string
+}
+
+// resolveVniRequest returns the allocation requested by a hook parent; ok is
+// false if it requests none. A parent whose controller (or its controller, and
+// so on) requests a VNI inherits that VNI instead of allocating its own, e.g.
+// the ReplicaSets of a Deployment, or the Jobs of a shared CronJob.
+func resolveVniRequest(ctx context.Context, object gjson.Result) (request vniRequest, ok bool, err error) {
+	return resolveVniRequestAt(ctx, object, 0)
+}
+
+func resolveVniRequestAt(ctx context.Context, object gjson.Result, depth int) (vniRequest, bool, error) {
+	kind := object.Get("kind").String()
+	if object.Get("apiVersion").String() == vniApiVersion && kind == "VniClaim" {
+		return vniRequest{VniUid: object.Get("spec.name").String(), Owns: true}, true, nil
+	}
+
+	// a VniClaim or reservation named by the parent itself takes precedence
+	// over the VNI of its owners
+	annotation := strings.ToLower(object.Get("metadata.annotations.vni").String())
+	if annotation != "" && annotation != "true" && annotation != "yes" {
+		return vniRequest{VniUid: annotation}, true, nil
+	}
+
+	ancestor, ok, err := ancestorVniRequest(ctx, object, depth)
+	if err != nil || ok {
+		return ancestor, ok, err
+	}
+
+	if annotation == "" {
+		return vniRequest{}, false, nil
+	}
+	if kind == "CronJob" && object.Get("metadata.annotations").Map()[cronJobVniAnnotation].String() != "shared" {
+		return vniRequest{}, false, nil
+	}
+	return vniRequest{VniUid: fmt.Sprintf("vni-%s", object.Get("metadata.uid").String()), Owns: true}, true, nil
+}
+
+// ancestorVniRequest returns the request of the parent's controller if that is
+// a configured parent requesting a VNI. Without access to the Kubernetes API,
+// it can only find allocations the controller already holds.
+func ancestorVniRequest(ctx context.Context, object gjson.Result, depth int) (vniRequest, bool, error) {
+	if depth >= maxOwnerDepth {
+		return vniRequest{}, false, nil
+	}
+	namespace := object.Get("metadata.namespace").String()
+	for _, ref := range object.Get("metadata.ownerReferences").Array() {
+		if !ref.Get("controller").Bool() {
+			continue
+		}
+		key := ref.Get("kind").String() + "." + ref.Get("apiVersion").String()
+		gvr, known := ownerResources[key]
+		if !known || !allowedParents[key] {
+			continue
+		}
+		ancestor := fmt.Sprintf("%s %s", ref.Get("kind").String(), ref.Get("name").String())
+
+		if podClient == nil {
+			vniUid, found, err := heldAllocation(namespace, ref.Get("uid").String())
+			if err != nil || !found {
+				return vniRequest{}, false, err
+			}
+			return vniRequest{VniUid: vniUid, Ancestor: ancestor}, true, nil
+		}
+
+		owner, err := podClient.Resource(gvr).Namespace(namespace).Get(ctx, ref.Get("name").String(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return vniRequest{}, false, err
+		}
+		if string(owner.GetUID()) != ref.Get("uid").String() {
+			// deleted and recreated under the same name
+			continue
+		}
+		data, err := json.Marshal(owner.Object)
+		if err != nil {
+			return vniRequest{}, false, err
+		}
+		request, ok, err := resolveVniRequestAt(ctx, gjson.ParseBytes(data), depth+1)
+		if err != nil || !ok {
+			return vniRequest{}, false, err
+		}
+		return vniRequest{VniUid: request.VniUid, Ancestor: ancestor}, true, nil
+	}
+	return vniRequest{}, false, nil
+}
+
+// heldAllocation returns the allocation owned (vni-<uid>) or joined by uid.
+func heldAllocation(namespace string, uid string) (string, bool, error) {
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		return "", false, err
+	}
+	for _, alloc := range allocs {
+		if alloc.VniUid == fmt.Sprintf("vni-%s", uid) {
+			return alloc.VniUid, true, nil
+		}
+	}
+	for _, alloc := range allocs {
+		if slices.Contains(alloc.Users, uid) {
+			return alloc.VniUid, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// detachInheritors detaches the parents that inherited the allocation vniUid
+// from an owner being finalized, e.g. the ReplicaSets of a Deployment. Those
+// are only garbage collected once the owner is gone, so waiting for them
+// would block the owner forever. Nodes still holding CXI services stay
+// attached and keep the VNI from being released until they have torn them
+// down.
+func detachInheritors(vniUid string, namespace string) error {
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		return err
+	}
+	for _, alloc := range allocs {
+		if alloc.VniUid != vniUid {
+			continue
+		}
+		for _, user := range alloc.Users {
+			if strings.HasPrefix(user, cxiNodeUserPrefix) {
+				continue
+			}
+			if err := store.RemoveUser(vniUid, namespace, user, shouldLog); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseOwnAllocation releases the allocation vni-<uid> of a parent that
+// now inherits the VNI of its owner, e.g. a ReplicaSet that got its own VNI
+// before ReplicaSets joined their Deployment's. It reports whether the parent
+// had one, i.e. whether its attachment is switching VNIs.
+func releaseOwnAllocation(namespace string, uid string) bool {
+	vniUid := fmt.Sprintf("vni-%s", uid)
+	// look first, so that the common case does not write
+	vni, err := store.GetVni(vniUid, namespace)
+	if err != nil {
+		log.Printf("Error getting VNI: %v\n", err)
+		return false
+	}
+	if vni == -1 {
+		return false
+	}
+	err = store.ReleaseUserCheck(vniUid, namespace, shouldLog)
+	switch {
+	case err == nil:
+		log.Printf("Released %s/%s, it now inherits the VNI of its owner\n", namespace, vniUid)
+	case errors.Is(err, ErrVNIInUse):
+		// retried on the next sync, once the nodes switched to the new VNI
+	case !errors.Is(err, ErrVNINotFound):
+		log.Printf("Error releasing VNI: %v\n", err)
+	}
+	return true
+}
+
+// removeUserEverywhere detaches uid from every allocation in namespace it
+// joined.
+func removeUserEverywhere(namespace string, uid string) error {
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		return err
+	}
+	for _, alloc := range allocs {
+		if !slices.Contains(alloc.Users, uid) {
+			continue
+		}
+		if err := store.RemoveUser(alloc.VniUid, namespace, uid, shouldLog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
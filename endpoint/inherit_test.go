@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestResolveVniRequest(t *testing.T) {
+	deployment := newOwnedObject("apps/v1", "Deployment", "trainer", map[string]string{"vni": "true"})
+	replicaSet := newOwnedObject("apps/v1", "ReplicaSet", "trainer-5d8f", nil, deployment)
+	pod := newOwnedObject("v1", "Pod", "trainer-5d8f-x2x", nil, replicaSet)
+	shared := newOwnedObject("batch/v1", "CronJob", "nightly",
+		map[string]string{"vni": "true", cronJobVniAnnotation: "shared"})
+	sharedJob := newOwnedObject("batch/v1", "Job", "nightly-2890", nil, shared)
+	claimJob := newOwnedObject("batch/v1", "Job", "nightly-2891", map[string]string{"vni": "my-claim"}, shared)
+	perJob := newOwnedObject("batch/v1", "CronJob", "hourly", map[string]string{"vni": "true"})
+	perJobJob := newOwnedObject("batch/v1", "Job", "hourly-2890", map[string]string{"vni": "true"}, perJob)
+	// the owner reference points to a Deployment deleted and recreated since
+	stale := newOwnedObject("apps/v1", "ReplicaSet", "trainer-7c9b", nil, deployment)
+	refs := stale.GetOwnerReferences()
+	refs[0].UID = types.UID("trainer-old-uid")
+	stale.SetOwnerReferences(refs)
+
+	tests := []struct {
+		name   string
+		object *unstructured.Unstructured
+		// ok is false if the object requests no VNI
+		ok       bool
+		vniUid   string
+		owns     bool
+		ancestor string
+	}{
+		{name: "owner", object: deployment, ok: true, vniUid: "vni-trainer-uid", owns: true},
+		{name: "controlled", object: replicaSet, ok: true, vniUid: "vni-trainer-uid", ancestor: "Deployment trainer"},
+		{name: "transitive", object: pod, ok: true, vniUid: "vni-trainer-uid", ancestor: "ReplicaSet trainer-5d8f"},
+		{name: "shared CronJob", object: sharedJob, ok: true, vniUid: "vni-nightly-uid", ancestor: "CronJob nightly"},
+		{name: "claim over shared CronJob", object: claimJob, ok: true, vniUid: "my-claim"},
+		{name: "per-job CronJob", object: perJob},
+		{name: "job of per-job CronJob", object: perJobJob, ok: true, vniUid: "vni-hourly-2890-uid", owns: true},
+		{name: "recreated owner", object: stale},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestStore(t)
+			setPodClient(deployment, replicaSet, pod, shared, sharedJob, claimJob, perJob, perJobJob, stale)
+			data, err := json.Marshal(test.object.Object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, ok, err := resolveVniRequest(context.Background(), gjson.ParseBytes(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := vniRequest{VniUid: test.vniUid, Owns: test.owns, Ancestor: test.ancestor}
+			if ok != test.ok || request != want {
+				t.Errorf("request %+v (%v), want %+v (%v)", request, ok, want, test.ok)
+			}
+		})
+	}
+}
+
+// TestResolveVniRequestWithoutClient checks that without access to the
+// Kubernetes API only allocations the owner holds are inherited.
+func TestResolveVniRequestWithoutClient(t *testing.T) {
+	newTestStore(t)
+	deployment := newOwnedObject("apps/v1", "Deployment", "trainer", map[string]string{"vni": "true"})
+	replicaSet := newOwnedObject("apps/v1", "ReplicaSet", "trainer-5d8f", nil, deployment)
+	data, err := json.Marshal(replicaSet.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := gjson.ParseBytes(data)
+
+	if request, ok, err := resolveVniRequest(context.Background(), object); err != nil || ok {
+		t.Fatalf("request %+v (%v, %v) before the owner is allocated", request, ok, err)
+	}
+	acquireTestVni(t, "vni-trainer-uid", "vnitest")
+	request, ok, err := resolveVniRequest(context.Background(), object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := vniRequest{VniUid: "vni-trainer-uid", Ancestor: "Deployment trainer"}
+	if !ok || request != want {
+		t.Errorf("request %+v (%v), want %+v", request, ok, want)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const vniApiVersion = "horizon-opencube.eu/v1"
+
+var vniGVR = schema.GroupVersionResource{Group: "horizon-opencube.eu", Version: "v1", Resource: "vnis"}
+var vniClaimGVR = schema.GroupVersionResource{Group: "horizon-opencube.eu", Version: "v1", Resource: "vniclaims"}
+
+// kubeConfig loads the kubeconfig at path, or the in-cluster configuration if
+// path is empty.
+func kubeConfig(path string) (*rest.Config, error) {
+	return clientcmd.BuildConfigFromFlags("", path)
+}
+
+func newDynamicClient(path string) (dynamic.Interface, error) {
+	config, err := kubeConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func newKubeClient(path string) (kubernetes.Interface, error) {
+	config, err := kubeConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
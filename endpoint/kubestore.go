@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+var vniRangeAllocationGVR = schema.GroupVersionResource{Group: "horizon-opencube.eu", Version: "v1", Resource: "vnirangeallocations"}
+
+type vniRangeAllocationEntry struct {
+	Namespace string      `json:"namespace"`
+	VniUid    string      `json:"vniUid"`
+	Vni       int64       `json:"vni"`
+	Users     []string    `json:"users,omitempty"`
+	Profile   *CxiProfile `json:"profile,omitempty"`
+}
+
+type vniReleaseEntry struct {
+	Vni          int64  `json:"vni"`
+	LastReleased string `json:"lastReleased"`
+}
+
+// vniRangeAllocationStatus is the status of a VniRangeAllocation object.
+// Bitmap holds bit i for VNI vniMin+i as a gzipped, base64 encoded bitmap.
+type vniRangeAllocationStatus struct {
+	Range       string                    `json:"range"`
+	Bitmap      string                    `json:"bitmap"`
+	Allocations []vniRangeAllocationEntry `json:"allocations,omitempty"`
+	Released    []vniReleaseEntry         `json:"released,omitempty"`
+	// External lists the VNIs held by external allocators, by owner
+	External map[string][]int64 `json:"external,omitempty"`
+}
+
+// vniRangeState is the decoded allocation state of a VniRangeAllocation.
+type vniRangeState struct {
+	min      int
+	max      int
+	bitmap   []byte
+	allocs   map[string]*vniRangeAllocationEntry
+	released map[int]time.Time
+	external map[int]string
+}
+
+func (s *vniRangeState) inRange(vni int) bool {
+	return vni >= s.min && vni < s.max
+}
+
+// isSet reports whether vni is allocated; VNIs outside the range never are.
+func (s *vniRangeState) isSet(vni int) bool {
+	if !s.inRange(vni) {
+		return false
+	}
+	i := vni - s.min
+	return s.bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+func (s *vniRangeState) set(vni int, value bool) {
+	i := vni - s.min
+	if value {
+		s.bitmap[i/8] |= 1 << (i % 8)
+	} else {
+		s.bitmap[i/8] &^= 1 << (i % 8)
+	}
+}
+
+func decodeRangeState(status vniRangeAllocationStatus, vniMin int, vniMax int) (*vniRangeState, error) {
+	state := &vniRangeState{
+		min:      vniMin,
+		max:      vniMax,
+		bitmap:   make([]byte, (vniMax-vniMin+7)/8),
+		allocs:   make(map[string]*vniRangeAllocationEntry),
+		released: make(map[int]time.Time),
+		external: make(map[int]string),
+	}
+	if status.Range != "" && status.Range != fmt.Sprintf("%d-%d", vniMin, vniMax) {
+		return nil, fmt.Errorf("VniRangeAllocation range %s does not match configured range %d-%d",
+			status.Range, vniMin, vniMax)
+	}
+
+	if status.Bitmap != "" {
+		compressed, err := base64.StdEncoding.DecodeString(status.Bitmap)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		bitmap, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(bitmap) != len(state.bitmap) {
+			return nil, fmt.Errorf("VniRangeAllocation bitmap has %d bytes, expected %d", len(bitmap), len(state.bitmap))
+		}
+		state.bitmap = bitmap
+	}
+
+	for i := range status.Allocations {
+		entry := status.Allocations[i]
+		if !state.inRange(int(entry.Vni)) {
+			return nil, fmt.Errorf("VniRangeAllocation allocation %s has VNI %d outside range %d-%d",
+				allocKey(entry.VniUid, entry.Namespace), entry.Vni, vniMin, vniMax)
+		}
+		if !state.isSet(int(entry.Vni)) {
+			return nil, fmt.Errorf("VniRangeAllocation bitmap misses VNI %d of %s", entry.Vni,
+				allocKey(entry.VniUid, entry.Namespace))
+		}
+		state.allocs[allocKey(entry.VniUid, entry.Namespace)] = &entry
+	}
+	for _, entry := range status.Released {
+		ts, err := time.Parse(time.RFC3339, entry.LastReleased)
+		if err != nil {
+			return nil, err
+		}
+		state.released[int(entry.Vni)] = ts
+	}
+	for owner, vnis := range status.External {
+		for _, vni := range vnis {
+			state.external[int(vni)] = owner
+		}
+	}
+	return state, nil
+}
+
+func (s *vniRangeState) encode() (vniRangeAllocationStatus, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(s.bitmap); err != nil {
+		return vniRangeAllocationStatus{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return vniRangeAllocationStatus{}, err
+	}
+
+	status := vniRangeAllocationStatus{
+		Range:  fmt.Sprintf("%d-%d", s.min, s.max),
+		Bitmap: base64.StdEncoding.EncodeToString(compressed.Bytes()),
+	}
+	for _, entry := range s.allocs {
+		status.Allocations = append(status.Allocations, *entry)
+	}
+	sort.Slice(status.Allocations, func(i, j int) bool {
+		return status.Allocations[i].Vni < status.Allocations[j].Vni
+	})
+
+	// entries past the longest quarantine period carry no information anymore
+	for vni, ts := range s.released {
+		if time.Since(ts) < longestQuarantine() {
+			status.Released = append(status.Released, vniReleaseEntry{int64(vni), ts.UTC().Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(status.Released, func(i, j int) bool {
+		return status.Released[i].Vni < status.Released[j].Vni
+	})
+
+	for vni, owner := range s.external {
+		if status.External == nil {
+			status.External = make(map[string][]int64)
+		}
+		status.External[owner] = append(status.External[owner], int64(vni))
+	}
+	for _, vnis := range status.External {
+		sort.Slice(vnis, func(i, j int) bool { return vnis[i] < vnis[j] })
+	}
+	return status, nil
+}
+
+// KubeStore keeps the allocation state in a cluster-scoped VniRangeAllocation
+// object, similar to the allocator for Service cluster IPs. Every mutation is
+// a read-modify-write of that object guarded by its resourceVersion, so any
+// number of stateless endpoint replicas can share it. It keeps no allocation
+// history: doLog is ignored, and --log is refused with it.
+type KubeStore struct {
+	client dynamic.Interface
+	name   string
+}
+
+func NewKubeStore(client dynamic.Interface, name string) *KubeStore {
+	return &KubeStore{client: client, name: name}
+}
+
+func (s *KubeStore) Init() error {
+	ctx := context.TODO()
+	_, err := s.client.Resource(vniRangeAllocationGVR).Get(ctx, s.name, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	state, err := decodeRangeState(vniRangeAllocationStatus{}, vniMin, vniMax)
+	if err != nil {
+		return err
+	}
+	obj, err := newRangeAllocationObject(s.name, state)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Resource(vniRangeAllocationGVR).Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// another replica was faster
+		return nil
+	}
+	if err == nil {
+		log.Printf("Created VniRangeAllocation %s\n", s.name)
+	}
+	return err
+}
+
+func newRangeAllocationObject(name string, state *vniRangeState) (*unstructured.Unstructured, error) {
+	status, err := state.encode()
+	if err != nil {
+		return nil, err
+	}
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": vniApiVersion,
+		"kind":       "VniRangeAllocation",
+		"metadata":   map[string]interface{}{"name": name},
+		"status":     statusObj,
+	}}, nil
+}
+
+func (s *KubeStore) get() (*unstructured.Unstructured, *vniRangeState, error) {
+	obj, err := s.client.Resource(vniRangeAllocationGVR).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var status vniRangeAllocationStatus
+	statusObj, _, err := unstructured.NestedMap(obj.Object, "status")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(statusObj, &status); err != nil {
+		return nil, nil, err
+	}
+	state, err := decodeRangeState(status, vniMin, vniMax)
+	return obj, state, err
+}
+
+// update applies mutate to the current state and writes it back. On a
+// resourceVersion conflict the state is re-read and mutate is applied again,
+// so mutate must not have side effects. If mutate returns changed == false,
+// nothing is written.
+func (s *KubeStore) update(mutate func(state *vniRangeState) (changed bool, err error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, state, err := s.get()
+		if err != nil {
+			return err
+		}
+		changed, err := mutate(state)
+		if err != nil || !changed {
+			return err
+		}
+
+		status, err := state.encode()
+		if err != nil {
+			return err
+		}
+		statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedMap(obj.Object, statusObj, "status"); err != nil {
+			return err
+		}
+		// obj carries the resourceVersion we read, so a concurrent write
+		// makes this fail with a conflict
+		_, err = s.client.Resource(vniRangeAllocationGVR).UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s *KubeStore) GetVni(vniUid string, namespace string) (int, error) {
+	_, state, err := s.get()
+	if err != nil {
+		return -1, err
+	}
+	entry, ok := state.allocs[allocKey(vniUid, namespace)]
+	if !ok {
+		return -1, nil
+	}
+	return int(entry.Vni), nil
+}
+
+func (s *KubeStore) Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	vni := -1
+	err := s.update(func(state *vniRangeState) (bool, error) {
+		if entry, ok := state.allocs[allocKey(vniUid, namespace)]; ok {
+			vni = int(entry.Vni)
+			return false, nil
+		}
+		// the closure is retried on conflicts
+		vni = -1
+		var releasedAt time.Time
+		for candidate := max(policy.Min, state.min); candidate < min(policy.Max, state.max); candidate++ {
+			if state.isSet(candidate) {
+				continue
+			}
+			ts, released := state.released[candidate]
+			if released && time.Since(ts) < policy.Quarantine {
+				continue
+			}
+			if _, ok := state.external[candidate]; ok {
+				continue
+			}
+			if policy.Strategy != StrategyLeastRecentlyReleased {
+				vni = candidate
+				break
+			}
+			if vni == -1 || ts.Before(releasedAt) {
+				vni, releasedAt = candidate, ts
+			}
+		}
+		if vni != -1 {
+			state.set(vni, true)
+			state.allocs[allocKey(vniUid, namespace)] = &vniRangeAllocationEntry{
+				Namespace: namespace,
+				VniUid:    vniUid,
+				Vni:       int64(vni),
+			}
+			return true, nil
+		}
+		return false, ErrNoFreeVNI
+	})
+	if err != nil {
+		return -1, err
+	}
+	return vni, nil
+}
+
+func (s *KubeStore) ReleaseUserCheck(vniUid string, namespace string, doLog bool) error {
+	return s.update(func(state *vniRangeState) (bool, error) {
+		entry, ok := state.allocs[allocKey(vniUid, namespace)]
+		if !ok {
+			return false, ErrVNINotFound
+		}
+		if len(entry.Users) > 0 {
+			return false, ErrVNIInUse
+		}
+		vni := int(entry.Vni)
+		state.set(vni, false)
+		state.released[vni] = time.Now()
+		delete(state.allocs, allocKey(vniUid, namespace))
+		return true, nil
+	})
+}
+
+func (s *KubeStore) AddUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return s.update(func(state *vniRangeState) (bool, error) {
+		entry, ok := state.allocs[allocKey(vniUid, namespace)]
+		if !ok {
+			return false, ErrVNINotFound
+		}
+		for _, user := range entry.Users {
+			if user == userId {
+				return false, nil
+			}
+		}
+		entry.Users = append(entry.Users, userId)
+		return true, nil
+	})
+}
+
+func (s *KubeStore) RemoveUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return s.update(func(state *vniRangeState) (bool, error) {
+		entry, ok := state.allocs[allocKey(vniUid, namespace)]
+		if !ok {
+			return false, nil
+		}
+		for i, user := range entry.Users {
+			if user == userId {
+				entry.Users = append(entry.Users[:i], entry.Users[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func (s *KubeStore) ListAllocations(namespace string) ([]Allocation, error) {
+	_, state, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	allocs := make([]Allocation, 0, len(state.allocs))
+	for _, entry := range state.allocs {
+		if namespace != "" && entry.Namespace != namespace {
+			continue
+		}
+		allocs = append(allocs, Allocation{
+			VniUid:    entry.VniUid,
+			Namespace: entry.Namespace,
+			Vni:       int(entry.Vni),
+			Users:     append([]string(nil), entry.Users...),
+		})
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		return allocKey(allocs[i].VniUid, allocs[i].Namespace) < allocKey(allocs[j].VniUid, allocs[j].Namespace)
+	})
+	return allocs, nil
+}
+
+func (s *KubeStore) SetProfile(vniUid string, namespace string, profile CxiProfile) error {
+	return s.update(func(state *vniRangeState) (bool, error) {
+		entry, ok := state.allocs[allocKey(vniUid, namespace)]
+		if !ok {
+			return false, ErrVNINotFound
+		}
+		if profile.IsEmpty() {
+			changed := entry.Profile != nil
+			entry.Profile = nil
+			return changed, nil
+		}
+		if entry.Profile != nil && reflect.DeepEqual(*entry.Profile, profile) {
+			return false, nil
+		}
+		entry.Profile = &profile
+		return true, nil
+	})
+}
+
+func (s *KubeStore) GetProfile(vniUid string, namespace string) (CxiProfile, error) {
+	_, state, err := s.get()
+	if err != nil {
+		return CxiProfile{}, err
+	}
+	entry, ok := state.allocs[allocKey(vniUid, namespace)]
+	if !ok || entry.Profile == nil {
+		return CxiProfile{}, nil
+	}
+	return *entry.Profile, nil
+}
+
+func (s *KubeStore) SetExternal(owner string, vnis []int) error {
+	return s.update(func(state *vniRangeState) (bool, error) {
+		held := make(map[int]bool, len(vnis))
+		for _, vni := range vnis {
+			held[vni] = true
+		}
+		changed := false
+		for vni, o := range state.external {
+			if o == owner && !held[vni] {
+				delete(state.external, vni)
+				state.released[vni] = time.Now()
+				changed = true
+			}
+		}
+		for vni := range held {
+			if _, ok := state.external[vni]; !ok {
+				state.external[vni] = owner
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+func (s *KubeStore) GetExternal() (map[string][]int, error) {
+	_, state, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	external := make(map[string][]int)
+	for vni, owner := range state.external {
+		external[owner] = append(external[owner], vni)
+	}
+	for _, vnis := range external {
+		sort.Ints(vnis)
+	}
+	return external, nil
+}
+
+func (s *KubeStore) Close() error {
+	return nil
+}
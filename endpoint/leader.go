@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// forwardedHeader marks requests proxied from a follower, so that they are
+// never forwarded a second time.
+const forwardedHeader = "X-Vni-Forwarded-By"
+
+// retryAfterSeconds is sent to callers while no leader is known.
+const retryAfterSeconds = "2"
+
+type LeaderConfig struct {
+	Namespace string
+	Name      string
+	// Identity is the holder identity written to the Lease. If it is an
+	// http(s) URL, followers proxy hook requests to it.
+	Identity string
+	Proxy    bool
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// LeaderElector runs Lease-based leader election among the endpoint replicas.
+// Only the leader serves the hooks; followers proxy to it or answer 503.
+type LeaderElector struct {
+	config   LeaderConfig
+	client   kubernetes.Interface
+	isLeader atomic.Bool
+
+	mu        sync.Mutex
+	leader    string
+	leaderURL *url.URL
+	proxy     *httputil.ReverseProxy
+}
+
+func NewLeaderElector(client kubernetes.Interface, config LeaderConfig) *LeaderElector {
+	return &LeaderElector{config: config, client: client}
+}
+
+func (l *LeaderElector) IsLeader() bool {
+	return l.isLeader.Load()
+}
+
+// Leader returns the identity of the current leader, or "" if none is known.
+func (l *LeaderElector) Leader() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *LeaderElector) setLeader(identity string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leader = identity
+	l.leaderURL = nil
+	l.proxy = nil
+	if u, err := url.Parse(identity); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		l.leaderURL = u
+		l.proxy = httputil.NewSingleHostReverseProxy(u)
+		l.proxy.Transport = peerTransport
+	}
+}
+
+// Run takes part in the election until ctx is done. After losing the lease it
+// rejoins as a follower.
+func (l *LeaderElector) Run(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: l.config.Namespace,
+			Name:      l.config.Name,
+		},
+		Client: l.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: l.config.Identity,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   l.config.LeaseDuration,
+			RenewDeadline:   l.config.RenewDeadline,
+			RetryPeriod:     l.config.RetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					l.isLeader.Store(true)
+					log.Printf("Became leader (%s)\n", l.config.Identity)
+				},
+				OnStoppedLeading: func() {
+					l.isLeader.Store(false)
+					log.Printf("Stopped leading (%s)\n", l.config.Identity)
+				},
+				OnNewLeader: func(identity string) {
+					l.setLeader(identity)
+					if identity != l.config.Identity {
+						log.Printf("New leader: %s\n", identity)
+					}
+				},
+			},
+		})
+		// leadership may not have been acquired at all if ctx ended
+		l.isLeader.Store(false)
+	}
+}
+
+// leading reports whether this replica should run leader-only background
+// work: it holds the Lease (if elected) and leads the Raft cluster (if any).
+func leading() bool {
+	if elector != nil && !elector.IsLeader() {
+		return false
+	}
+	if raftStore, ok := store.(*RaftStore); ok && !raftStore.IsLeader() {
+		return false
+	}
+	return true
+}
+
+// leaderOnly wraps a hook handler so that it only runs on the leader. It is a
+// no-op if leader election is disabled.
+func leaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if elector == nil {
+			handler(w, r)
+			return
+		}
+		elector.serve(handler, w, r)
+	}
+}
+
+// serve runs handler if l leads, and otherwise proxies r to the leader or
+// answers 503.
+func (l *LeaderElector) serve(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	if l.IsLeader() {
+		handler(w, r)
+		return
+	}
+
+	l.mu.Lock()
+	proxy := l.proxy
+	leader := l.leader
+	l.mu.Unlock()
+
+	if l.config.Proxy && proxy != nil && r.Header.Get(forwardedHeader) == "" &&
+		!strings.EqualFold(leader, l.config.Identity) {
+		r.Header.Set(forwardedHeader, l.config.Identity)
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Retry-After", retryAfterSeconds)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if leader == "" {
+		w.Write([]byte("no leader elected, retry later"))
+	} else {
+		w.Write([]byte("not the leader, current leader: " + leader))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// testInstance is an endpoint replica serving /sync in-process.
+type testInstance struct {
+	server  *httptest.Server
+	elector *LeaderElector
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+func startTestInstance(t *testing.T, client *kubefake.Clientset) *testInstance {
+	t.Helper()
+	instance := &testInstance{done: make(chan struct{})}
+	instance.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance.elector.serve(cSync, w, r)
+	}))
+	t.Cleanup(instance.server.Close)
+	instance.elector = NewLeaderElector(client, LeaderConfig{
+		Namespace:     "vni-management",
+		Name:          "vni-endpoint",
+		Identity:      instance.server.URL,
+		Proxy:         true,
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	})
+	var ctx context.Context
+	ctx, instance.stop = context.WithCancel(context.Background())
+	go func() {
+		instance.elector.Run(ctx)
+		close(instance.done)
+	}()
+	t.Cleanup(func() {
+		instance.stop()
+		<-instance.done
+	})
+	return instance
+}
+
+func (i *testInstance) sync(t *testing.T, body []byte) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(i.server.URL+"/sync", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response bytes.Buffer
+	response.ReadFrom(resp.Body)
+	return resp.StatusCode, response.Bytes()
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(15 * time.Second); !condition(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestFailover runs two replicas sharing a store and a Lease: the follower
+// proxies to the leader, and takes over once the leader stops.
+func TestFailover(t *testing.T) {
+	newTestStore(t)
+	client := kubefake.NewClientset()
+	body := readHook(t, "sync-deployment.json")
+	vniOf := func(response []byte) int {
+		var sync DecoratorSyncHookResponse
+		if err := json.Unmarshal(response, &sync); err != nil || len(sync.Attachments) != 1 {
+			t.Fatalf("response %s: %v", response, err)
+		}
+		return sync.Attachments[0].Spec.Vni
+	}
+
+	a := startTestInstance(t, client)
+	waitFor(t, "the first replica to lead", a.elector.IsLeader)
+	b := startTestInstance(t, client)
+	waitFor(t, "the second replica to follow", func() bool { return b.elector.Leader() == a.server.URL })
+	if b.elector.IsLeader() {
+		t.Fatal("both replicas lead")
+	}
+
+	status, response := b.sync(t, body)
+	if status != http.StatusOK {
+		t.Fatalf("sync on the follower: %d %s", status, response)
+	}
+	vni := vniOf(response)
+
+	a.stop()
+	<-a.done
+	waitFor(t, "the second replica to take over", b.elector.IsLeader)
+
+	status, response = b.sync(t, body)
+	if status != http.StatusOK {
+		t.Fatalf("sync on the new leader: %d %s", status, response)
+	}
+	if got := vniOf(response); got != vni {
+		t.Errorf("VNI %d after failover, was %d", got, vni)
+	}
+
+	// the stopped replica neither serves nor proxies
+	status, response = a.sync(t, body)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("sync on the stopped replica: %d %s", status, response)
+	}
+}
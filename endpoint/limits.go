@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBodyBytes bounds the size of request bodies. Hook requests carry the
+// parent object and its attachments, so this must be above the largest object
+// the API server accepts.
+var maxBodyBytes int64 = 4 << 20
+
+// clientLimiter is nil when rate limiting is disabled
+var clientLimiter *clientRateLimiter
+
+// writeSlots is nil when concurrent writes are not capped
+var writeSlots chan struct{}
+
+// limiterIdleTimeout is how long a client's bucket is kept after its last
+// request.
+const limiterIdleTimeout = 10 * time.Minute
+
+// clientRateLimiter keeps a token bucket per client address.
+type clientRateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimiter(perSecond float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:     rate.Limit(perSecond),
+		burst:     burst,
+		clients:   make(map[string]*clientBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// bucket returns the bucket of client, dropping the buckets of clients gone
+// idle. l.mu must be held.
+func (l *clientRateLimiter) bucket(client string, now time.Time) *clientBucket {
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for key, bucket := range l.clients {
+			if now.Sub(bucket.lastSeen) > limiterIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = bucket
+	}
+	bucket.lastSeen = now
+	return bucket
+}
+
+// reserve takes a token for client. If none is available, it returns how long
+// the client should wait.
+func (l *clientRateLimiter) reserve(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	reservation := l.bucket(client, now).limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// check is reserve without taking the token.
+func (l *clientRateLimiter) check(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	limiter := l.bucket(client, now).limiter
+	tokens := limiter.TokensAt(now)
+	if tokens >= 1 {
+		return true, 0
+	}
+	if l.limit <= 0 {
+		return false, time.Second
+	}
+	return false, time.Duration((1 - tokens) / float64(l.limit) * float64(time.Second))
+}
+
+// clientKey identifies the client by its address
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitBody caps the request body at maxBodyBytes.
+func limitBody(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		handler(w, r)
+	}
+}
+
+// readBody reads the whole request body, answering 413 or 400 if it cannot.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectedRequests.WithLabelValues(r.Pattern, reasonBodyTooLarge).Inc()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit)))
+		log.Printf("Rejected request body larger than %d bytes from %s\n", tooLarge.Limit, r.RemoteAddr)
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reading body: %v\n", err)
+		return nil, false
+	}
+	return body, true
+}
+
+// rateLimit answers 429 to clients that exceed their token bucket. It wraps
+// authentication, so that a client cannot make the endpoint call TokenReview
+// without limit. Requests a follower forwards count against the follower's
+// address: headers are set by the client and are not trusted.
+func rateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientLimiter == nil {
+			handler(w, r)
+			return
+		}
+		client := clientKey(r)
+		if ok, delay := clientLimiter.reserve(client); !ok {
+			tooManyRequests(w, r, client, delay)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// rateLimitHooks authenticates the hook users and limits the hook routes.
+// Metacontroller sends all hooks from one address, so the requests of the
+// users in hookUsers are not limited per address: limitWrites bounds them
+// instead. Requests that fail authentication still take a token of their
+// address, and are refused once it has none, so that TokenReview is not
+// called without limit. Without authentication, all requests are limited per
+// address as by rateLimit.
+func rateLimitHooks(handler http.HandlerFunc) http.HandlerFunc {
+	users := hookUsers
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientLimiter == nil || authenticator == nil {
+			rateLimit(usersAuth(users, handler))(w, r)
+			return
+		}
+		client := clientKey(r)
+		if ok, delay := clientLimiter.check(client); !ok {
+			tooManyRequests(w, r, client, delay)
+			return
+		}
+		r, ok := checkUser(w, r, users)
+		if !ok {
+			clientLimiter.reserve(client)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, client string, delay time.Duration) {
+	rejectedRequests.WithLabelValues(r.Pattern, reasonRateLimited).Inc()
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(delay.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("rate limit exceeded, retry later"))
+	log.Printf("Rate limited %s on %s\n", client, r.URL.Path)
+}
+
+// limitWrites runs at most cap(writeSlots) write handlers at once. Further
+// requests wait for a free slot until their client gives up.
+func limitWrites(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if writeSlots == nil {
+			handler(w, r)
+			return
+		}
+		queuedWrites.Inc()
+		select {
+		case writeSlots <- struct{}{}:
+			queuedWrites.Dec()
+		case <-r.Context().Done():
+			queuedWrites.Dec()
+			rejectedRequests.WithLabelValues(r.Pattern, reasonCanceled).Inc()
+			return
+		}
+		inflightWrites.Inc()
+		defer func() {
+			inflightWrites.Dec()
+			<-writeSlots
+		}()
+		handler(w, r)
+	}
+}
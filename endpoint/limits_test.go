@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// countingAuthenticator accepts any token but "invalid" and counts the calls,
+// like a TokenReview per request would. The token "other" is another user's.
+type countingAuthenticator struct {
+	calls int
+}
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context, token string) (*UserInfo, error) {
+	a.calls++
+	switch token {
+	case "invalid":
+		return nil, ErrUnauthenticated
+	case "other":
+		return &UserInfo{Username: "system:serviceaccount:default:other"}, nil
+	}
+	return &UserInfo{Username: "system:serviceaccount:metacontroller:metacontroller"}, nil
+}
+
+func TestRateLimit(t *testing.T) {
+	oldLimiter, oldAuthenticator, oldHookUsers := clientLimiter, authenticator, hookUsers
+	defer func() { clientLimiter, authenticator, hookUsers = oldLimiter, oldAuthenticator, oldHookUsers }()
+	counting := &countingAuthenticator{}
+	authenticator, hookUsers = counting, nil
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"client", http.Header{"Authorization": {"Bearer token"}}},
+		{"forged forwarding", http.Header{"Authorization": {"Bearer token"}, forwardedHeader: {"http://10.0.0.2:8842"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientLimiter = newClientRateLimiter(1, 2)
+			counting.calls = 0
+			handler := rateLimit(hookAuth(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var codes []int
+			for range 4 {
+				request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+				request.Header = test.header.Clone()
+				recorder := httptest.NewRecorder()
+				handler(recorder, request)
+				codes = append(codes, recorder.Code)
+			}
+			want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+			for i := range want {
+				if codes[i] != want[i] {
+					t.Fatalf("status codes %v, want %v", codes, want)
+				}
+			}
+			if counting.calls != 2 {
+				t.Errorf("authenticated %d requests, want 2", counting.calls)
+			}
+		})
+	}
+}
+
+func TestRateLimitHooks(t *testing.T) {
+	oldLimiter, oldAuthenticator, oldHookUsers := clientLimiter, authenticator, hookUsers
+	defer func() { clientLimiter, authenticator, hookUsers = oldLimiter, oldAuthenticator, oldHookUsers }()
+	counting := &countingAuthenticator{}
+	authenticator = counting
+	hookUsers = map[string]bool{"system:serviceaccount:metacontroller:metacontroller": true}
+
+	tests := []struct {
+		name  string
+		token string
+		want  []int
+		calls int
+	}{
+		// Metacontroller sends all hooks from one address
+		{name: "hook user", token: "token", want: slices.Repeat([]int{http.StatusOK}, 6), calls: 6},
+		{name: "invalid token", token: "invalid", calls: 2, want: []int{http.StatusUnauthorized,
+			http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{name: "other user", token: "other", calls: 2, want: []int{http.StatusForbidden,
+			http.StatusForbidden, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientLimiter = newClientRateLimiter(0.001, 2)
+			counting.calls = 0
+			handler := rateLimitHooks(func(w http.ResponseWriter, r *http.Request) {
+				if requestUser(r) == nil {
+					t.Error("no user in the request context")
+				}
+			})
+
+			var codes []int
+			for range test.want {
+				request := httptest.NewRequest(http.MethodPost, "/sync", nil)
+				request.Header.Set("Authorization", "Bearer "+test.token)
+				recorder := httptest.NewRecorder()
+				handler(recorder, request)
+				codes = append(codes, recorder.Code)
+			}
+			if !slices.Equal(codes, test.want) {
+				t.Errorf("status codes %v, want %v", codes, test.want)
+			}
+			if counting.calls != test.calls {
+				t.Errorf("authenticated %d requests, want %d", counting.calls, test.calls)
+			}
+		})
+	}
+
+	t.Run("without authentication", func(t *testing.T) {
+		authenticator = nil
+		clientLimiter = newClientRateLimiter(0.001, 2)
+		handler := rateLimitHooks(func(w http.ResponseWriter, r *http.Request) {})
+		var codes []int
+		for range 3 {
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodPost, "/sync", nil))
+			codes = append(codes, recorder.Code)
+		}
+		if want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}; !slices.Equal(codes, want) {
+			t.Errorf("status codes %v, want %v", codes, want)
+		}
+	})
+}
@@ -1,17 +1,378 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 
 	filePath := flag.String("file", "/opt/db/db.sqlite3", "Path to sqlite3 file")
 	shouldLog := flag.Bool("log", false, "Log events to vni_allocs_log")
+	migrateOnly := flag.Bool("migrate-only", false, "Apply pending schema migrations and exit")
+	backupDir := flag.String("backup-dir", "", "Directory for periodic DB backups (disabled if empty)")
+	backupInterval := flag.Duration("backup-interval", time.Hour, "Interval between periodic DB backups")
+	backupKeep := flag.Int("backup-keep", 24, "Number of periodic DB backups to keep")
+	storeKind := flag.String("store", "sqlite", "Storage backend: sqlite, postgres, kube or raft")
+	postgresDSN := flag.String("postgres-dsn", "", "PostgreSQL connection string (store postgres)")
+	kubeObjectName := flag.String("kube-allocation-name", "default", "Name of the VniRangeAllocation object (store kube)")
+	raftId := flag.String("raft-id", "", "Raft server ID, the HTTP base URL of this endpoint (store raft)")
+	raftDir := flag.String("raft-dir", "/opt/db/raft", "Directory for the Raft log and snapshots (store raft)")
+	raftBind := flag.String("raft-bind", ":8843", "Listen address for Raft traffic (store raft)")
+	raftAdvertise := flag.String("raft-advertise", "", "Address other peers reach Raft traffic at (store raft)")
+	raftPeers := flag.String("raft-peers", "", "Initial cluster as comma-separated id=address pairs (store raft)")
+	leaderElect := flag.Bool("leader-elect", false, "Run Lease-based leader election; only the leader serves hooks")
+	leaderNamespace := flag.String("leader-election-namespace", "vni-management", "Namespace of the leader election Lease")
+	leaderName := flag.String("leader-election-id", "vni-endpoint", "Name of the leader election Lease")
+	leaderIdentity := flag.String("leader-identity", "", "Identity in the Lease, use http://<pod ip>:8842 to enable proxying (defaults to hostname)")
+	leaderProxy := flag.Bool("leader-proxy", true, "Proxy hook requests on followers to the leader instead of answering 503")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enables HTTPS (reloaded on change)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle for client certificates, requires them if set")
+	tlsPeerCA := flag.String("tls-peer-ca", "", "CA bundle to verify other endpoint replicas")
+	authTokenFile := flag.String("auth-token-file", "", "Static bearer tokens (token,user,uid,groups) for hook callers")
+	authTokenReview := flag.Bool("auth-tokenreview", false, "Authenticate hook callers with the TokenReview API")
+	authAudiences := flag.String("auth-audiences", "", "Comma-separated token audiences for TokenReview")
+	authHookUsers := flag.String("auth-hook-users", "system:serviceaccount:metacontroller:metacontroller",
+		"Comma-separated users allowed to call the hooks (any authenticated user if empty)")
+	authAgentUsers := flag.String("auth-agent-users", "system:serviceaccount:vni-management:vni-agent",
+		"Comma-separated users allowed to report CXI services (any authenticated user if empty)")
+	agentReportTTL := flag.Duration("agent-report-ttl", 5*time.Minute, "Detach nodes whose CXI agent has not reported for this long")
+	authSAR := flag.Bool("auth-sar", false, "Authorize admin operations with SubjectAccessReviews")
+	peerToken := flag.String("peer-token-file", "", "Bearer token file sent to other endpoint replicas")
+	cxiPolicyFile := flag.String("cxi-policy-file", "", "YAML file with the traffic classes and CXI limits allowed per namespace")
+	parentResources := flag.String("parent-resources", strings.Join(defaultAllowedParents, ","),
+		"Comma-separated Kind.apiVersion of the parents in vni-controller.yml; hook requests for others are rejected")
+	maxBody := flag.Int64("max-body-bytes", maxBodyBytes, "Maximum size of request bodies")
+	rateLimitPerSecond := flag.Float64("rate-limit", 10, "Requests per second allowed per client address (0 disables)")
+	rateBurst := flag.Int("rate-burst", 50, "Burst of requests allowed per client address")
+	maxWrites := flag.Int("max-concurrent-writes", 4, "Write requests handled at once, further ones queue (0 disables)")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "Time to keep serving after SIGTERM while /readyz fails")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 20*time.Second, "Time to wait for in-flight requests on shutdown")
+	readyzLeader := flag.Bool("readyz-require-leader", false, "Report followers as not ready (with leader election)")
+	slurmSource := flag.String("slurm-source", "",
+		"Import the VNIs allocated by Slurm from file:<path>, http(s)://<url> or exec:<command> (disabled if empty)")
+	slurmInterval := flag.Duration("slurm-interval", time.Minute, "Interval between imports from Slurm")
+	podLookup := flag.Bool("pod-lookup", true, "Serve the VNIs of pods to the CNI plugin (needs access to the Kubernetes API)")
+	poolRefresh := flag.Duration("pool-refresh", 30*time.Second,
+		"Interval between lists of the VniPools in the cluster (0 to only learn them from the /pool hooks)")
+	recordEvents := flag.Bool("record-events", true, "Record Kubernetes Events on the objects VNIs are allocated for")
+	eventQPS := flag.Float64("event-qps", 1.0/300, "Events per second allowed per object after a burst")
+	eventBurst := flag.Int("event-burst", 25, "Burst of Events allowed per object")
+	drainBackoff := flag.Duration("drain-backoff", 5*time.Second,
+		"First interval between checks of a deleted VniClaim or job whose VNI is still in use; doubles up to --drain-max-backoff")
+	drainMaxBackoff := flag.Duration("drain-max-backoff", 5*time.Minute, "Maximum interval between checks of a draining VNI")
+	drainTimeout := flag.Duration("drain-timeout", 0,
+		"Detach the remaining users and release a VNI after draining this long (wait forever if 0)")
+	forecastInterval := flag.Duration("forecast-interval", 5*time.Minute,
+		"Interval between capacity forecasts from vni_allocs_log, needs --log (0 disables)")
+	forecastWindow := flag.Duration("forecast-window", 24*time.Hour, "Allocation history the capacity forecast is computed over")
+	forecastWarning := flag.Duration("forecast-warning", 0,
+		"Warn about pools projected to run out of VNIs within this time (0 disables)")
+	forecastWebhook := flag.String("forecast-webhook", "", "URL the forecast of pools warned about is posted to as JSON")
+	kubeconfig := flag.String("kubeconfig", "", "Path to kubeconfig (in-cluster config if empty)")
 	flag.Parse()
 
-	if err := StartServer(filePath, *shouldLog); err != nil {
+	switch flag.Arg(0) {
+	case "":
+	case "restore":
+		// restore <backup file>: replace the DB with a backup, endpoint must be stopped
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: %s [-file db] restore <backup file>", flag.CommandLine.Name())
+		}
+		if *storeKind != "sqlite" {
+			log.Fatalf("restore replaces a sqlite3 file, not --store %s; use the tooling of that store instead", *storeKind)
+		}
+		if err := Restore(filePath, flag.Arg(1)); err != nil {
+			log.Fatalf("Error restoring DB: %v", err)
+		}
+		return
+	case "recover":
+		// recover [-dry-run]: rebuild an empty DB from the Vni objects in the cluster
+		recoverFlags := flag.NewFlagSet("recover", flag.ExitOnError)
+		dryRun := recoverFlags.Bool("dry-run", false, "Only report the reconstructed state")
+		recoverFlags.Parse(flag.Args()[1:])
+		if *storeKind != "sqlite" {
+			log.Fatalf("recover writes a sqlite3 file, not --store %s", *storeKind)
+		}
+		if err := RecoverFromCluster(filePath, *kubeconfig, *dryRun, *shouldLog); err != nil {
+			log.Fatalf("Error recovering DB: %v", err)
+		}
+		return
+	case "simulate":
+		// simulate [-pools file] [-jobs n ...]: replay the allocation history or a
+		//  synthetic trace against proposed VniPools
+		simulateFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+		poolsFile := simulateFlags.String("pools", "", "YAML file with the proposed VniPools (the whole range without pools if empty)")
+		jobs := simulateFlags.Int("jobs", 0, "Replay a synthetic trace of this many jobs instead of the history in --file")
+		interarrival := simulateFlags.Duration("interarrival", 10*time.Second, "Mean time between synthetic job arrivals")
+		hold := simulateFlags.Duration("hold", time.Hour, "Mean time synthetic jobs hold their VNI")
+		namespaces := simulateFlags.String("namespaces", "default", "Comma-separated namespaces of synthetic jobs")
+		seed := simulateFlags.Int64("seed", 1, "Seed of the synthetic trace")
+		simulateFlags.Parse(flag.Args()[1:])
+		if *storeKind == "kube" && *jobs == 0 {
+			log.Fatalf("--store kube keeps no allocation history to replay, use -jobs for a synthetic trace")
+		}
+		err := RunSimulation(filePath, SimulationConfig{
+			PoolsFile:    *poolsFile,
+			Jobs:         *jobs,
+			Interarrival: *interarrival,
+			Hold:         *hold,
+			Namespaces:   splitList(*namespaces),
+			Seed:         *seed,
+		})
+		if err != nil {
+			log.Fatalf("Error simulating: %v", err)
+		}
+		return
+	case "agent":
+		// agent: run the CXI node agent, as a DaemonSet
+		agentFlags := flag.NewFlagSet("agent", flag.ExitOnError)
+		nodeName := agentFlags.String("node-name", os.Getenv("NODE_NAME"), "Name of this node (defaults to $NODE_NAME)")
+		driverName := agentFlags.String("cxi-driver", "", "CXI driver: exec, or fake for nodes without Slingshot NICs")
+		driverCommand := agentFlags.String("cxi-driver-command", "", "Command wrapping libcxi (driver exec)")
+		endpointURL := agentFlags.String("endpoint-url", "http://vni-endpoint-service.vni-management:8842",
+			"Base URL of the endpoint to report CXI services to")
+		trafficClasses := agentFlags.String("traffic-classes", "BEST_EFFORT", "Comma-separated traffic classes of the CXI services")
+		resync := agentFlags.Duration("resync", 30*time.Second, "Interval between full reconciliations and reports")
+		agentFlags.Parse(flag.Args()[1:])
+
+		driver, err := NewCxiDriver(*driverName, *driverCommand)
+		if err != nil {
+			log.Fatalf("Error creating CXI driver: %v", err)
+		}
+		if *tlsPeerCA != "" {
+			transport, err := newPeerTransport(*tlsPeerCA, *tlsCert, *tlsKey)
+			if err != nil {
+				log.Fatalf("Error loading TLS configuration: %v", err)
+			}
+			peerTransport = transport
+		}
+		peerTokenFile = *peerToken
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		err = RunAgent(ctx, AgentConfig{
+			NodeName:       *nodeName,
+			Kubeconfig:     *kubeconfig,
+			Driver:         driver,
+			EndpointURL:    *endpointURL,
+			TrafficClasses: splitList(*trafficClasses),
+			ResyncPeriod:   *resync,
+		})
+		if err != nil {
+			log.Fatalf("Error running CXI agent: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	if *migrateOnly {
+		version, err := MigrateStore(StoreConfig{Kind: *storeKind, FilePath: filePath, PostgresDSN: *postgresDSN})
+		if err != nil {
+			log.Fatalf("Error migrating DB: %v", err)
+		}
+		log.Printf("DB schema is at version %d\n", version)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var err error
+	if *backupDir != "" && *storeKind == "sqlite" {
+		go StartBackups(ctx, filePath, *backupDir, *backupInterval, *backupKeep)
+	}
+
+	if *tlsCert != "" || *tlsPeerCA != "" {
+		transport, err := newPeerTransport(*tlsPeerCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS configuration: %v", err)
+		}
+		peerTransport = transport
+	}
+	peerTokenFile = *peerToken
+
+	switch {
+	case *authTokenFile != "" && *authTokenReview:
+		log.Fatalf("Only one of --auth-token-file and --auth-tokenreview may be given")
+	case *authTokenFile != "":
+		authenticator, err = NewStaticTokenAuthenticator(*authTokenFile)
+		if err != nil {
+			log.Fatalf("Error loading token file: %v", err)
+		}
+	case *authTokenReview:
+		client, err := newKubeClient(*kubeconfig)
+		if err != nil {
+			log.Fatalf("Error creating Kubernetes client: %v", err)
+		}
+		authenticator = NewTokenReviewAuthenticator(client, splitList(*authAudiences))
+	}
+	if *authSAR {
+		if authenticator == nil {
+			log.Fatalf("--auth-sar requires --auth-tokenreview or --auth-token-file")
+		}
+		client, err := newKubeClient(*kubeconfig)
+		if err != nil {
+			log.Fatalf("Error creating Kubernetes client: %v", err)
+		}
+		authorizer = NewSubjectAccessReviewAuthorizer(client)
+	}
+	hookUsers = make(map[string]bool)
+	for _, user := range splitList(*authHookUsers) {
+		hookUsers[user] = true
+	}
+	agentUsers = make(map[string]bool)
+	for _, user := range splitList(*authAgentUsers) {
+		agentUsers[user] = true
+	}
+	if *agentReportTTL <= 0 {
+		log.Fatalf("--agent-report-ttl must be positive, got %v", *agentReportTTL)
+	}
+	if *slurmSource != "" && *slurmInterval <= 0 {
+		log.Fatalf("--slurm-interval must be positive, got %v", *slurmInterval)
+	}
+	if *leaderElect && *storeKind == "sqlite" {
+		log.Fatalf("--leader-elect requires a store shared by the replicas (postgres, kube or raft), not sqlite")
+	}
+	if *storeKind == "raft" && *tlsCert != "" && *tlsPeerCA == "" {
+		log.Fatalf("--store raft with --tls-cert requires --tls-peer-ca to authenticate the Raft peers")
+	}
+	if *shouldLog && *storeKind == "kube" {
+		// no vni_allocs_log to write, so simulate and the forecast have no history
+		log.Fatalf("--log requires a store with an allocation log (sqlite, postgres or raft), not kube")
+	}
+	if *forecastInterval > 0 && *forecastWindow <= 0 {
+		log.Fatalf("--forecast-window must be positive, got %v", *forecastWindow)
+	}
+	maxBodyBytes = *maxBody
+	if *rateLimitPerSecond > 0 {
+		clientLimiter = newClientRateLimiter(*rateLimitPerSecond, *rateBurst)
+	}
+	if *maxWrites > 0 {
+		writeSlots = make(chan struct{}, *maxWrites)
+	}
+	readyRequiresLeader = *readyzLeader
+	if *cxiPolicyFile != "" {
+		cxiPolicies, err = LoadCxiPolicies(*cxiPolicyFile)
+		if err != nil {
+			log.Fatalf("Error loading CXI policy: %v", err)
+		}
+	}
+	if err := setAllowedParents(splitList(*parentResources)); err != nil {
+		log.Fatalf("Error in --parent-resources: %v", err)
+	}
+
+	if *podLookup {
+		client, err := newDynamicClient(*kubeconfig)
+		if err != nil {
+			log.Printf("Pod VNI lookup disabled: %v\n", err)
+		} else {
+			podClient = client
+		}
+	}
+
+	if *poolRefresh > 0 {
+		client, err := newDynamicClient(*kubeconfig)
+		if err != nil {
+			log.Printf("Not listing VniPools: %v\n", err)
+		} else {
+			go StartPoolRefresh(ctx, client, *poolRefresh)
+		}
+	}
+
+	if *recordEvents {
+		client, err := newKubeClient(*kubeconfig)
+		if err != nil {
+			log.Printf("Events disabled: %v\n", err)
+		} else {
+			eventRecorder = NewEventRecorder(ctx, client, float32(*eventQPS), *eventBurst)
+		}
+	}
+
+	store, err := OpenStore(StoreConfig{
+		Kind:           *storeKind,
+		FilePath:       filePath,
+		PostgresDSN:    *postgresDSN,
+		Kubeconfig:     *kubeconfig,
+		KubeObjectName: *kubeObjectName,
+		RaftID:         *raftId,
+		RaftDir:        *raftDir,
+		RaftBind:       *raftBind,
+		RaftAdvertise:  *raftAdvertise,
+		RaftPeers:      *raftPeers,
+		RaftTLS:        RaftTLS{CertFile: *tlsCert, KeyFile: *tlsKey, PeerCAFile: *tlsPeerCA},
+	})
+	if err != nil {
+		log.Fatalf("Error opening store: %v", err)
+	}
+	defer store.Close()
+
+	if *leaderElect {
+		client, err := newKubeClient(*kubeconfig)
+		if err != nil {
+			log.Fatalf("Error creating Kubernetes client: %v", err)
+		}
+		identity := *leaderIdentity
+		if identity == "" {
+			identity, err = os.Hostname()
+			if err != nil {
+				log.Fatalf("Error getting hostname: %v", err)
+			}
+		}
+		elector = NewLeaderElector(client, LeaderConfig{
+			Namespace:     *leaderNamespace,
+			Name:          *leaderName,
+			Identity:      identity,
+			Proxy:         *leaderProxy,
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   2 * time.Second,
+		})
+		// the lease is only given up once in-flight requests are drained
+		electorCtx, stopElector := context.WithCancel(context.Background())
+		electorDone := make(chan struct{})
+		go func() {
+			elector.Run(electorCtx)
+			close(electorDone)
+		}()
+		defer func() {
+			stopElector()
+			<-electorDone
+		}()
+	}
+
+	err = StartServer(ctx, store, *shouldLog, ServerConfig{
+		TLSCertFile:     *tlsCert,
+		TLSKeyFile:      *tlsKey,
+		TLSClientCAFile: *tlsClientCA,
+		ShutdownDelay:   *shutdownDelay,
+		ShutdownTimeout: *shutdownTimeout,
+		AgentReportTTL:  *agentReportTTL,
+		SlurmSource:     *slurmSource,
+		SlurmInterval:   *slurmInterval,
+		Drain:           DrainPolicy{Backoff: *drainBackoff, MaxBackoff: *drainMaxBackoff, Timeout: *drainTimeout},
+		Forecast: ForecastConfig{Interval: *forecastInterval, Window: *forecastWindow,
+			Warning: *forecastWarning, Webhook: *forecastWebhook},
+	})
+	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
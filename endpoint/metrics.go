@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are served in the Prometheus format on /metrics.
+var (
+	rejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vni_rejected_requests_total",
+		Help: "Requests rejected before reaching the handler, by route and reason.",
+	}, []string{"route", "reason"})
+
+	queuedWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vni_queued_writes",
+		Help: "Write requests waiting for a free write slot.",
+	})
+
+	inflightWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vni_inflight_writes",
+		Help: "Write requests currently being handled.",
+	})
+)
+
+const (
+	reasonBodyTooLarge = "body_too_large"
+	reasonRateLimited  = "rate_limited"
+	reasonCanceled     = "canceled_while_queued"
+	reasonInvalid      = "invalid"
+)
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+// migration is a single numbered schema change. Migrations are applied in
+// order, each inside its own transaction, and are never edited once released:
+// a schema change always gets a new version number.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "initial v1.0 schema", migrateV1},
+	{2, "CXI profiles of allocations", migrateV2},
+	{3, "VNIs held by external allocators", migrateV3},
+}
+
+// schemaVersion is the schema version this binary expects.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrateV1 creates the schema as shipped with v1.0. All statements use
+// "if not exists", so databases created by v1.0 (which have no schema_version
+// table) are adopted as version 1 without changes.
+func migrateV1(ctx context.Context, tx *sql.Tx) error {
+	// vni_allocs
+	_, err := tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS
+    vni_allocs (
+		vniUid string not null,
+		namespace string not null,
+        vni integer not null,
+        unique (vniUid, namespace, vni),
+        primary key (vniUid, namespace)
+    );
+	create index if not exists vni_allocs_idx on vni_allocs(vni);
+	create index if not exists vni_allocs_idx2 on vni_allocs(vniUid, namespace, vni);`)
+	if err != nil {
+		return err
+	}
+
+	// vni_allocs_log
+	_, err = tx.ExecContext(ctx, `
+	CREATE TABLE if not exists
+	vni_allocs_log (
+	   vniUid string not null,
+	   namespace string not null,
+       vni integer not null,
+	   operation text not null,
+	   ts datetime not null
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// vni_users
+	_, err = tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS
+    vni_users (
+		vniUid string not null,
+		namespace string not null,
+        userId text not null,
+        unique (vniUid, namespace, userId),
+        primary key (vniUid, namespace, userId)
+    );
+	create index if not exists vni_users_idx on vni_users(vniUid, namespace, userId);`)
+	if err != nil {
+		return err
+	}
+
+	// vni_users_log
+	_, err = tx.ExecContext(ctx, `
+	CREATE TABLE if not exists
+	vni_users_log (
+	   vniUid string not null,
+	   namespace string not null,
+       userId text not null,
+	   operation text not null,
+	   ts datetime not null
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// available_vnis
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+	CREATE TABLE if not exists
+	available_vnis (
+		vni int not null primary key,
+		lastReleased datetime,
+		unique (vni),
+	    check (vni >= %d and vni < %d)
+	);`, vniMin, vniMax))
+	return err
+}
+
+// migrateV2 adds the CXI profile (traffic classes and resource limits) of
+// allocations, stored as JSON next to vni_allocs.
+func migrateV2(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS
+	vni_profiles (
+		vniUid string not null,
+		namespace string not null,
+		profile text not null,
+		primary key (vniUid, namespace)
+	);`)
+	return err
+}
+
+// migrateV3 marks VNIs allocated outside of Kubernetes, e.g. by Slurm. A VNI
+// with a non-null external column is never acquired.
+func migrateV3(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE available_vnis ADD COLUMN external text;`)
+	return err
+}
+
+// GetSchemaVersion returns the highest migration version applied to db, or 0
+// if the schema_version table does not exist yet.
+func GetSchemaVersion(db *sql.DB) (int, error) {
+	ctx := context.TODO()
+	var name string
+	err := db.QueryRowContext(ctx, `
+	select name
+	from sqlite_master
+	where type = 'table' and name = 'schema_version';`).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_version;`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies all pending migrations to db. Each migration runs in its
+// own transaction together with its schema_version row, so a failing
+// migration leaves the database at the previous version.
+func Migrate(db *sql.DB) error {
+	ctx := context.TODO()
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS
+	schema_version (
+		version integer not null primary key,
+		description text not null,
+		ts datetime not null
+	);`)
+	if err != nil {
+		return err
+	}
+
+	current, err := GetSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > schemaVersion() {
+		return fmt.Errorf("%w: found %d, expected at most %d", ErrSchemaTooNew, current, schemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable})
+		if err != nil {
+			return err
+		}
+		if err := m.up(ctx, tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		_, err = tx.ExecContext(ctx, `insert into schema_version(version, description, ts) values (?, ?, ?);`,
+			m.version, m.description, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied schema migration %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newFixtureStore returns a store on a database created from
+// testdata/migrations/v1.0.sql and the statements in extra.
+func newFixtureStore(t *testing.T, extra string) *SQLiteStore {
+	t.Helper()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "migrations", "v1.0.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "vni.db")
+	s, err := NewSQLiteStore(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	if _, err := s.db.Exec(string(fixture) + extra); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMigrateV1(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+	}{
+		// as shipped with v1.0, without schema_version
+		{name: "v1.0"},
+		{
+			name: "version 1",
+			extra: `create table schema_version (version integer not null primary key, description text not null,
+				ts datetime not null);
+				insert into schema_version values (1, 'initial v1.0 schema', '2024-05-02 09:00:00');`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFixtureStore(t, test.extra)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+
+			version, err := GetSchemaVersion(s.db)
+			if err != nil || version != 3 {
+				t.Fatalf("schema version %d (%v), want 3", version, err)
+			}
+			var versions []int
+			rows, err := s.db.Query(`select version from schema_version order by version;`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var v int
+				if err := rows.Scan(&v); err != nil {
+					t.Fatal(err)
+				}
+				versions = append(versions, v)
+			}
+			rows.Close()
+			if !slices.Equal(versions, []int{1, 2, 3}) {
+				t.Errorf("schema_version rows %v", versions)
+			}
+
+			var columns []string
+			rows, err = s.db.Query(`select name from pragma_table_info('available_vnis');`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					t.Fatal(err)
+				}
+				columns = append(columns, name)
+			}
+			rows.Close()
+			if !slices.Equal(columns, []string{"vni", "lastReleased", "external"}) {
+				t.Errorf("available_vnis columns %v", columns)
+			}
+			var profiles int
+			if err := s.db.QueryRow(`select count(*) from vni_profiles;`).Scan(&profiles); err != nil {
+				t.Errorf("vni_profiles: %v", err)
+			}
+
+			// the v1.0 data is kept
+			allocations, err := s.ListAllocations("vnitest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(allocations) != 1 || allocations[0].VniUid != "my-claim" || allocations[0].Vni != 100 ||
+				!slices.Equal(allocations[0].Users, []string{jobUid}) {
+				t.Errorf("allocations %+v", allocations)
+			}
+			var lastReleased time.Time
+			if err := s.db.QueryRow(`select lastReleased from available_vnis where vni = 101;`).Scan(&lastReleased); err != nil ||
+				!lastReleased.Equal(time.Date(2024, 5, 2, 9, 14, 11, 0, time.UTC)) {
+				t.Errorf("lastReleased of 101 %v (%v)", lastReleased, err)
+			}
+			var available int
+			if err := s.db.QueryRow(`select count(*) from available_vnis;`).Scan(&available); err != nil ||
+				available != vniMax-vniMin {
+				t.Errorf("%d available VNIs (%v), want %d", available, err, vniMax-vniMin)
+			}
+
+			// and the new columns are used
+			profile := CxiProfile{TrafficClasses: []string{"BEST_EFFORT"}}
+			if err := s.SetProfile("my-claim", "vnitest", profile); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.GetProfile("my-claim", "vnitest"); err != nil || !slices.Equal(got.TrafficClasses, profile.TrafficClasses) {
+				t.Errorf("profile %+v (%v)", got, err)
+			}
+			if err := s.SetExternal("slurm", []int{101, 102}); err != nil {
+				t.Fatal(err)
+			}
+			vni, err := s.Acquire("vni-new", "vnitest", defaultPolicy(), false)
+			if err != nil || vni != 103 {
+				t.Errorf("acquired %d (%v), want 103 past the allocated and external VNIs", vni, err)
+			}
+		})
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	s := newFixtureStore(t, `create table schema_version (version integer not null primary key,
+		description text not null, ts datetime not null);
+		insert into schema_version values (4, 'from a newer release', '2024-05-02 09:00:00');`)
+	if err := s.Init(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Init: %v, want %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vni.db")
+	version, err := MigrateStore(StoreConfig{Kind: "sqlite", FilePath: &path})
+	if err != nil || version != schemaVersion() {
+		t.Fatalf("sqlite: version %d, %v, want %d", version, err, schemaVersion())
+	}
+	db, err := open(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var applied int
+	if err := db.QueryRow(`select max(version) from schema_version;`).Scan(&applied); err != nil || applied != version {
+		t.Errorf("schema_version %d, %v, want %d", applied, err, version)
+	}
+
+	// no store but sqlite3 may touch the file
+	for _, kind := range []string{"postgres", "kube", "raft", "etcd"} {
+		other := filepath.Join(t.TempDir(), "vni.db")
+		if _, err := MigrateStore(StoreConfig{Kind: kind, FilePath: &other}); err == nil {
+			t.Errorf("%s: migrated without error", kind)
+		}
+		if _, err := os.Stat(other); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: created %s", kind, other)
+		}
+	}
+}
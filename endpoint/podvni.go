@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// podGroupAnnotation names the Volcano PodGroup of a pod.
+const podGroupAnnotation = "scheduling.k8s.io/group-name"
+
+// maxOwnerDepth bounds the owner chain walked from a pod.
+const maxOwnerDepth = 8
+
+var podGVR = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// ownerResources maps the kinds that own pods, directly or through other
+// owners, to their resources. Keys are <kind>.<apiVersion> as in
+// allowedParents.
+var ownerResources = map[string]schema.GroupVersionResource{
+	"ReplicaSet.apps/v1":                     {Group: "apps", Version: "v1", Resource: "replicasets"},
+	"Deployment.apps/v1":                     {Group: "apps", Version: "v1", Resource: "deployments"},
+	"DaemonSet.apps/v1":                      {Group: "apps", Version: "v1", Resource: "daemonsets"},
+	"StatefulSet.apps/v1":                    {Group: "apps", Version: "v1", Resource: "statefulsets"},
+	"Job.batch/v1":                           {Group: "batch", Version: "v1", Resource: "jobs"},
+	"CronJob.batch/v1":                       {Group: "batch", Version: "v1", Resource: "cronjobs"},
+	"Job.batch.volcano.sh/v1alpha1":          {Group: "batch.volcano.sh", Version: "v1alpha1", Resource: "jobs"},
+	"PodGroup.scheduling.volcano.sh/v1beta1": {Group: "scheduling.volcano.sh", Version: "v1beta1", Resource: "podgroups"},
+	"MPIJob.kubeflow.org/v2beta1":            {Group: "kubeflow.org", Version: "v2beta1", Resource: "mpijobs"},
+	"PyTorchJob.kubeflow.org/v1":             {Group: "kubeflow.org", Version: "v1", Resource: "pytorchjobs"},
+}
+
+// podClient reads pods and their owners for the pod lookup. It is nil if the
+// lookup is disabled.
+var podClient dynamic.Interface
+
+// PodOwner is the pod itself or one of its (transitive) owners.
+type PodOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// PodVni is a VNI a pod may use, with the owner it got it through.
+type PodVni struct {
+	Vni            int            `json:"vni"`
+	VniUid         string         `json:"vniUid"`
+	Owner          PodOwner       `json:"owner"`
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	Limits         map[string]int `json:"limits,omitempty"`
+}
+
+// PodVniResponse is served on /api/v1/pods/{namespace}/{name}/vni. Vnis is
+// empty for pods without a VNI.
+type PodVniResponse struct {
+	Namespace string     `json:"namespace"`
+	Pod       string     `json:"pod"`
+	Owners    []PodOwner `json:"owners"`
+	Vnis      []PodVni   `json:"vnis"`
+}
+
+// podOwners returns the pod and its owners, nearest first. Volcano pods also
+// get the owners of their PodGroup. requesting lists the owners requesting a
+// VNI with the vni annotation.
+func podOwners(ctx context.Context, namespace string, name string) (owners []PodOwner, requesting []PodOwner, err error) {
+	pod, err := podClient.Resource(podGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]bool)
+	var walk func(obj *unstructured.Unstructured, depth int) error
+	walk = func(obj *unstructured.Unstructured, depth int) error {
+		if seen[string(obj.GetUID())] || depth > maxOwnerDepth {
+			return nil
+		}
+		seen[string(obj.GetUID())] = true
+		owner := PodOwner{Kind: obj.GetKind(), Name: obj.GetName(), UID: string(obj.GetUID())}
+		owners = append(owners, owner)
+		if annotation := obj.GetAnnotations()["vni"]; annotation != "" {
+			requesting = append(requesting, owner)
+		}
+
+		type ref struct{ key, name string }
+		var refs []ref
+		for _, owner := range obj.GetOwnerReferences() {
+			refs = append(refs, ref{owner.Kind + "." + owner.APIVersion, owner.Name})
+		}
+		if group := obj.GetAnnotations()[podGroupAnnotation]; group != "" && obj.GetKind() == "Pod" {
+			refs = append(refs, ref{"PodGroup.scheduling.volcano.sh/v1beta1", group})
+		}
+		for _, ref := range refs {
+			gvr, ok := ownerResources[ref.key]
+			if !ok {
+				continue
+			}
+			owner, err := podClient.Resource(gvr).Namespace(namespace).Get(ctx, ref.name, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				// being deleted, or a PodGroup that is not there yet
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := walk(owner, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(pod, 0); err != nil {
+		return nil, nil, err
+	}
+	return owners, requesting, nil
+}
+
+// podVnis returns the VNIs owned by one of owners (vni-<uid>) and those of
+// the allocations an owner joined as a user. allocated holds the UIDs of the
+// owners with a VNI, including those sharing one with a nearer owner.
+func podVnis(namespace string, owners []PodOwner) (vnis []PodVni, allocated map[string]bool, err error) {
+	allocs, err := store.ListAllocations(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	vnis = make([]PodVni, 0)
+	allocated = make(map[string]bool)
+	for _, owner := range owners {
+		for _, alloc := range allocs {
+			if alloc.VniUid != fmt.Sprintf("vni-%s", owner.UID) && !slices.Contains(alloc.Users, owner.UID) {
+				continue
+			}
+			allocated[owner.UID] = true
+			if slices.ContainsFunc(vnis, func(vni PodVni) bool { return vni.VniUid == alloc.VniUid }) {
+				continue
+			}
+			profile, err := store.GetProfile(alloc.VniUid, namespace)
+			if err != nil {
+				return nil, nil, err
+			}
+			vnis = append(vnis, PodVni{Vni: alloc.Vni, VniUid: alloc.VniUid, Owner: owner,
+				TrafficClasses: profile.TrafficClasses, Limits: profile.Limits})
+		}
+	}
+	return vnis, allocated, nil
+}
+
+// cPodVni serves the VNIs of a pod to the CNI plugin. It answers 503 while
+// any owner requests a VNI that has not been allocated yet, so that the
+// plugin retries instead of starting the pod without it.
+func cPodVni(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	owners, requesting, err := podOwners(r.Context(), namespace, name)
+	if errors.IsNotFound(err) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reading owners of pod %s/%s: %v\n", namespace, name, err)
+		return
+	}
+
+	vnis, allocated, err := podVnis(namespace, owners)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error looking up VNIs of pod %s/%s: %v\n", namespace, name, err)
+		return
+	}
+	var pending []string
+	for _, owner := range requesting {
+		if !allocated[owner.UID] {
+			pending = append(pending, fmt.Sprintf("%s %s", owner.Kind, owner.Name))
+		}
+	}
+	if len(pending) > 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("no VNI allocated yet for %s", strings.Join(pending, ", "))))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(PodVniResponse{Namespace: namespace, Pod: name, Owners: owners, Vnis: vnis})
+	if err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// newOwnedObject returns an object in namespace vnitest controlled by owners.
+func newOwnedObject(apiVersion string, kind string, name string, annotations map[string]string,
+	owners ...*unstructured.Unstructured) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace("vnitest")
+	obj.SetName(name)
+	obj.SetUID(types.UID(name + "-uid"))
+	obj.SetAnnotations(annotations)
+	controller := true
+	var refs []metav1.OwnerReference
+	for _, owner := range owners {
+		refs = append(refs, metav1.OwnerReference{APIVersion: owner.GetAPIVersion(), Kind: owner.GetKind(),
+			Name: owner.GetName(), UID: owner.GetUID(), Controller: &controller})
+	}
+	obj.SetOwnerReferences(refs)
+	return obj
+}
+
+// setPodClient serves objects to the owner lookups.
+func setPodClient(objects ...runtime.Object) {
+	podClient = fake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+}
+
+func TestPodVni(t *testing.T) {
+	deployment := newOwnedObject("apps/v1", "Deployment", "trainer", map[string]string{"vni": "true"})
+	replicaSet := newOwnedObject("apps/v1", "ReplicaSet", "trainer-5d8f", nil, deployment)
+	pod := newOwnedObject("v1", "Pod", "trainer-5d8f-x2x", nil, replicaSet)
+	job := newOwnedObject("batch/v1", "Job", "eval", map[string]string{"vni": "true"})
+	claimPod := newOwnedObject("v1", "Pod", "eval-abcde", map[string]string{"vni": "my-claim"}, job)
+
+	tests := []struct {
+		name   string
+		pod    string
+		setup  func(t *testing.T)
+		status int
+		vnis   []string
+	}{
+		{name: "no VNI yet", pod: pod.GetName(), status: http.StatusServiceUnavailable},
+		{
+			name: "owner allocated", pod: pod.GetName(),
+			setup:  func(t *testing.T) { acquireTestVni(t, "vni-trainer-uid", "vnitest") },
+			status: http.StatusOK, vnis: []string{"vni-trainer-uid"},
+		},
+		{
+			// the Job has its VNI, the pod's claim is not joined yet
+			name: "one of two pending", pod: claimPod.GetName(),
+			setup: func(t *testing.T) {
+				acquireTestVni(t, "vni-eval-uid", "vnitest")
+				acquireTestVni(t, "my-claim", "vnitest")
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "both allocated", pod: claimPod.GetName(),
+			setup: func(t *testing.T) {
+				acquireTestVni(t, "vni-eval-uid", "vnitest")
+				acquireTestVni(t, "my-claim", "vnitest")
+				if err := store.AddUser("my-claim", "vnitest", "eval-abcde-uid", false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusOK, vnis: []string{"my-claim", "vni-eval-uid"},
+		},
+		{name: "unknown pod", pod: "gone", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestStore(t)
+			setPodClient(deployment, replicaSet, pod, job, claimPod)
+			if test.setup != nil {
+				test.setup(t)
+			}
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/pods/vnitest/"+test.pod+"/vni", nil)
+			request.SetPathValue("namespace", "vnitest")
+			request.SetPathValue("name", test.pod)
+			recorder := httptest.NewRecorder()
+			cPodVni(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if recorder.Code != http.StatusOK {
+				return
+			}
+			var response PodVniResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			var vniUids []string
+			for _, vni := range response.Vnis {
+				vniUids = append(vniUids, vni.VniUid)
+			}
+			if len(vniUids) != len(test.vnis) {
+				t.Fatalf("VNIs %v, want %v", vniUids, test.vnis)
+			}
+			for i := range vniUids {
+				if vniUids[i] != test.vnis[i] {
+					t.Errorf("VNIs %v, want %v", vniUids, test.vnis)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// VniPools split the VNIs the endpoint manages, [vniMin, vniMax), among
+// namespaces. They are declared as cluster-scoped VniPool objects, which a
+// CompositeController passes to the /pool hooks. Without VniPools, every
+// namespace allocates from the whole range.
+
+var vniPoolGVR = schema.GroupVersionResource{Group: "horizon-opencube.eu", Version: "v1", Resource: "vnipools"}
+
+var ErrNoPool = errors.New("no VniPool allows the namespace")
+
+// poolResyncInterval is how often Metacontroller refreshes the usage in the
+// status of a VniPool.
+const poolResyncInterval = 30 * time.Second
+
+// Condition types of a VniPool
+const (
+	PoolReady     = "Ready"
+	PoolExhausted = "Exhausted"
+)
+
+// VniPoolRange holds the VNIs [Min, Max).
+type VniPoolRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+type VniPoolSpec struct {
+	// Ranges are allocated from in order
+	Ranges []VniPoolRange `json:"ranges"`
+	// QuarantineSeconds is the time a released VNI is kept from being
+	// reallocated, 60 if unset
+	QuarantineSeconds *int `json:"quarantineSeconds,omitempty"`
+	// Strategy is StrategyLowestFirst or StrategyLeastRecentlyReleased
+	Strategy string `json:"strategy,omitempty"`
+	// Namespaces may allocate from the pool; all if empty. Pools naming a
+	// namespace are preferred over pools for all namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+type VniPoolStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Size               int                `json:"size"`
+	Allocated          int                `json:"allocated"`
+	External           int                `json:"external"`
+	Available          int                `json:"available"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+type vniPool struct {
+	name    string
+	created time.Time
+	spec    VniPoolSpec
+	// exhausted is set when an allocation found no free VNI, and cleared by
+	// the next one that succeeds
+	exhausted bool
+}
+
+// vniPools holds the valid VniPools by name.
+var vniPools = struct {
+	sync.Mutex
+	byName map[string]*vniPool
+}{byName: make(map[string]*vniPool)}
+
+var (
+	poolSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_size",
+		Help: "VNIs in the ranges of a VniPool.",
+	}, []string{"pool"})
+	poolAllocated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_allocated",
+		Help: "VNIs of a VniPool allocated to jobs, claims or reservations.",
+	}, []string{"pool"})
+	poolAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vni_pool_available",
+		Help: "VNIs of a VniPool neither allocated nor held by Slurm, including quarantined ones.",
+	}, []string{"pool"})
+)
+
+func (spec VniPoolSpec) validate() error {
+	if len(spec.Ranges) == 0 {
+		return errors.New("no ranges")
+	}
+	for i, r := range spec.Ranges {
+		if r.Min >= r.Max {
+			return fmt.Errorf("range %d-%d is empty", r.Min, r.Max)
+		}
+		if r.Min < vniMin || r.Max > vniMax {
+			return fmt.Errorf("range %d-%d is outside the VNIs of the endpoint, %d-%d", r.Min, r.Max, vniMin, vniMax)
+		}
+		for _, other := range spec.Ranges[:i] {
+			if r.Min < other.Max && other.Min < r.Max {
+				return fmt.Errorf("ranges %d-%d and %d-%d overlap", other.Min, other.Max, r.Min, r.Max)
+			}
+		}
+	}
+	if spec.QuarantineSeconds != nil && *spec.QuarantineSeconds < 0 {
+		return errors.New("quarantineSeconds is negative")
+	}
+	switch spec.Strategy {
+	case "", StrategyLowestFirst, StrategyLeastRecentlyReleased:
+	default:
+		return fmt.Errorf("unknown strategy %q", spec.Strategy)
+	}
+	return nil
+}
+
+func (spec VniPoolSpec) quarantine() time.Duration {
+	if spec.QuarantineSeconds == nil {
+		return defaultQuarantine
+	}
+	return time.Duration(*spec.QuarantineSeconds) * time.Second
+}
+
+// policies returns the allocation policy of each range.
+func (spec VniPoolSpec) policies() []AllocationPolicy {
+	strategy := spec.Strategy
+	if strategy == "" {
+		strategy = StrategyLowestFirst
+	}
+	policies := make([]AllocationPolicy, 0, len(spec.Ranges))
+	for _, r := range spec.Ranges {
+		policies = append(policies, AllocationPolicy{Min: r.Min, Max: r.Max, Quarantine: spec.quarantine(), Strategy: strategy})
+	}
+	return policies
+}
+
+func (spec VniPoolSpec) contains(vni int) bool {
+	return slices.ContainsFunc(spec.Ranges, func(r VniPoolRange) bool { return vni >= r.Min && vni < r.Max })
+}
+
+func (spec VniPoolSpec) overlaps(other VniPoolSpec) bool {
+	for _, r := range spec.Ranges {
+		for _, o := range other.Ranges {
+			if r.Min < o.Max && o.Min < r.Max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (spec VniPoolSpec) size() int {
+	size := 0
+	for _, r := range spec.Ranges {
+		size += r.Max - r.Min
+	}
+	return size
+}
+
+// usage counts the VNIs of spec that are allocated and held by external
+// allocators.
+func (spec VniPoolSpec) usage() (allocated int, external int, err error) {
+	allocs, err := store.ListAllocations("")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, alloc := range allocs {
+		if spec.contains(alloc.Vni) {
+			allocated++
+		}
+	}
+	held, err := store.GetExternal()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, vnis := range held {
+		for _, vni := range vnis {
+			if spec.contains(vni) {
+				external++
+			}
+		}
+	}
+	return allocated, external, nil
+}
+
+// before orders pools by creation, so that of two overlapping pools the
+// older one is used.
+func (pool *vniPool) before(other *vniPool) bool {
+	if !pool.created.Equal(other.created) {
+		return pool.created.Before(other.created)
+	}
+	return pool.name < other.name
+}
+
+// setPool adds or updates a valid pool. It fails if the pool overlaps an
+// older one; younger ones it overlaps are dropped until their next sync.
+func setPool(pool *vniPool) error {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	for name, other := range vniPools.byName {
+		if name == pool.name || !pool.spec.overlaps(other.spec) {
+			continue
+		}
+		if other.before(pool) {
+			delete(vniPools.byName, pool.name)
+			return fmt.Errorf("ranges overlap with VniPool %s", name)
+		}
+		log.Printf("VniPool %s overlaps the older VniPool %s, ignoring it\n", name, pool.name)
+		delete(vniPools.byName, name)
+	}
+	if current, ok := vniPools.byName[pool.name]; ok {
+		pool.exhausted = current.exhausted
+	}
+	vniPools.byName[pool.name] = pool
+	return nil
+}
+
+func removePool(name string) {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	delete(vniPools.byName, name)
+}
+
+// longestQuarantine returns the longest quarantine of any pool.
+func longestQuarantine() time.Duration {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	longest := defaultQuarantine
+	for _, pool := range vniPools.byName {
+		longest = max(longest, pool.spec.quarantine())
+	}
+	return longest
+}
+
+// poolsFor returns the pools namespace may allocate from, in order of
+// preference. declared is false if there are no pools at all.
+func poolsFor(namespace string) (pools []*vniPool, declared bool) {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	var named, all []*vniPool
+	for _, pool := range vniPools.byName {
+		switch {
+		case len(pool.spec.Namespaces) == 0:
+			all = append(all, pool)
+		case slices.Contains(pool.spec.Namespaces, namespace):
+			named = append(named, pool)
+		}
+	}
+	byName := func(a, b *vniPool) int { return strings.Compare(a.name, b.name) }
+	slices.SortFunc(named, byName)
+	slices.SortFunc(all, byName)
+	return append(named, all...), len(vniPools.byName) > 0
+}
+
+func setExhausted(pool *vniPool, exhausted bool) {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	pool.exhausted = exhausted
+}
+
+// poolAllows reports whether namespace may hold vni: whether one of its pools
+// contains it, or it is in the whole range if there are no pools.
+func poolAllows(namespace string, vni int) bool {
+	pools, declared := poolsFor(namespace)
+	if !declared {
+		return vni >= vniMin && vni < vniMax
+	}
+	return slices.ContainsFunc(pools, func(pool *vniPool) bool { return pool.spec.contains(vni) })
+}
+
+// acquireVni allocates a VNI for (vniUid, namespace) from the pools the
+// namespace may use, or from the whole range if there are no pools.
+func acquireVni(vniUid string, namespace string) (int, error) {
+	pools, declared := poolsFor(namespace)
+	if !declared {
+		return store.Acquire(vniUid, namespace, defaultPolicy(), shouldLog)
+	}
+	if len(pools) == 0 {
+		return -1, fmt.Errorf("%w %s", ErrNoPool, namespace)
+	}
+	for _, pool := range pools {
+		for _, policy := range pool.spec.policies() {
+			vni, err := store.Acquire(vniUid, namespace, policy, shouldLog)
+			if errors.Is(err, ErrNoFreeVNI) {
+				continue
+			}
+			if err == nil {
+				setExhausted(pool, false)
+			}
+			return vni, err
+		}
+		setExhausted(pool, true)
+	}
+	return -1, ErrNoFreeVNI
+}
+
+// poolStatus returns the status of a pool with its current usage. observed
+// is the status the pool has, whose conditions keep their transition times.
+func poolStatus(pool *vniPool, observed VniPoolStatus, generation int64, invalid error) (VniPoolStatus, error) {
+	status := VniPoolStatus{ObservedGeneration: generation, Size: pool.spec.size(), Conditions: observed.Conditions}
+	if invalid != nil {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolReady, Status: metav1.ConditionFalse,
+			ObservedGeneration: generation, Reason: "Invalid", Message: invalid.Error()})
+	} else {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolReady, Status: metav1.ConditionTrue,
+			ObservedGeneration: generation, Reason: "Valid", Message: "VNIs are allocated from the pool"})
+	}
+
+	var err error
+	status.Allocated, status.External, err = pool.spec.usage()
+	if err != nil {
+		return status, err
+	}
+	status.Available = max(status.Size-status.Allocated-status.External, 0)
+
+	vniPools.Lock()
+	exhausted := pool.exhausted
+	vniPools.Unlock()
+	switch {
+	case status.Available == 0:
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolExhausted, Status: metav1.ConditionTrue,
+			ObservedGeneration: generation, Reason: "AllAllocated", Message: "all VNIs are allocated"})
+	case exhausted:
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolExhausted, Status: metav1.ConditionTrue,
+			ObservedGeneration: generation, Reason: "Quarantined",
+			Message: fmt.Sprintf("the %d VNIs not allocated are quarantined", status.Available)})
+	default:
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolExhausted, Status: metav1.ConditionFalse,
+			ObservedGeneration: generation, Reason: "Available",
+			Message: fmt.Sprintf("%d of %d VNIs available", status.Available, status.Size)})
+	}
+
+	poolSize.WithLabelValues(pool.name).Set(float64(status.Size))
+	poolAllocated.WithLabelValues(pool.name).Set(float64(status.Allocated))
+	poolAvailable.WithLabelValues(pool.name).Set(float64(status.Available))
+	return status, nil
+}
+
+// decodePool decodes the spec of a VniPool strictly.
+func decodePool(parent KubeObject) (*vniPool, error) {
+	pool := &vniPool{name: parent.Metadata.Name, created: parent.Metadata.CreationTimestamp.Time}
+	if len(parent.Spec) == 0 {
+		return pool, errors.New("spec missing")
+	}
+	if err := decodeStrict(parent.Spec, &pool.spec); err != nil {
+		return pool, err
+	}
+	return pool, pool.spec.validate()
+}
+
+func cPoolSync(w http.ResponseWriter, r *http.Request) {
+	poolHook(w, r, false)
+}
+
+func cPoolFinalize(w http.ResponseWriter, r *http.Request) {
+	poolHook(w, r, true)
+}
+
+// poolHook registers the VniPool of a sync, or removes it on finalize, and
+// reports its usage. A deleted pool is finalized once none of its VNIs is
+// allocated anymore.
+func poolHook(w http.ResponseWriter, r *http.Request, finalize bool) {
+	defer r.Body.Close()
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var hookRequest CompositeSyncHookRequest
+	err := decodeHookRequest(body, &hookRequest)
+	if err == nil && (hookRequest.Parent.ApiVersion != vniApiVersion || hookRequest.Parent.Kind != "VniPool") {
+		err = invalidRequest("parent %s.%s is not a VniPool", hookRequest.Parent.Kind, hookRequest.Parent.ApiVersion)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		rejectedRequests.WithLabelValues(r.Pattern, reasonInvalid).Inc()
+		log.Printf("Rejected hook request: %v\n", err)
+		return
+	}
+	parent := hookRequest.Parent
+	var observed VniPoolStatus
+	if len(parent.Status) > 0 {
+		// conditions only, the rest is recomputed
+		json.Unmarshal(parent.Status, &observed)
+	}
+
+	pool, invalid := decodePool(parent)
+	switch {
+	case finalize:
+		removePool(pool.name)
+	case invalid != nil:
+		removePool(pool.name)
+		log.Printf("Ignoring VniPool %s: %v\n", pool.name, invalid)
+	default:
+		invalid = setPool(pool)
+	}
+
+	status, err := poolStatus(pool, observed, parent.Metadata.Generation, invalid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error computing usage of VniPool %s: %v\n", pool.name, err)
+		return
+	}
+	finalized := finalize && status.Allocated == 0
+	if finalize {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{Type: PoolReady, Status: metav1.ConditionFalse,
+			ObservedGeneration: parent.Metadata.Generation, Reason: "Deleting",
+			Message: fmt.Sprintf("waiting for %d VNIs to be released", status.Allocated)})
+	}
+	if finalized {
+		poolSize.DeleteLabelValues(pool.name)
+		poolAllocated.DeleteLabelValues(pool.name)
+		poolAvailable.DeleteLabelValues(pool.name)
+	}
+
+	statusData, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error encoding status: %v\n", err)
+		return
+	}
+	response := CompositeFinalizeHookResponse{
+		CompositeSyncHookResponse: CompositeSyncHookResponse{
+			Status:             statusData,
+			Children:           make([]json.RawMessage, 0),
+			ResyncAfterSeconds: poolResyncInterval.Seconds(),
+		},
+		Finalized: finalized,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if finalize {
+		err = json.NewEncoder(w).Encode(response)
+	} else {
+		err = json.NewEncoder(w).Encode(response.CompositeSyncHookResponse)
+	}
+	if err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
+
+// refreshPools replaces the pools with the VniPools in the cluster, so that
+// a replica knows them before Metacontroller syncs them to it.
+func refreshPools(ctx context.Context, client dynamic.Interface) error {
+	list, err := client.Resource(vniPoolGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var pools []*vniPool
+	for _, item := range list.Items {
+		if item.GetDeletionTimestamp() != nil {
+			continue
+		}
+		data, err := json.Marshal(item.Object["spec"])
+		if err != nil {
+			return err
+		}
+		pool, err := decodePool(KubeObject{Metadata: metav1.ObjectMeta{Name: item.GetName(),
+			CreationTimestamp: item.GetCreationTimestamp()}, Spec: data})
+		if err != nil {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].before(pools[j]) })
+
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	byName := make(map[string]*vniPool)
+	var accepted []*vniPool
+	for _, pool := range pools {
+		if slices.ContainsFunc(accepted, func(other *vniPool) bool { return pool.spec.overlaps(other.spec) }) {
+			continue
+		}
+		accepted = append(accepted, pool)
+		if current, ok := vniPools.byName[pool.name]; ok {
+			pool.exhausted = current.exhausted
+		}
+		byName[pool.name] = pool
+	}
+	vniPools.byName = byName
+	return nil
+}
+
+// StartPoolRefresh runs refreshPools every interval until ctx is done.
+func StartPoolRefresh(ctx context.Context, client dynamic.Interface, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastErr := ""
+	for {
+		err := refreshPools(ctx, client)
+		if err != nil && err.Error() != lastErr {
+			// e.g. the CRD is not installed, logged once
+			log.Printf("Error listing VniPools: %v\n", err)
+		}
+		lastErr = ""
+		if err != nil {
+			lastErr = err.Error()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// newTestPool returns a pool with the ranges min-max, min-max, ... for
+// namespaces, created at minute age after the epoch.
+func newTestPool(name string, age int, namespaces []string, bounds ...int) *vniPool {
+	pool := &vniPool{name: name, created: time.Unix(int64(age)*60, 0),
+		spec: VniPoolSpec{Namespaces: namespaces}}
+	for i := 0; i+1 < len(bounds); i += 2 {
+		pool.spec.Ranges = append(pool.spec.Ranges, VniPoolRange{Min: bounds[i], Max: bounds[i+1]})
+	}
+	return pool
+}
+
+func setTestPools(t *testing.T, pools ...*vniPool) {
+	t.Helper()
+	for _, pool := range pools {
+		if err := setPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func poolNames(pools []*vniPool) []string {
+	var names []string
+	for _, pool := range pools {
+		names = append(names, pool.name)
+	}
+	return names
+}
+
+func TestPoolsFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		pools     []*vniPool
+		namespace string
+		want      []string
+		declared  bool
+	}{
+		{name: "no pools", namespace: "team-a"},
+		{
+			name: "named before global",
+			pools: []*vniPool{
+				newTestPool("all-b", 1, nil, 100, 200),
+				newTestPool("all-a", 2, nil, 200, 300),
+				newTestPool("team-b", 3, []string{"team-a", "team-b"}, 300, 400),
+				newTestPool("team-a", 4, []string{"team-a"}, 400, 500),
+			},
+			namespace: "team-a",
+			want:      []string{"team-a", "team-b", "all-a", "all-b"},
+			declared:  true,
+		},
+		{
+			name: "other namespace",
+			pools: []*vniPool{
+				newTestPool("team-a", 1, []string{"team-a"}, 100, 200),
+				newTestPool("shared", 2, nil, 200, 300),
+			},
+			namespace: "team-c",
+			want:      []string{"shared"},
+			declared:  true,
+		},
+		{
+			name:      "no pool for the namespace",
+			pools:     []*vniPool{newTestPool("team-a", 1, []string{"team-a"}, 100, 200)},
+			namespace: "team-c",
+			declared:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			setTestPools(t, tt.pools...)
+			pools, declared := poolsFor(tt.namespace)
+			if names := poolNames(pools); !slices.Equal(names, tt.want) || declared != tt.declared {
+				t.Errorf("poolsFor = %v, %v, want %v, %v", names, declared, tt.want, tt.declared)
+			}
+		})
+	}
+}
+
+func TestAcquireVniFromPools(t *testing.T) {
+	newTestStore(t)
+	team := newTestPool("team", 1, []string{"vnitest"}, 150, 151, 100, 101)
+	shared := newTestPool("shared", 2, nil, 200, 202)
+	setTestPools(t, team, shared)
+
+	// the ranges of a pool are used in order, then the next pool
+	for i, want := range []int{150, 100, 200} {
+		vni, err := acquireVni(string(rune('a'+i)), "vnitest")
+		if err != nil || vni != want {
+			t.Fatalf("acquisition %d: %d, %v, want %d", i, vni, err, want)
+		}
+	}
+	if !team.exhausted || shared.exhausted {
+		t.Errorf("exhausted: team %v, shared %v, want only team", team.exhausted, shared.exhausted)
+	}
+	if vni, err := acquireVni("d", "vnitest"); err != nil || vni != 201 {
+		t.Fatalf("acquired %d, %v, want 201", vni, err)
+	}
+	if _, err := acquireVni("e", "vnitest"); !errors.Is(err, ErrNoFreeVNI) {
+		t.Fatalf("acquired with all pools exhausted: %v", err)
+	}
+	if !shared.exhausted {
+		t.Error("shared pool not marked exhausted")
+	}
+
+	// an update keeps the flag, and a successful allocation clears it
+	grown := newTestPool("team", 1, []string{"vnitest"}, 150, 151, 100, 102)
+	setTestPools(t, grown)
+	if !grown.exhausted {
+		t.Error("update cleared the exhausted flag")
+	}
+	if vni, err := acquireVni("f", "vnitest"); err != nil || vni != 101 {
+		t.Fatalf("acquired %d, %v, want 101", vni, err)
+	}
+	if grown.exhausted {
+		t.Error("team pool still marked exhausted")
+	}
+
+	if _, err := acquireVni("g", "team-c"); !errors.Is(err, ErrNoFreeVNI) {
+		t.Errorf("team-c may use the shared pool only: %v", err)
+	}
+	removePool("shared")
+	if _, err := acquireVni("g", "team-c"); !errors.Is(err, ErrNoPool) {
+		t.Errorf("team-c without a pool: %v, want %v", err, ErrNoPool)
+	}
+}
+
+func TestVniPoolSpecValidate(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		name    string
+		spec    VniPoolSpec
+		wantErr string
+	}{
+		{name: "valid", spec: VniPoolSpec{Ranges: []VniPoolRange{{100, 200}, {300, 400}}, Strategy: StrategyLowestFirst}},
+		{name: "no ranges", wantErr: "no ranges"},
+		{name: "empty range", spec: VniPoolSpec{Ranges: []VniPoolRange{{200, 200}}}, wantErr: "range 200-200 is empty"},
+		{name: "below the range", spec: VniPoolSpec{Ranges: []VniPoolRange{{50, 200}}}, wantErr: "outside the VNIs"},
+		{name: "above the range", spec: VniPoolSpec{Ranges: []VniPoolRange{{65000, 65536}}}, wantErr: "outside the VNIs"},
+		{
+			name:    "overlapping ranges",
+			spec:    VniPoolSpec{Ranges: []VniPoolRange{{100, 200}, {300, 400}, {150, 160}}},
+			wantErr: "ranges 100-200 and 150-160 overlap",
+		},
+		{
+			name:    "negative quarantine",
+			spec:    VniPoolSpec{Ranges: []VniPoolRange{{100, 200}}, QuarantineSeconds: &negative},
+			wantErr: "quarantineSeconds is negative",
+		},
+		{name: "unknown strategy", spec: VniPoolSpec{Ranges: []VniPoolRange{{100, 200}}, Strategy: "random"}, wantErr: "unknown strategy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetPoolOverlap(t *testing.T) {
+	tests := []struct {
+		name    string
+		pools   []*vniPool
+		wantErr string
+		want    []string
+	}{
+		{
+			name:  "adjacent",
+			pools: []*vniPool{newTestPool("a", 1, nil, 100, 200), newTestPool("b", 2, nil, 200, 300)},
+			want:  []string{"a", "b"},
+		},
+		{
+			name:    "younger overlapping",
+			pools:   []*vniPool{newTestPool("a", 1, nil, 100, 200), newTestPool("b", 2, nil, 300, 400, 199, 250)},
+			wantErr: "ranges overlap with VniPool a",
+			want:    []string{"a"},
+		},
+		{
+			// the younger pool was synced first and gives way
+			name:  "older overlapping",
+			pools: []*vniPool{newTestPool("b", 2, nil, 150, 250), newTestPool("a", 1, nil, 100, 200)},
+			want:  []string{"a"},
+		},
+		{
+			name:  "update of the same pool",
+			pools: []*vniPool{newTestPool("a", 1, nil, 100, 200), newTestPool("a", 1, nil, 100, 300)},
+			want:  []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestStore(t)
+			var err error
+			for _, pool := range tt.pools {
+				if err = setPool(pool); err != nil {
+					break
+				}
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			pools, _ := poolsFor("vnitest")
+			if names := poolNames(pools); !slices.Equal(names, tt.want) {
+				t.Errorf("pools = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolStatus(t *testing.T) {
+	s := newTestStore(t)
+	pool := newTestPool("team", 1, nil, 100, 104)
+	setTestPools(t, pool)
+	acquireTestVni(t, "a", "vnitest")
+	if err := s.SetExternal(slurmOwner, []int{103, 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	condition := func(status VniPoolStatus, conditionType string) metav1.Condition {
+		t.Helper()
+		c := meta.FindStatusCondition(status.Conditions, conditionType)
+		if c == nil {
+			t.Fatalf("no %s condition in %+v", conditionType, status.Conditions)
+		}
+		return *c
+	}
+
+	status, err := poolStatus(pool, VniPoolStatus{}, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ObservedGeneration != 3 || status.Size != 4 || status.Allocated != 1 || status.External != 1 ||
+		status.Available != 2 {
+		t.Errorf("status = %+v", status)
+	}
+	if c := condition(status, PoolReady); c.Status != metav1.ConditionTrue || c.Reason != "Valid" {
+		t.Errorf("Ready = %+v", c)
+	}
+	if c := condition(status, PoolExhausted); c.Status != metav1.ConditionFalse || c.Reason != "Available" {
+		t.Errorf("Exhausted = %+v", c)
+	}
+
+	// quarantined VNIs are counted as available, but exhaust the pool
+	setExhausted(pool, true)
+	previous := condition(status, PoolReady).LastTransitionTime
+	status, err = poolStatus(pool, status, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(status, PoolExhausted); c.Status != metav1.ConditionTrue || c.Reason != "Quarantined" {
+		t.Errorf("Exhausted = %+v", c)
+	}
+	if c := condition(status, PoolReady); !c.LastTransitionTime.Equal(&previous) {
+		t.Errorf("Ready transitioned at %v, want %v", c.LastTransitionTime, previous)
+	}
+
+	acquireTestVni(t, "b", "vnitest")
+	acquireTestVni(t, "c", "vnitest")
+	status, err = poolStatus(pool, status, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(status, PoolExhausted); status.Available != 0 || c.Status != metav1.ConditionTrue ||
+		c.Reason != "AllAllocated" {
+		t.Errorf("available %d, Exhausted = %+v", status.Available, c)
+	}
+
+	status, err = poolStatus(pool, status, 4, errors.New("ranges overlap with VniPool other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(status, PoolReady); c.Status != metav1.ConditionFalse || c.Reason != "Invalid" ||
+		c.ObservedGeneration != 4 {
+		t.Errorf("Ready = %+v", c)
+	}
+}
+
+// newPoolObject returns a VniPool object created at minute age after the epoch.
+func newPoolObject(name string, age int, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(vniApiVersion)
+	obj.SetKind("VniPool")
+	obj.SetName(name)
+	obj.SetCreationTimestamp(metav1.NewTime(time.Unix(int64(age)*60, 0)))
+	return obj
+}
+
+func poolRanges(bounds ...int64) map[string]interface{} {
+	var ranges []interface{}
+	for i := 0; i+1 < len(bounds); i += 2 {
+		ranges = append(ranges, map[string]interface{}{"min": bounds[i], "max": bounds[i+1]})
+	}
+	return map[string]interface{}{"ranges": ranges}
+}
+
+func TestRefreshPools(t *testing.T) {
+	newTestStore(t)
+	// known before the refresh, keeps its exhausted flag
+	known := newTestPool("old", 1, nil, 100, 200)
+	known.exhausted = true
+	setTestPools(t, known, newTestPool("gone", 2, nil, 600, 700))
+
+	deleting := newPoolObject("deleting", 5, poolRanges(400, 500))
+	now := metav1.Now()
+	deleting.SetDeletionTimestamp(&now)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{vniPoolGVR: "VniPoolList"},
+		newPoolObject("old", 1, poolRanges(100, 200)),
+		newPoolObject("young", 3, poolRanges(150, 250)),
+		newPoolObject("other", 4, poolRanges(300, 400)),
+		newPoolObject("invalid", 2, poolRanges(50, 60)),
+		deleting,
+	)
+	if err := refreshPools(context.TODO(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	pools, _ := poolsFor("vnitest")
+	if names := poolNames(pools); !slices.Equal(names, []string{"old", "other"}) {
+		t.Errorf("pools = %v, want old and other", names)
+	}
+	if !pools[0].exhausted || pools[1].exhausted {
+		t.Errorf("exhausted: old %v, other %v", pools[0].exhausted, pools[1].exhausted)
+	}
+
+	// VNIs of a removed pool are not allowed anymore, but those of the
+	// remaining pools are
+	if poolAllows("vnitest", 650) || !poolAllows("vnitest", 350) {
+		t.Errorf("poolAllows: 650 %v, 350 %v", poolAllows("vnitest", 650), poolAllows("vnitest", 350))
+	}
+	removePool("old")
+	if poolAllows("vnitest", 150) {
+		t.Error("VNI of the removed pool old allowed")
+	}
+	removePool("other")
+	if !poolAllows("vnitest", 150) || poolAllows("vnitest", vniMax) {
+		t.Error("without pools, the whole range should be allowed")
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// maxAcquireAttempts bounds the retries of Acquire when a concurrent
+// transaction wins the race for the same VNI.
+const maxAcquireAttempts = 5
+
+const pgUniqueViolation = "23505"
+
+// maxPostgresConns bounds the connections per replica; /readyz fails while
+// all of them are in use.
+const maxPostgresConns = 10
+
+var pgMigrations = []migration{
+	{1, "initial schema", pgMigrateV1},
+	{2, "CXI profiles of allocations", pgMigrateV2},
+	{3, "VNIs held by external allocators", pgMigrateV3},
+}
+
+// pgMigrateV1 mirrors the SQLite v1 schema. Unlike the SQLite store, the
+// unique constraint on vni_allocs(vni) is what keeps concurrent writers on
+// several replicas from handing out the same VNI.
+func pgMigrateV1(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	create table if not exists
+	vni_allocs (
+		vniUid text not null,
+		namespace text not null,
+		vni integer not null unique,
+		primary key (vniUid, namespace)
+	);
+
+	create table if not exists
+	vni_allocs_log (
+		vniUid text not null,
+		namespace text not null,
+		vni integer not null,
+		operation text not null,
+		ts timestamptz not null
+	);
+
+	create table if not exists
+	vni_users (
+		vniUid text not null,
+		namespace text not null,
+		userId text not null,
+		primary key (vniUid, namespace, userId)
+	);
+
+	create table if not exists
+	vni_users_log (
+		vniUid text not null,
+		namespace text not null,
+		userId text not null,
+		operation text not null,
+		ts timestamptz not null
+	);
+
+	create table if not exists
+	available_vnis (
+		vni integer not null primary key,
+		lastReleased timestamptz
+	);`)
+	return err
+}
+
+func pgMigrateV2(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	create table if not exists
+	vni_profiles (
+		vniUid text not null,
+		namespace text not null,
+		profile jsonb not null,
+		primary key (vniUid, namespace),
+		foreign key (vniUid, namespace) references vni_allocs (vniUid, namespace) on delete cascade
+	);`)
+	return err
+}
+
+func pgMigrateV3(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `alter table available_vnis add column if not exists external text;`)
+	return err
+}
+
+// PostgresStore keeps the allocation database in PostgreSQL, so that several
+// endpoint replicas can share it.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	if dsn == "" {
+		return nil, errors.New("no PostgreSQL DSN given")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxPostgresConns)
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Init() error {
+	ctx := context.TODO()
+	_, err := s.db.ExecContext(ctx, `
+	create table if not exists
+	schema_version (
+		version integer not null primary key,
+		description text not null,
+		ts timestamptz not null
+	);`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_version;`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	latest := pgMigrations[len(pgMigrations)-1].version
+	if current > latest {
+		return fmt.Errorf("%w: found %d, expected at most %d", ErrSchemaTooNew, current, latest)
+	}
+
+	for _, m := range pgMigrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// serialize concurrently starting replicas
+		if _, err := tx.ExecContext(ctx, `lock table schema_version in exclusive mode;`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		var applied bool
+		err = tx.QueryRowContext(ctx, `select exists(select 1 from schema_version where version = $1);`,
+			m.version).Scan(&applied)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if applied {
+			tx.Rollback()
+			continue
+		}
+		if err := m.up(ctx, tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		_, err = tx.ExecContext(ctx, `insert into schema_version(version, description, ts) values ($1, $2, $3);`,
+			m.version, m.description, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied PostgreSQL schema migration %d: %s\n", m.version, m.description)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	insert into available_vnis (vni, lastReleased)
+		select generate_series($1::integer, $2::integer - 1), null
+	on conflict do nothing;`, vniMin, vniMax)
+	return err
+}
+
+func (s *PostgresStore) GetVni(vniUid string, namespace string) (int, error) {
+	vni := -1
+	err := s.db.QueryRowContext(context.TODO(), `
+	select vni
+	from vni_allocs
+	where vniUid = $1 and namespace = $2;`,
+		vniUid, namespace).Scan(&vni)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, nil
+	}
+	return vni, err
+}
+
+func (s *PostgresStore) Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	for attempt := 0; attempt < maxAcquireAttempts; attempt++ {
+		vni, err := s.tryAcquire(vniUid, namespace, policy, doLog)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			// another replica took the same VNI or allocated for the same
+			// (vniUid, namespace) concurrently - try again
+			continue
+		}
+		return vni, err
+	}
+	return -1, errors.New("too many concurrent allocations, giving up")
+}
+
+// tryAcquire picks a free VNI by the policy's strategy, skipping rows locked
+// by concurrent allocations instead of waiting for them.
+func (s *PostgresStore) tryAcquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	ctx := context.TODO()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	vni := -1
+	err = tx.QueryRowContext(ctx, `
+	select vni
+	from vni_allocs
+	where vniUid = $1 and namespace = $2;`, vniUid, namespace).Scan(&vni)
+	if err == nil {
+		return vni, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return -1, err
+	}
+
+	order := "a.vni"
+	if policy.Strategy == StrategyLeastRecentlyReleased {
+		order = "coalesce(a.lastReleased, 'epoch'::timestamptz), a.vni"
+	}
+	err = tx.QueryRowContext(ctx, `
+	select a.vni
+	from available_vnis a
+	where a.vni >= $1 and a.vni < $2
+		and coalesce(a.lastReleased, 'epoch'::timestamptz) < now() - $3 * interval '1 second'
+		and a.external is null
+		and not exists (select 1 from vni_allocs va where va.vni = a.vni)
+	order by `+order+`
+	limit 1
+	for update skip locked;`, policy.Min, policy.Max, policy.Quarantine.Seconds()).Scan(&vni)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, ErrNoFreeVNI
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into vni_allocs (vniUid, namespace, vni) values ($1, $2, $3);`,
+		vniUid, namespace, vni)
+	if err != nil {
+		return -1, err
+	}
+
+	if doLog {
+		_, err = tx.ExecContext(ctx, `insert into vni_allocs_log(vniUid, namespace, vni, operation, ts)
+									   values ($1, $2, $3, 'acquire', $4);`,
+			vniUid, namespace, vni, time.Now())
+		if err != nil {
+			return -1, err
+		}
+	}
+	return vni, tx.Commit()
+}
+
+func (s *PostgresStore) ReleaseUserCheck(vniUid string, namespace string, doLog bool) error {
+	ctx := context.TODO()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	vni := -1
+	err = tx.QueryRowContext(ctx, `
+	select vni
+	from vni_allocs
+	where vniUid = $1 and namespace = $2
+	for update;`, vniUid, namespace).Scan(&vni)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrVNINotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var inUse bool
+	err = tx.QueryRowContext(ctx, `
+	select exists(
+		select 1
+		from vni_users
+		where vniUid = $1 and namespace = $2
+	);`, vniUid, namespace).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrVNIInUse
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from vni_allocs where vniUid = $1 and namespace = $2;`, vniUid, namespace)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update available_vnis set lastReleased = now() where vni = $1;`, vni)
+	if err != nil {
+		return err
+	}
+
+	if doLog {
+		_, err = tx.ExecContext(ctx, `insert into vni_allocs_log(vniUid, namespace, vni, operation, ts)
+									   values ($1, $2, $3, 'release', $4);`,
+			vniUid, namespace, vni, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) AddUser(vniUid string, namespace string, userId string, doLog bool) error {
+	ctx := context.TODO()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the key share lock keeps the allocation from being released until the
+	// user is recorded
+	var found int
+	err = tx.QueryRowContext(ctx, `
+	select 1
+	from vni_allocs
+	where vniUid = $1 and namespace = $2
+	for key share;`, vniUid, namespace).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrVNINotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	insert into vni_users (vniUid, namespace, userId)
+	values ($1, $2, $3)
+	on conflict do nothing;`, vniUid, namespace, userId)
+	if err != nil {
+		return err
+	}
+	added, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if doLog && added > 0 {
+		_, err = tx.ExecContext(ctx, `insert into vni_users_log(vniUid, namespace, userId, operation, ts)
+									   values ($1, $2, $3, 'add', $4);`,
+			vniUid, namespace, userId, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RemoveUser(vniUid string, namespace string, userId string, doLog bool) error {
+	ctx := context.TODO()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	delete from vni_users
+	where vniUid = $1 and namespace = $2 and userId = $3;`, vniUid, namespace, userId)
+	if err != nil {
+		return err
+	}
+
+	if doLog {
+		_, err = tx.ExecContext(ctx, `insert into vni_users_log(vniUid, namespace, userId, operation, ts)
+									   values ($1, $2, $3, 'remove', $4);`,
+			vniUid, namespace, userId, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) ListAllocations(namespace string) ([]Allocation, error) {
+	return listAllocations(s.db, `
+	select vniUid, namespace, vni
+	from vni_allocs
+	where $1 = '' or namespace = $2
+	order by namespace, vniUid;`, `
+	select vniUid, namespace, userId
+	from vni_users
+	where $1 = '' or namespace = $2
+	order by userId;`, namespace)
+}
+
+func (s *PostgresStore) SetProfile(vniUid string, namespace string, profile CxiProfile) error {
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(context.TODO(), `
+	insert into vni_profiles (vniUid, namespace, profile)
+	select vniUid, namespace, $3
+	from vni_allocs
+	where vniUid = $1 and namespace = $2
+	on conflict (vniUid, namespace) do update set profile = excluded.profile;`,
+		vniUid, namespace, string(encoded))
+	if err != nil {
+		return err
+	}
+	set, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return ErrVNINotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetProfile(vniUid string, namespace string) (CxiProfile, error) {
+	var profile CxiProfile
+	var encoded string
+	err := s.db.QueryRowContext(context.TODO(), `
+	select profile
+	from vni_profiles
+	where vniUid = $1 and namespace = $2;`, vniUid, namespace).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile, nil
+	}
+	if err != nil {
+		return profile, err
+	}
+	err = json.Unmarshal([]byte(encoded), &profile)
+	return profile, err
+}
+
+func (s *PostgresStore) SetExternal(owner string, vnis []int) error {
+	if vnis == nil {
+		vnis = []int{}
+	}
+	encoded, err := json.Marshal(vnis)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	update available_vnis
+	set external = null, lastReleased = now()
+	where external = $1
+		and vni not in (select jsonb_array_elements_text($2::jsonb)::integer);`, owner, string(encoded))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	update available_vnis
+	set external = $1
+	where vni in (select jsonb_array_elements_text($2::jsonb)::integer)
+		and external is null;`, owner, string(encoded))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetExternal() (map[string][]int, error) {
+	rows, err := s.db.QueryContext(context.TODO(), `
+	select external, vni
+	from available_vnis
+	where external is not null
+	order by vni;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	external := make(map[string][]int)
+	for rows.Next() {
+		var owner string
+		var vni int
+		if err := rows.Scan(&owner, &vni); err != nil {
+			return nil, err
+		}
+		external[owner] = append(external[owner], vni)
+	}
+	return external, rows.Close()
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
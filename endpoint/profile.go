@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"sigs.k8s.io/yaml"
+)
+
+// Annotations requesting a CXI profile on parents with vni: true. VniClaims
+// use the spec fields trafficClasses and limits instead.
+const (
+	trafficClassesAnnotation = "vni.horizon-opencube.eu/traffic-classes"
+	limitsAnnotation         = "vni.horizon-opencube.eu/limits"
+)
+
+// The Slingshot traffic classes, as in Slurm's hpe_slingshot plugin
+var cxiTrafficClasses = []string{"DEDICATED_ACCESS", "LOW_LATENCY", "BULK_DATA", "BEST_EFFORT"}
+
+// The CXI resources that can be capped per allocation: transmit and target
+// command queues, event queues, counters, trigger list entries, portal table
+// entries, list entries and address contexts.
+var cxiResources = []string{"txqs", "tgqs", "eqs", "cts", "tles", "ptes", "les", "acs"}
+
+// CxiProfile holds the traffic classes and resource limits of an allocation.
+// The node agents and the CNI plugin enforce it; an empty profile leaves them
+// at their defaults.
+type CxiProfile struct {
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	Limits         map[string]int `json:"limits,omitempty"`
+}
+
+func (p CxiProfile) IsEmpty() bool {
+	return len(p.TrafficClasses) == 0 && len(p.Limits) == 0
+}
+
+// CxiPolicy restricts the profiles a namespace may request. Limits missing
+// from MaxLimits are not capped; an empty TrafficClasses allows all.
+type CxiPolicy struct {
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	MaxLimits      map[string]int `json:"maxLimits,omitempty"`
+}
+
+// CxiPolicies is the content of the --cxi-policy-file. Namespaces without an
+// entry get Default.
+type CxiPolicies struct {
+	Default    CxiPolicy            `json:"default"`
+	Namespaces map[string]CxiPolicy `json:"namespaces,omitempty"`
+}
+
+var cxiPolicies CxiPolicies
+
+func LoadCxiPolicies(path string) (CxiPolicies, error) {
+	var policies CxiPolicies
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policies, err
+	}
+	if err := yaml.UnmarshalStrict(data, &policies); err != nil {
+		return policies, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// store the policies normalized, so that checkPolicy compares them with
+	// normalized profiles
+	normalize := func(name string, policy CxiPolicy) (CxiPolicy, error) {
+		normalized, err := normalizeProfile(CxiProfile{TrafficClasses: policy.TrafficClasses, Limits: policy.MaxLimits})
+		if err != nil {
+			return policy, fmt.Errorf("policy %s: %w", name, err)
+		}
+		return CxiPolicy{TrafficClasses: normalized.TrafficClasses, MaxLimits: normalized.Limits}, nil
+	}
+	if policies.Default, err = normalize("default", policies.Default); err != nil {
+		return policies, err
+	}
+	for namespace, policy := range policies.Namespaces {
+		if policies.Namespaces[namespace], err = normalize(namespace, policy); err != nil {
+			return policies, err
+		}
+	}
+	return policies, nil
+}
+
+func (p CxiPolicies) forNamespace(namespace string) CxiPolicy {
+	if policy, ok := p.Namespaces[namespace]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// normalizeProfile upper-cases and sorts the traffic classes and checks that
+// all classes and resources are known.
+func normalizeProfile(profile CxiProfile) (CxiProfile, error) {
+	var normalized CxiProfile
+	for _, tc := range profile.TrafficClasses {
+		tc = strings.ToUpper(strings.TrimSpace(tc))
+		if !slices.Contains(cxiTrafficClasses, tc) {
+			return normalized, fmt.Errorf("unknown traffic class %q, expected one of %v", tc, cxiTrafficClasses)
+		}
+		if !slices.Contains(normalized.TrafficClasses, tc) {
+			normalized.TrafficClasses = append(normalized.TrafficClasses, tc)
+		}
+	}
+	sort.Strings(normalized.TrafficClasses)
+	for resource, limit := range profile.Limits {
+		if !slices.Contains(cxiResources, resource) {
+			return normalized, fmt.Errorf("unknown CXI resource %q, expected one of %v", resource, cxiResources)
+		}
+		if limit < 0 {
+			return normalized, fmt.Errorf("negative limit for %s", resource)
+		}
+		if normalized.Limits == nil {
+			normalized.Limits = make(map[string]int)
+		}
+		normalized.Limits[resource] = limit
+	}
+	return normalized, nil
+}
+
+// checkPolicy returns an error if profile exceeds what policy allows.
+func checkPolicy(profile CxiProfile, policy CxiPolicy) error {
+	for _, tc := range profile.TrafficClasses {
+		if len(policy.TrafficClasses) > 0 && !slices.Contains(policy.TrafficClasses, tc) {
+			return fmt.Errorf("traffic class %s is not allowed, allowed are %v", tc, policy.TrafficClasses)
+		}
+	}
+	for resource, limit := range profile.Limits {
+		if max, ok := policy.MaxLimits[resource]; ok && limit > max {
+			return fmt.Errorf("limit %s=%d exceeds the maximum of %d", resource, limit, max)
+		}
+	}
+	return nil
+}
+
+// parseLimits parses the limits annotation, e.g. "txqs=64,cts=32".
+func parseLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range splitList(value) {
+		resource, number, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid limit %q, expected resource=number", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q: %w", item, err)
+		}
+		limits[strings.TrimSpace(resource)] = limit
+	}
+	return limits, nil
+}
+
+// requestedProfile reads the profile requested by the parent of a hook
+// request and checks it against the policy of its namespace.
+func requestedProfile(object gjson.Result) (CxiProfile, error) {
+	var profile CxiProfile
+	if object.Get("apiVersion").String() == vniApiVersion && object.Get("kind").String() == "VniClaim" {
+		for _, tc := range object.Get("spec.trafficClasses").Array() {
+			profile.TrafficClasses = append(profile.TrafficClasses, tc.String())
+		}
+		limits := object.Get("spec.limits").Map()
+		if len(limits) > 0 {
+			profile.Limits = make(map[string]int)
+			for resource, limit := range limits {
+				profile.Limits[resource] = int(limit.Int())
+			}
+		}
+	} else {
+		annotations := object.Get("metadata.annotations").Map()
+		profile.TrafficClasses = splitList(annotations[trafficClassesAnnotation].String())
+		if value := annotations[limitsAnnotation].String(); value != "" {
+			limits, err := parseLimits(value)
+			if err != nil {
+				return profile, err
+			}
+			profile.Limits = limits
+		}
+	}
+
+	profile, err := normalizeProfile(profile)
+	if err != nil {
+		return profile, err
+	}
+	namespace := object.Get("metadata.namespace").String()
+	if err := checkPolicy(profile, cxiPolicies.forNamespace(namespace)); err != nil {
+		return profile, fmt.Errorf("namespace %s: %w", namespace, err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadCxiPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    CxiPolicies
+		wantErr string
+	}{
+		{
+			name: "normalized",
+			file: `
+default:
+  trafficClasses: [best_effort, " Bulk_Data ", BEST_EFFORT]
+  maxLimits: {txqs: 64}
+namespaces:
+  hpc:
+    trafficClasses: [low_latency]
+`,
+			want: CxiPolicies{
+				Default: CxiPolicy{TrafficClasses: []string{"BEST_EFFORT", "BULK_DATA"}, MaxLimits: map[string]int{"txqs": 64}},
+				Namespaces: map[string]CxiPolicy{
+					"hpc": {TrafficClasses: []string{"LOW_LATENCY"}},
+				},
+			},
+		},
+		{
+			name:    "unknown traffic class",
+			file:    "namespaces:\n  hpc:\n    trafficClasses: [fastest]\n",
+			wantErr: `policy hpc: unknown traffic class "FASTEST"`,
+		},
+		{
+			name:    "unknown resource",
+			file:    "default:\n  maxLimits: {queues: 4}\n",
+			wantErr: `policy default: unknown CXI resource "queues"`,
+		},
+		{
+			name:    "negative limit",
+			file:    "default:\n  maxLimits: {cts: -1}\n",
+			wantErr: "policy default: negative limit for cts",
+		},
+		{
+			name:    "unknown field",
+			file:    "default:\n  classes: [BEST_EFFORT]\n",
+			wantErr: "parsing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			policies, err := LoadCxiPolicies(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policies, tt.want) {
+				t.Errorf("policies = %+v, want %+v", policies, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "default:\n  trafficClasses: [best_effort, bulk_data]\n  maxLimits: {txqs: 64, cts: 32}\n"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := LoadCxiPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile CxiProfile
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "lower case class", profile: CxiProfile{TrafficClasses: []string{"bulk_data"}}},
+		{name: "at the limit", profile: CxiProfile{Limits: map[string]int{"txqs": 64, "cts": 32}}},
+		{name: "uncapped resource", profile: CxiProfile{Limits: map[string]int{"eqs": 1 << 20}}},
+		{
+			name:    "class not allowed",
+			profile: CxiProfile{TrafficClasses: []string{"Low_Latency"}},
+			wantErr: "traffic class LOW_LATENCY is not allowed",
+		},
+		{
+			name:    "unknown class",
+			profile: CxiProfile{TrafficClasses: []string{"fastest"}},
+			wantErr: `unknown traffic class "FASTEST"`,
+		},
+		{
+			name:    "limit exceeded",
+			profile: CxiProfile{Limits: map[string]int{"txqs": 65}},
+			wantErr: "limit txqs=65 exceeds the maximum of 64",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := normalizeProfile(tt.profile)
+			if err == nil {
+				err = checkPolicy(profile, policies.forNamespace("vnitest"))
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := parseLimits("txqs=64, cts = 32")
+	if err != nil || !reflect.DeepEqual(limits, map[string]int{"txqs": 64, "cts": 32}) {
+		t.Errorf("parseLimits = %v, %v", limits, err)
+	}
+	for _, value := range []string{"txqs", "txqs=many", "txqs=99999999999999999999"} {
+		if _, err := parseLimits(value); err == nil {
+			t.Errorf("parseLimits(%q) succeeded", value)
+		}
+	}
+}
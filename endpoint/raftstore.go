@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const raftApplyTimeout = 5 * time.Second
+
+// raftCommand is one mutation of the allocation database. The leader stamps
+// Time before appending it to the log, so every replica applies it with the
+// same notion of "now".
+type raftCommand struct {
+	Op        string `json:"op"`
+	VniUid    string `json:"vniUid"`
+	Namespace string `json:"namespace"`
+	UserId    string `json:"userId,omitempty"`
+	// VniMin and VniMax are the range of acquire commands logged before
+	// Policy
+	VniMin  int               `json:"vniMin,omitempty"`
+	VniMax  int               `json:"vniMax,omitempty"`
+	Policy  *AllocationPolicy `json:"policy,omitempty"`
+	Profile *CxiProfile       `json:"profile,omitempty"`
+	Owner   string            `json:"owner,omitempty"`
+	// Vnis must not be omitted when empty: setExternal with no VNIs gives
+	// them all up
+	Vnis  []int     `json:"vnis"`
+	DoLog bool      `json:"doLog"`
+	Time  time.Time `json:"time"`
+}
+
+type raftResult struct {
+	Vni int
+	Err error
+}
+
+// raftApplyResponse is the answer of the leader to a forwarded command.
+type raftApplyResponse struct {
+	Vni   int    `json:"vni"`
+	Error string `json:"error,omitempty"`
+	Index uint64 `json:"index"`
+}
+
+// errors returned by the leader are matched by message to restore the
+// sentinels callers check with errors.Is
+var raftSentinelErrors = []error{ErrVNINotFound, ErrNoFreeVNI, ErrVNIInUse}
+
+func raftError(message string) error {
+	if message == "" {
+		return nil
+	}
+	for _, sentinel := range raftSentinelErrors {
+		if message == sentinel.Error() {
+			return sentinel
+		}
+	}
+	return errors.New(message)
+}
+
+// RaftConfig configures a RaftStore. ID must be the HTTP base URL of the
+// endpoint, since followers forward writes to the leader by its ID.
+type RaftConfig struct {
+	ID            string
+	Peers         []raft.Server
+	Transport     raft.Transport
+	LogStore      raft.LogStore
+	StableStore   raft.StableStore
+	SnapshotStore raft.SnapshotStore
+}
+
+// RaftTLS holds the files securing the Raft transport. Without CertFile,
+// Raft traffic is plain TCP and must be restricted by the network.
+type RaftTLS struct {
+	CertFile   string
+	KeyFile    string
+	PeerCAFile string
+}
+
+// NewRaftConfig builds a RaftConfig with a TCP transport, over TLS if
+// configured, and the Raft log and snapshots kept in dir. peers is a
+// comma-separated list of id=address.
+func NewRaftConfig(id string, dir string, bind string, advertise string, peers string, tlsFiles RaftTLS) (RaftConfig, error) {
+	config := RaftConfig{ID: id}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return config, err
+	}
+
+	for _, peer := range strings.Split(peers, ",") {
+		if peer == "" {
+			continue
+		}
+		peerId, address, ok := strings.Cut(peer, "=")
+		if !ok {
+			return config, fmt.Errorf("invalid Raft peer %q, expected id=address", peer)
+		}
+		config.Peers = append(config.Peers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(peerId),
+			Address:  raft.ServerAddress(address),
+		})
+	}
+
+	advertiseAddr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return config, err
+	}
+	if tlsFiles.CertFile != "" {
+		stream, err := newRaftStreamLayer(bind, advertiseAddr, tlsFiles.CertFile, tlsFiles.KeyFile, tlsFiles.PeerCAFile)
+		if err != nil {
+			return config, err
+		}
+		config.Transport = raft.NewNetworkTransport(stream, 3, 10*time.Second, os.Stderr)
+	} else {
+		log.Printf("Raft traffic on %s is neither encrypted nor authenticated, restrict it to the replicas\n", bind)
+		config.Transport, err = raft.NewTCPTransport(bind, advertiseAddr, 3, 10*time.Second, os.Stderr)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return config, err
+	}
+	config.LogStore = boltStore
+	config.StableStore = boltStore
+
+	config.SnapshotStore, err = raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	return config, err
+}
+
+// RaftStore replicates the SQLite store over Raft. Every mutation is a
+// command in the Raft log that each replica applies to its local SQLite copy.
+// Reads are served from the local copy; writes on a follower are forwarded
+// to the leader over HTTP, and the follower waits until it has applied the
+// write itself before returning.
+type RaftStore struct {
+	filePath *string
+	config   RaftConfig
+	raft     *raft.Raft
+	client   *http.Client
+
+	// mu guards db against being swapped by a snapshot restore
+	mu sync.RWMutex
+	db *sql.DB
+}
+
+func NewRaftStore(filePath *string, config RaftConfig) *RaftStore {
+	return &RaftStore{
+		filePath: filePath,
+		config:   config,
+		client:   &http.Client{Timeout: raftApplyTimeout, Transport: peerTransport},
+	}
+}
+
+// Init recreates the local copy from scratch: its state is entirely derived
+// from the latest snapshot and the Raft log, which are replayed on startup.
+func (s *RaftStore) Init() error {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(*s.filePath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	db, err := open(s.filePath)
+	if err != nil {
+		return err
+	}
+	if err := Init(db); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(s.config.ID)
+	hasState, err := raft.HasExistingState(s.config.LogStore, s.config.StableStore, s.config.SnapshotStore)
+	if err != nil {
+		return err
+	}
+	s.raft, err = raft.NewRaft(raftConfig, (*raftFSM)(s), s.config.LogStore, s.config.StableStore,
+		s.config.SnapshotStore, s.config.Transport)
+	if err != nil {
+		return err
+	}
+
+	if !hasState && len(s.config.Peers) > 0 {
+		// every peer bootstraps with the same configuration, which Raft allows
+		err := s.raft.BootstrapCluster(raft.Configuration{Servers: s.config.Peers}).Error()
+		if err == nil {
+			log.Printf("Bootstrapped Raft cluster with %d peers\n", len(s.config.Peers))
+		} else if !errors.Is(err, raft.ErrCantBootstrap) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RaftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// apply runs cmd on the leader, forwarding it if this replica is a follower.
+func (s *RaftStore) apply(cmd raftCommand) (int, error) {
+	if s.IsLeader() {
+		result, _, err := s.applyLocal(cmd)
+		if err != nil {
+			return -1, err
+		}
+		return result.Vni, result.Err
+	}
+
+	_, leaderId := s.raft.LeaderWithID()
+	if leaderId == "" {
+		return -1, errors.New("no Raft leader elected")
+	}
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return -1, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(string(leaderId), "/")+"/raft/apply",
+		bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if peerTokenFile != "" {
+		// re-read on every request, projected tokens are rotated
+		token, err := os.ReadFile(peerTokenFile)
+		if err != nil {
+			return -1, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return -1, fmt.Errorf("forwarding to Raft leader %s: %s: %s", leaderId, resp.Status, message)
+	}
+	var applyResponse raftApplyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&applyResponse); err != nil {
+		return -1, err
+	}
+
+	// make the write visible to local reads before returning
+	deadline := time.Now().Add(raftApplyTimeout)
+	for s.raft.AppliedIndex() < applyResponse.Index {
+		if time.Now().After(deadline) {
+			return -1, errors.New("timed out waiting for Raft log to be applied locally")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return applyResponse.Vni, raftError(applyResponse.Error)
+}
+
+func (s *RaftStore) applyLocal(cmd raftCommand) (raftResult, uint64, error) {
+	cmd.Time = time.Now()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return raftResult{}, 0, err
+	}
+	future := s.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return raftResult{}, 0, err
+	}
+	result, ok := future.Response().(raftResult)
+	if !ok {
+		return raftResult{}, 0, fmt.Errorf("unexpected Raft apply response: %v", future.Response())
+	}
+	return result, future.Index(), nil
+}
+
+// cApply serves commands forwarded by followers.
+func (s *RaftStore) cApply(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !s.IsLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not the Raft leader"))
+		return
+	}
+
+	var cmd raftCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error reading body: %v\n", err.Error())
+		return
+	}
+	result, index, err := s.applyLocal(cmd)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Printf("Error applying Raft command: %v\n", err)
+		return
+	}
+
+	applyResponse := raftApplyResponse{Vni: result.Vni, Index: index}
+	if result.Err != nil {
+		applyResponse.Error = result.Err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(applyResponse); err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
+
+func (s *RaftStore) GetVni(vniUid string, namespace string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return GetVni(s.db, vniUid, namespace)
+}
+
+func (s *RaftStore) Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	return s.apply(raftCommand{Op: "acquire", VniUid: vniUid, Namespace: namespace,
+		Policy: &policy, DoLog: doLog})
+}
+
+func (s *RaftStore) ReleaseUserCheck(vniUid string, namespace string, doLog bool) error {
+	_, err := s.apply(raftCommand{Op: "release", VniUid: vniUid, Namespace: namespace, DoLog: doLog})
+	return err
+}
+
+func (s *RaftStore) AddUser(vniUid string, namespace string, userId string, doLog bool) error {
+	_, err := s.apply(raftCommand{Op: "addUser", VniUid: vniUid, Namespace: namespace, UserId: userId, DoLog: doLog})
+	return err
+}
+
+func (s *RaftStore) RemoveUser(vniUid string, namespace string, userId string, doLog bool) error {
+	_, err := s.apply(raftCommand{Op: "removeUser", VniUid: vniUid, Namespace: namespace, UserId: userId, DoLog: doLog})
+	return err
+}
+
+func (s *RaftStore) ListAllocations(namespace string) ([]Allocation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ListAllocations(s.db, namespace)
+}
+
+func (s *RaftStore) SetProfile(vniUid string, namespace string, profile CxiProfile) error {
+	_, err := s.apply(raftCommand{Op: "setProfile", VniUid: vniUid, Namespace: namespace, Profile: &profile})
+	return err
+}
+
+func (s *RaftStore) GetProfile(vniUid string, namespace string) (CxiProfile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return GetProfile(s.db, vniUid, namespace)
+}
+
+func (s *RaftStore) SetExternal(owner string, vnis []int) error {
+	if vnis == nil {
+		vnis = []int{}
+	}
+	_, err := s.apply(raftCommand{Op: "setExternal", Owner: owner, Vnis: vnis})
+	return err
+}
+
+func (s *RaftStore) GetExternal() (map[string][]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return GetExternal(s.db)
+}
+
+func (s *RaftStore) Close() error {
+	if s.raft != nil {
+		if err := s.raft.Shutdown().Error(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// raftFSM applies committed commands to the local copy of a RaftStore.
+type raftFSM RaftStore
+
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return raftResult{Vni: -1, Err: err}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	switch cmd.Op {
+	case "acquire":
+		policy := AllocationPolicy{Min: cmd.VniMin, Max: cmd.VniMax, Quarantine: defaultQuarantine}
+		if cmd.Policy != nil {
+			policy = *cmd.Policy
+		}
+		vni, err := acquireAt(f.db, cmd.VniUid, cmd.Namespace, policy, cmd.DoLog, cmd.Time)
+		return raftResult{Vni: vni, Err: err}
+	case "release":
+		return raftResult{Vni: -1, Err: releaseUserCheckAt(f.db, cmd.VniUid, cmd.Namespace, cmd.DoLog, cmd.Time)}
+	case "addUser":
+		return raftResult{Vni: -1, Err: addUserAt(f.db, cmd.VniUid, cmd.Namespace, cmd.UserId, cmd.DoLog, cmd.Time)}
+	case "removeUser":
+		return raftResult{Vni: -1, Err: removeUserAt(f.db, cmd.VniUid, cmd.Namespace, cmd.UserId, cmd.DoLog, cmd.Time)}
+	case "setExternal":
+		return raftResult{Vni: -1, Err: setExternalAt(f.db, cmd.Owner, cmd.Vnis, cmd.Time)}
+	case "setProfile":
+		if cmd.Profile == nil {
+			return raftResult{Vni: -1, Err: errors.New("setProfile without profile")}
+		}
+		return raftResult{Vni: -1, Err: SetProfile(f.db, cmd.VniUid, cmd.Namespace, *cmd.Profile)}
+	default:
+		return raftResult{Vni: -1, Err: fmt.Errorf("unknown Raft command: %s", cmd.Op)}
+	}
+}
+
+// Snapshot copies the local database with VACUUM INTO. Raft does not call
+// Apply concurrently, so the copy matches the last applied index.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	dir, err := os.MkdirTemp("", "vni-raft-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "snapshot.sqlite3")
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if err := Backup(f.db, path); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &raftSnapshot{dir: dir, path: path}, nil
+}
+
+// Restore replaces the local database with a snapshot.
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	tmpPath := *f.filePath + ".raft-snapshot"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, snapshot)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if _, err := ValidateBackup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db != nil {
+		if err := f.db.Close(); err != nil {
+			return err
+		}
+	}
+	err = Restore(f.filePath, tmpPath)
+	os.Remove(tmpPath)
+	if err != nil {
+		return err
+	}
+	// Restore keeps the replaced file, which is of no use for a derived copy
+	if matches, _ := filepath.Glob(*f.filePath + ".pre-restore-*"); matches != nil {
+		for _, match := range matches {
+			os.Remove(match)
+		}
+	}
+
+	db, err := open(f.filePath)
+	if err != nil {
+		return err
+	}
+	if err := Init(db); err != nil {
+		db.Close()
+		return err
+	}
+	f.db = db
+	return nil
+}
+
+type raftSnapshot struct {
+	dir  string
+	path string
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	in, err := os.Open(s.path)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	defer in.Close()
+	if _, err := io.Copy(sink, in); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestRaftCluster starts n RaftStores connected by in-memory transports,
+// each serving /raft/apply for the writes forwarded by the others.
+func newTestRaftCluster(t *testing.T, n int) []*RaftStore {
+	t.Helper()
+	stores := make([]*RaftStore, n)
+	servers := make([]*httptest.Server, n)
+	addresses := make([]raft.ServerAddress, n)
+	transports := make([]*raft.InmemTransport, n)
+	var peers []raft.Server
+	for i := range stores {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stores[i].cApply(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+		addresses[i], transports[i] = raft.NewInmemTransport("")
+		peers = append(peers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(servers[i].URL), Address: addresses[i]})
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(addresses[j], transports[j])
+			}
+		}
+	}
+	for i := range stores {
+		logStore := raft.NewInmemStore()
+		path := filepath.Join(t.TempDir(), "vni.db")
+		stores[i] = NewRaftStore(&path, RaftConfig{
+			ID:            servers[i].URL,
+			Peers:         peers,
+			Transport:     transports[i],
+			LogStore:      logStore,
+			StableStore:   logStore,
+			SnapshotStore: raft.NewInmemSnapshotStore(),
+		})
+		if err := stores[i].Init(); err != nil {
+			t.Fatal(err)
+		}
+		s := stores[i]
+		t.Cleanup(func() { s.Close() })
+	}
+	return stores
+}
+
+// raftLeader waits for one of stores to lead and returns it and a follower.
+func raftLeader(t *testing.T, stores []*RaftStore) (leader *RaftStore, follower *RaftStore) {
+	t.Helper()
+	waitFor(t, "a Raft leader", func() bool {
+		leader, follower = nil, nil
+		for _, s := range stores {
+			if s.IsLeader() {
+				leader = s
+			} else {
+				follower = s
+			}
+		}
+		return leader != nil && follower != nil
+	})
+	return leader, follower
+}
+
+func TestRaftCluster(t *testing.T) {
+	stores := newTestRaftCluster(t, 3)
+	policy := AllocationPolicy{Min: 100, Max: 110, Quarantine: time.Hour, Strategy: StrategyLowestFirst}
+	leader, follower := raftLeader(t, stores)
+
+	// writes on a follower are forwarded, and visible there on return
+	if vni, err := follower.Acquire("my-claim", "vnitest", policy, true); err != nil || vni != 100 {
+		t.Fatalf("Acquire on a follower = %d, %v", vni, err)
+	}
+	if err := follower.AddUser("my-claim", "vnitest", jobUid, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ReleaseUserCheck("my-claim", "vnitest", true); !errors.Is(err, ErrVNIInUse) {
+		t.Errorf("ReleaseUserCheck on a follower = %v, want %v", err, ErrVNIInUse)
+	}
+	if vni, err := follower.Acquire("vni-old", "vnitest", policy, true); err != nil || vni != 101 {
+		t.Fatalf("Acquire on a follower = %d, %v", vni, err)
+	}
+	if err := follower.ReleaseUserCheck("vni-old", "vnitest", true); err != nil {
+		t.Fatal(err)
+	}
+	want := []Allocation{{VniUid: "my-claim", Namespace: "vnitest", Vni: 100, Users: []string{jobUid}}}
+	for _, s := range stores {
+		waitFor(t, "the writes to replicate", func() bool {
+			allocations, err := s.ListAllocations("vnitest")
+			return err == nil && reflect.DeepEqual(allocations, want)
+		})
+	}
+
+	// the other two elect a new leader and keep the state
+	if err := leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var remaining []*RaftStore
+	for _, s := range stores {
+		if s != leader {
+			remaining = append(remaining, s)
+		}
+	}
+	newLeader, follower := raftLeader(t, remaining)
+	// 101 is quarantined
+	if vni, err := follower.Acquire("vni-new", "vnitest", policy, true); err != nil || vni != 102 {
+		t.Fatalf("Acquire after failover = %d, %v, want 102", vni, err)
+	}
+	if vni, err := newLeader.GetVni("vni-new", "vnitest"); err != nil || vni != 102 {
+		t.Errorf("GetVni on the new leader = %d, %v", vni, err)
+	}
+
+	t.Run("snapshot", func(t *testing.T) {
+		snapshot, err := (*raftFSM)(newLeader).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Release()
+		snapshots := raft.NewInmemSnapshotStore()
+		sink, err := snapshots.Create(raft.SnapshotVersionMax, 10, 2, raft.Configuration{}, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := snapshot.Persist(sink); err != nil {
+			t.Fatal(err)
+		}
+		_, reader, err := snapshots.Open(sink.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "restored.db")
+		restored := &RaftStore{filePath: &path}
+		if err := (*raftFSM)(restored).Restore(reader); err != nil {
+			t.Fatal(err)
+		}
+		defer restored.db.Close()
+		local := &SQLiteStore{db: restored.db}
+
+		allocations, err := local.ListAllocations("vnitest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Allocation{
+			{VniUid: "my-claim", Namespace: "vnitest", Vni: 100, Users: []string{jobUid}},
+			{VniUid: "vni-new", Namespace: "vnitest", Vni: 102},
+		}
+		if !reflect.DeepEqual(allocations, want) {
+			t.Errorf("restored allocations %+v, want %+v", allocations, want)
+		}
+		// the quarantine of 101 survives the round trip
+		quarantined := AllocationPolicy{Min: 101, Max: 102, Quarantine: time.Hour, Strategy: StrategyLowestFirst}
+		if vni, err := local.Acquire("vni-next", "vnitest", quarantined, false); !errors.Is(err, ErrNoFreeVNI) {
+			t.Errorf("Acquire of the quarantined VNI = %d, %v", vni, err)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+var ErrRecoveryConflicts = errors.New("conflicting VNIs found in cluster")
+var ErrDBNotEmpty = errors.New("database already holds allocations")
+
+type RecoveredAlloc struct {
+	VniUid    string
+	Namespace string
+	Vni       int
+}
+
+type RecoveredUser struct {
+	VniUid    string
+	Namespace string
+	UserId    string
+}
+
+// RecoveryReport is the allocation state reconstructed from the Vni and
+// VniClaim objects in the cluster.
+type RecoveryReport struct {
+	Allocs    []RecoveredAlloc
+	Users     []RecoveredUser
+	Conflicts []string
+	Skipped   []string
+}
+
+// ReconstructFromCluster rebuilds vni_allocs and vni_users from the cluster.
+//
+// Every Vni object is owned by the job or VniClaim it was created for.
+// A Vni owned by a VniClaim is the claim's allocation. Any other Vni carrying
+// the same VNI number as a claim in its namespace belongs to a job that
+// redeemed that claim, so its owner becomes a user of the claim. A Vni whose
+// owner's controller chain leads to a parent with a Vni of the same VNI was
+// inherited, e.g. by the ReplicaSet of a Deployment, so its owner becomes a
+// user of that parent's allocation. All remaining Vni objects are allocations
+// of their own. Allocations sharing a VNI number are reported as conflicts and
+// left to the operator.
+func ReconstructFromCluster(ctx context.Context, client dynamic.Interface) (*RecoveryReport, error) {
+	vnis, err := client.Resource(vniGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing Vni objects: %w", err)
+	}
+	claims, err := client.Resource(vniClaimGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing VniClaim objects: %w", err)
+	}
+
+	report := &RecoveryReport{}
+
+	// claim name (spec.name) by namespace, as used for the claim's Vni object
+	claimNames := make(map[string]bool)
+	for _, claim := range claims.Items {
+		name, _, _ := unstructured.NestedString(claim.Object, "spec", "name")
+		if name == "" {
+			report.Skipped = append(report.Skipped,
+				fmt.Sprintf("VniClaim %s/%s: no spec.name", claim.GetNamespace(), claim.GetName()))
+			continue
+		}
+		claimNames[claim.GetNamespace()+"/"+name] = true
+	}
+
+	// claim allocations first, so users can be matched against them
+	claimByVni := make(map[string]string)
+	// VNI of the other Vni objects by namespace/name
+	vniByName := make(map[string]int64)
+	others := make([]unstructured.Unstructured, 0, len(vnis.Items))
+	for _, item := range vnis.Items {
+		vni, found, err := unstructured.NestedInt64(item.Object, "spec", "vni")
+		if err != nil || !found {
+			report.Skipped = append(report.Skipped,
+				fmt.Sprintf("Vni %s/%s: no valid spec.vni", item.GetNamespace(), item.GetName()))
+			continue
+		}
+		if vni < int64(vniMin) || vni >= int64(vniMax) {
+			report.Skipped = append(report.Skipped,
+				fmt.Sprintf("Vni %s/%s: VNI %d outside range [%d, %d)", item.GetNamespace(), item.GetName(), vni, vniMin, vniMax))
+			continue
+		}
+
+		owner, ok := vniOwner(item)
+		if !ok {
+			report.Skipped = append(report.Skipped,
+				fmt.Sprintf("Vni %s/%s: no owner", item.GetNamespace(), item.GetName()))
+			continue
+		}
+		if owner.APIVersion == vniApiVersion && owner.Kind == "VniClaim" {
+			if !claimNames[item.GetNamespace()+"/"+item.GetName()] {
+				report.Skipped = append(report.Skipped,
+					fmt.Sprintf("Vni %s/%s: owning VniClaim %s not found", item.GetNamespace(), item.GetName(), owner.Name))
+				continue
+			}
+			report.Allocs = append(report.Allocs, RecoveredAlloc{item.GetName(), item.GetNamespace(), int(vni)})
+			claimByVni[fmt.Sprintf("%s/%d", item.GetNamespace(), vni)] = item.GetName()
+			continue
+		}
+		vniByName[item.GetNamespace()+"/"+item.GetName()] = vni
+		others = append(others, item)
+	}
+
+	for _, item := range others {
+		vni, _, _ := unstructured.NestedInt64(item.Object, "spec", "vni")
+		owner, _ := vniOwner(item)
+		if claim, ok := claimByVni[fmt.Sprintf("%s/%d", item.GetNamespace(), vni)]; ok {
+			report.Users = append(report.Users, RecoveredUser{claim, item.GetNamespace(), string(owner.UID)})
+			continue
+		}
+		ancestor, ok, err := inheritedAllocation(ctx, client, item.GetNamespace(), owner, vni, vniByName)
+		if err != nil {
+			return nil, fmt.Errorf("resolving the owners of Vni %s/%s: %w", item.GetNamespace(), item.GetName(), err)
+		}
+		if ok {
+			report.Users = append(report.Users, RecoveredUser{ancestor, item.GetNamespace(), string(owner.UID)})
+			continue
+		}
+		report.Allocs = append(report.Allocs, RecoveredAlloc{item.GetName(), item.GetNamespace(), int(vni)})
+	}
+
+	byVni := make(map[int][]RecoveredAlloc)
+	for _, alloc := range report.Allocs {
+		byVni[alloc.Vni] = append(byVni[alloc.Vni], alloc)
+	}
+	for vni, allocs := range byVni {
+		if len(allocs) < 2 {
+			continue
+		}
+		holders := ""
+		for i, alloc := range allocs {
+			if i > 0 {
+				holders += ", "
+			}
+			holders += alloc.Namespace + "/" + alloc.VniUid
+		}
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("VNI %d held by %s", vni, holders))
+	}
+	sort.Strings(report.Conflicts)
+
+	return report, nil
+}
+
+// inheritedAllocation follows the controller owner references from owner,
+// the parent of a Vni carrying vni, and returns the allocation vni-<uid> of
+// the topmost ancestor whose Vni carries the same VNI, like
+// ancestorVniRequest resolves it on sync.
+func inheritedAllocation(ctx context.Context, client dynamic.Interface, namespace string,
+	owner metav1.OwnerReference, vni int64, vniByName map[string]int64) (string, bool, error) {
+	ancestor := ""
+	ref := owner
+	for depth := 0; depth < maxOwnerDepth; depth++ {
+		gvr, known := ownerResources[ref.Kind+"."+ref.APIVersion]
+		if !known {
+			break
+		}
+		obj, err := client.Resource(gvr).Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if obj.GetUID() != ref.UID {
+			// deleted and recreated under the same name
+			break
+		}
+		controller := metav1.GetControllerOf(obj)
+		if controller == nil {
+			break
+		}
+		name := fmt.Sprintf("vni-%s", controller.UID)
+		if held, ok := vniByName[namespace+"/"+name]; ok && held == vni {
+			ancestor = name
+		}
+		ref = *controller
+	}
+	return ancestor, ancestor != "", nil
+}
+
+// vniOwner returns the controlling owner of a Vni object, falling back to the
+// first owner reference.
+func vniOwner(item unstructured.Unstructured) (metav1.OwnerReference, bool) {
+	refs := item.GetOwnerReferences()
+	for _, ref := range refs {
+		if ref.Controller != nil && *ref.Controller {
+			return ref, true
+		}
+	}
+	if len(refs) > 0 {
+		return refs[0], true
+	}
+	return metav1.OwnerReference{}, false
+}
+
+// ApplyRecovery writes a conflict-free report into an empty database. All
+// VNIs are quarantined as of now, since VNIs released shortly before the data
+// loss may still be in use on the fabric.
+func ApplyRecovery(db *sql.DB, report *RecoveryReport, doLog bool) error {
+	if len(report.Conflicts) > 0 {
+		return ErrRecoveryConflicts
+	}
+
+	ctx := context.TODO()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, `
+	select (select count(*) from vni_allocs) + (select count(*) from vni_users);`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDBNotEmpty
+	}
+
+	now := time.Now()
+	for _, alloc := range report.Allocs {
+		_, err = tx.ExecContext(ctx, `insert into vni_allocs (vniUid, namespace, vni) values (?, ?, ?);`,
+			alloc.VniUid, alloc.Namespace, alloc.Vni)
+		if err != nil {
+			return err
+		}
+		if doLog {
+			_, err = tx.ExecContext(ctx, `insert into vni_allocs_log(vniUid, namespace, vni, operation, ts)
+									   values (?,?,?, "recover", ?);`,
+				alloc.VniUid, alloc.Namespace, alloc.Vni, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, user := range report.Users {
+		_, err = tx.ExecContext(ctx, `insert or ignore into vni_users (vniUid, namespace, userId) values (?, ?, ?);`,
+			user.VniUid, user.Namespace, user.UserId)
+		if err != nil {
+			return err
+		}
+		if doLog {
+			_, err = tx.ExecContext(ctx, `insert into vni_users_log(vniUid, namespace, userId, operation, ts)
+									   values (?,?,?, "recover", ?);`,
+				user.VniUid, user.Namespace, user.UserId, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `update available_vnis set lastReleased = datetime('now');`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoverFromCluster reconstructs the database at filePath from the cluster.
+// With dryRun set, the report is only printed.
+func RecoverFromCluster(filePath *string, kubeconfig string, dryRun bool, doLog bool) error {
+	client, err := newDynamicClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	report, err := ReconstructFromCluster(context.TODO(), client)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Recovered %d allocations and %d users\n", len(report.Allocs), len(report.Users))
+	for _, skipped := range report.Skipped {
+		log.Printf("Skipped: %s\n", skipped)
+	}
+	for _, conflict := range report.Conflicts {
+		log.Printf("Conflict: %s\n", conflict)
+	}
+	if dryRun {
+		for _, alloc := range report.Allocs {
+			log.Printf("Allocation: %s/%s -> %d\n", alloc.Namespace, alloc.VniUid, alloc.Vni)
+		}
+		for _, user := range report.Users {
+			log.Printf("User: %s/%s <- %s\n", user.Namespace, user.VniUid, user.UserId)
+		}
+		if len(report.Conflicts) > 0 {
+			return ErrRecoveryConflicts
+		}
+		return nil
+	}
+
+	if err := InitDB(filePath); err != nil {
+		return err
+	}
+	db, err := open(filePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return ApplyRecovery(db, report, doLog)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// newVniObject returns the Vni object name owned by owner, carrying vni.
+func newVniObject(name string, vni int64, owner *unstructured.Unstructured) *unstructured.Unstructured {
+	obj := newOwnedObject(vniApiVersion, "Vni", name, nil, owner)
+	unstructured.SetNestedField(obj.Object, vni, "spec", "vni")
+	return obj
+}
+
+func newRecoveryClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{vniGVR: "VniList", vniClaimGVR: "VniClaimList"}, objects...)
+}
+
+func TestReconstructFromCluster(t *testing.T) {
+	deployment := newOwnedObject("apps/v1", "Deployment", "trainer", map[string]string{"vni": "true"})
+	replicaSet := newOwnedObject("apps/v1", "ReplicaSet", "trainer-5d8f", nil, deployment)
+	claim := newOwnedObject(vniApiVersion, "VniClaim", "shared", nil)
+	unstructured.SetNestedField(claim.Object, "my-claim", "spec", "name")
+	job := newOwnedObject("batch/v1", "Job", "eval", map[string]string{"vni": "my-claim"})
+	other := newOwnedObject("batch/v1", "Job", "other", map[string]string{"vni": "true"})
+	stray := newOwnedObject("batch/v1", "Job", "stray", map[string]string{"vni": "true"})
+
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		allocs    []RecoveredAlloc
+		users     []RecoveredUser
+		conflicts int
+	}{
+		{
+			name: "inherited and claimed",
+			objects: []runtime.Object{deployment, replicaSet, claim, job,
+				newVniObject("vni-trainer-uid", 100, deployment),
+				newVniObject("vni-trainer-5d8f-uid", 100, replicaSet),
+				newVniObject("my-claim", 101, claim),
+				newVniObject("vni-eval-uid", 101, job),
+			},
+			allocs: []RecoveredAlloc{{"my-claim", "vnitest", 101}, {"vni-trainer-uid", "vnitest", 100}},
+			users: []RecoveredUser{
+				{"my-claim", "vnitest", "eval-uid"},
+				{"vni-trainer-uid", "vnitest", "trainer-5d8f-uid"},
+			},
+		},
+		{
+			// the ReplicaSet's Vni carries a different VNI, so it was not inherited
+			name: "owner chain with another VNI",
+			objects: []runtime.Object{deployment, replicaSet,
+				newVniObject("vni-trainer-uid", 100, deployment),
+				newVniObject("vni-trainer-5d8f-uid", 102, replicaSet),
+			},
+			allocs: []RecoveredAlloc{{"vni-trainer-5d8f-uid", "vnitest", 102}, {"vni-trainer-uid", "vnitest", 100}},
+		},
+		{
+			name: "owner missing from the cluster",
+			objects: []runtime.Object{deployment,
+				newVniObject("vni-trainer-uid", 100, deployment),
+				newVniObject("vni-trainer-5d8f-uid", 100, replicaSet),
+			},
+			allocs:    []RecoveredAlloc{{"vni-trainer-5d8f-uid", "vnitest", 100}, {"vni-trainer-uid", "vnitest", 100}},
+			conflicts: 1,
+		},
+		{
+			name: "unrelated jobs",
+			objects: []runtime.Object{other, stray,
+				newVniObject("vni-other-uid", 103, other),
+				newVniObject("vni-stray-uid", 103, stray),
+			},
+			allocs:    []RecoveredAlloc{{"vni-other-uid", "vnitest", 103}, {"vni-stray-uid", "vnitest", 103}},
+			conflicts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := ReconstructFromCluster(context.TODO(), newRecoveryClient(tt.objects...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(report.Allocs, func(i, j int) bool { return report.Allocs[i].VniUid < report.Allocs[j].VniUid })
+			sort.Slice(report.Users, func(i, j int) bool { return report.Users[i].VniUid < report.Users[j].VniUid })
+			if !reflect.DeepEqual(report.Allocs, tt.allocs) {
+				t.Errorf("allocs = %v, want %v", report.Allocs, tt.allocs)
+			}
+			if !reflect.DeepEqual(report.Users, tt.users) {
+				t.Errorf("users = %v, want %v", report.Users, tt.users)
+			}
+			if len(report.Conflicts) != tt.conflicts {
+				t.Errorf("conflicts = %v, want %d", report.Conflicts, tt.conflicts)
+			}
+			if len(report.Skipped) > 0 {
+				t.Errorf("skipped = %v", report.Skipped)
+			}
+		})
+	}
+}
+
+func TestApplyRecovery(t *testing.T) {
+	deployment := newOwnedObject("apps/v1", "Deployment", "trainer", map[string]string{"vni": "true"})
+	replicaSet := newOwnedObject("apps/v1", "ReplicaSet", "trainer-5d8f", nil, deployment)
+	claim := newOwnedObject(vniApiVersion, "VniClaim", "shared", nil)
+	unstructured.SetNestedField(claim.Object, "my-claim", "spec", "name")
+	job := newOwnedObject("batch/v1", "Job", "eval", map[string]string{"vni": "my-claim"})
+
+	report, err := ReconstructFromCluster(context.TODO(), newRecoveryClient(deployment, replicaSet, claim, job,
+		newVniObject("vni-trainer-uid", 100, deployment),
+		newVniObject("vni-trainer-5d8f-uid", 100, replicaSet),
+		newVniObject("my-claim", 101, claim),
+		newVniObject("vni-eval-uid", 101, job),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestStore(t)
+	if err := ApplyRecovery(s.db, report, true); err != nil {
+		t.Fatal(err)
+	}
+	allocs, err := s.ListAllocations("vnitest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Allocation{
+		"my-claim":        {VniUid: "my-claim", Namespace: "vnitest", Vni: 101, Users: []string{"eval-uid"}},
+		"vni-trainer-uid": {VniUid: "vni-trainer-uid", Namespace: "vnitest", Vni: 100, Users: []string{"trainer-5d8f-uid"}},
+	}
+	if len(allocs) != len(want) {
+		t.Fatalf("allocations = %v, want %v", allocs, want)
+	}
+	for _, alloc := range allocs {
+		if !reflect.DeepEqual(alloc, want[alloc.VniUid]) {
+			t.Errorf("allocation = %v, want %v", alloc, want[alloc.VniUid])
+		}
+	}
+
+	// the inherited VNI stays held while the ReplicaSet uses it
+	if err := s.ReleaseUserCheck("vni-trainer-uid", "vnitest", true); err == nil {
+		t.Error("released an allocation with a recovered user")
+	}
+	if err := ApplyRecovery(s.db, report, true); err != ErrDBNotEmpty {
+		t.Errorf("second recovery: err = %v, want %v", err, ErrDBNotEmpty)
+	}
+}
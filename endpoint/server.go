@@ -1,53 +1,156 @@
 package main
 
 import (
-	"database/sql"
-	"github.com/mattn/go-sqlite3"
+	"context"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var vniMin = 100
 var vniMax = 65535
 var shouldLog bool
-var DBFilePath *string
+var store Store
+var elector *LeaderElector
+var authenticator Authenticator
+var authorizer Authorizer
+var hookUsers map[string]bool
+var agentUsers map[string]bool
+
+// peerTransport is used for requests to other endpoint replicas
+var peerTransport http.RoundTripper = http.DefaultTransport
 
-func StartServer(filePath *string, _shouldLog bool) error {
+// peerTokenFile holds the bearer token sent to other endpoint replicas
+var peerTokenFile string
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+type ServerConfig struct {
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// ShutdownDelay is how long the server keeps accepting requests after
+	// ctx is done while /readyz fails, so that the replica is removed from the
+	// Service before the listener closes.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds the wait for in-flight requests.
+	ShutdownTimeout time.Duration
+	// AgentReportTTL is how long a node's CXI services are honored without a
+	// report from its agent.
+	AgentReportTTL time.Duration
+	// SlurmSource, if set, is read every SlurmInterval for the VNIs allocated
+	// by Slurm (see ReadSlurmState).
+	SlurmSource   string
+	SlurmInterval time.Duration
+	// Drain decides how long finalize waits for the users of a VNI.
+	Drain DrainPolicy
+	// Forecast decides how the capacity of the pools is forecast.
+	Forecast ForecastConfig
+}
+
+// StartServer serves the hooks until ctx is done, then drains in-flight
+// requests and returns.
+func StartServer(ctx context.Context, _store Store, _shouldLog bool, config ServerConfig) error {
 	shouldLog = _shouldLog
-	DBFilePath = filePath
-	sql.Register("sqlite3_with_extensions", &sqlite3.SQLiteDriver{
-		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-			return conn.CreateModule("generate_series", &seriesModule{})
-		},
-	})
-
-	db, err := open(DBFilePath)
+	store = _store
+	drainPolicy = config.Drain
+	err := store.Init()
 	if err != nil {
-		log.Fatalf("Error opening db: %v\n", err.Error())
+		log.Fatalf("Error initializing DB: %s\n", err)
 		return err
 	}
 
-	err = Init(db)
-	if err != nil {
-		log.Fatalf("Error initializing DB: %s\n", err)
-		return err
+	http.HandleFunc("/version", cVersion)
+	http.HandleFunc("/healthz", cHealthz)
+	http.HandleFunc("/readyz", cReadyz)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/sync", limitBody(rateLimitHooks(leaderOnly(limitWrites(cSync)))))
+	http.HandleFunc("/finalize", limitBody(rateLimitHooks(leaderOnly(limitWrites(cFinalize)))))
+	http.HandleFunc("/pool/sync", limitBody(rateLimitHooks(leaderOnly(cPoolSync))))
+	http.HandleFunc("/pool/finalize", limitBody(rateLimitHooks(leaderOnly(cPoolFinalize))))
+	// the admin API can release any VNI, so it is never served unauthenticated
+	adminEnabled := authenticator != nil
+	if adminEnabled {
+		http.HandleFunc("GET /admin/allocations", rateLimit(adminAuth(describeList, cListAllocations)))
+		http.HandleFunc("POST /admin/allocations/{namespace}/{name}/reserve",
+			limitBody(rateLimit(adminAuth(describeReserve, leaderOnly(limitWrites(cReserve))))))
+		http.HandleFunc("POST /admin/allocations/{namespace}/{name}/release",
+			limitBody(rateLimit(adminAuth(describeRelease, leaderOnly(limitWrites(cRelease))))))
+	} else {
+		log.Printf("Admin API disabled: it requires --auth-tokenreview or --auth-token-file\n")
 	}
-	err = db.Close()
-	if err != nil {
-		log.Fatalf("Error closing DB: %s\n", err)
-		return err
+	if _, ok := store.(*SQLiteStore); ok && adminEnabled {
+		http.HandleFunc("/admin/backup", rateLimit(adminAuth(describeBackup, cBackup)))
+	}
+	http.HandleFunc("POST /agent/services", limitBody(agentAuth(leaderOnly(limitWrites(cCxiReport)))))
+	go StartCxiNodeSweeper(ctx, config.AgentReportTTL)
+	if podClient != nil {
+		http.HandleFunc("GET /api/v1/pods/{namespace}/{name}/vni", rateLimit(agentAuth(cPodVni)))
+	}
+	if config.SlurmSource != "" {
+		if adminEnabled {
+			http.HandleFunc("GET /admin/slurm", rateLimit(adminAuth(describeSlurm, leaderOnly(cSlurmReport))))
+		}
+		go StartSlurmImport(ctx, config.SlurmSource, config.SlurmInterval)
+	}
+	if config.Forecast.Interval > 0 {
+		if adminEnabled {
+			http.HandleFunc("GET /admin/forecast", rateLimit(adminAuth(describeForecast, leaderOnly(cForecast))))
+		}
+		go StartForecast(ctx, config.Forecast)
+	}
+	if raftStore, ok := store.(*RaftStore); ok {
+		http.HandleFunc("/raft/apply", limitBody(hookAuth(limitWrites(raftStore.cApply))))
 	}
 
-	http.HandleFunc("/version", cVersion)
-	http.HandleFunc("/sync", cSync)
-	http.HandleFunc("/finalize", cFinalize)
+	server := &http.Server{
+		Addr:              ":8842",
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	if config.TLSCertFile != "" {
+		server.TLSConfig, err = newServerTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile)
+		if err != nil {
+			log.Printf("Error loading TLS configuration: %v\n", err)
+			return err
+		}
+		log.Printf("Starting server (v1.0) at port 8842 with TLS (client certificates: %v, logging: %v)\n",
+			config.TLSClientCAFile != "", shouldLog)
+		// certificates come from TLSConfig, which reloads them on rotation
+		go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+	} else {
+		log.Printf("Starting server (v1.0) at port 8842 (logging: %v)\n", shouldLog)
+		go func() { serveErr <- server.ListenAndServe() }()
+	}
 
-	log.Printf("Starting server (v1.0) at port 8842 (logging: %v)\n", shouldLog)
-	err = http.ListenAndServe(":8842", nil)
-	if err != nil {
+	select {
+	case err = <-serveErr:
 		log.Printf("Error while starting server: %v\n",
 			err)
 		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining in-flight requests\n")
+	shuttingDown.Store(true)
+	time.Sleep(config.ShutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error while shutting down server: %v\n", err)
+		return err
 	}
+	log.Printf("Server stopped\n")
 	return nil
 }
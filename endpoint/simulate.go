@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var ErrNoHistory = errors.New("no allocation history in the database, was the endpoint run with --log?")
+
+// Operations of a replayed trace, in the order they are applied at the same
+// time
+const (
+	simAcquire = iota
+	simAddUser
+	simRemoveUser
+	simRelease
+)
+
+// simEvent is an operation of an allocation history or synthetic trace.
+type simEvent struct {
+	ts        time.Time
+	op        int
+	vniUid    string
+	namespace string
+	userId    string
+}
+
+// SimulationConfig is the configuration a trace is replayed against.
+type SimulationConfig struct {
+	// PoolsFile holds VniPool manifests; without it, the whole range is
+	// allocated from as without VniPools
+	PoolsFile string
+	// Jobs, if > 0, replaces the history by a synthetic trace of Jobs jobs
+	// arriving Interarrival apart and holding their VNI for Hold, both on
+	// average and exponentially distributed, in Namespaces
+	Jobs         int
+	Interarrival time.Duration
+	Hold         time.Duration
+	Namespaces   []string
+	Seed         int64
+}
+
+// SimulationReport is the outcome of replaying a trace.
+type SimulationReport struct {
+	Events   int
+	From, To time.Time
+	Acquired int
+	Released int
+	// Skipped counts operations on allocations the simulation does not
+	// hold, because they predate the history or could not be allocated
+	Skipped int
+
+	// PeakAllocated is the most VNIs allocated at once, first reached at PeakAt
+	PeakAllocated int
+	PeakAt        time.Time
+	// PoolPeaks is the peak of each VniPool
+	PoolPeaks map[string]int
+
+	// Exhausted counts the allocations that found no free VNI, and
+	// ExhaustedQuarantined those of them made while VNIs were quarantined
+	Exhausted            int
+	ExhaustedQuarantined int
+	FirstExhausted       time.Time
+	// NoPool counts the allocations of namespaces no VniPool allows
+	NoPool int
+
+	// PeakQuarantined and MeanQuarantined are the VNIs in quarantine when
+	// allocating
+	PeakQuarantined int
+	MeanQuarantined float64
+
+	// ReuseIntervals are the times between the release of a VNI and its next
+	// allocation, sorted
+	ReuseIntervals []time.Duration
+}
+
+// simStore is an in-memory SQLiteStore whose clock is the time of the
+// replayed operation.
+type simStore struct {
+	*SQLiteStore
+	now time.Time
+}
+
+func (s *simStore) Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	return acquireAt(s.db, vniUid, namespace, policy, doLog, s.now)
+}
+
+func (s *simStore) ReleaseUserCheck(vniUid string, namespace string, doLog bool) error {
+	return releaseUserCheckAt(s.db, vniUid, namespace, doLog, s.now)
+}
+
+func (s *simStore) AddUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return addUserAt(s.db, vniUid, namespace, userId, doLog, s.now)
+}
+
+func (s *simStore) RemoveUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return removeUserAt(s.db, vniUid, namespace, userId, doLog, s.now)
+}
+
+func newSimStore() (*simStore, error) {
+	path := ":memory:"
+	db, err := open(&path)
+	if err != nil {
+		return nil, err
+	}
+	// every connection would open another in-memory database
+	db.SetMaxOpenConns(1)
+	if err := Init(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &simStore{SQLiteStore: &SQLiteStore{db: db}}, nil
+}
+
+// readHistory reads the operations logged in vni_allocs_log and
+// vni_users_log, in order.
+func readHistory(db *sql.DB) ([]simEvent, error) {
+	ctx := context.TODO()
+	ops := map[string]int{"acquire": simAcquire, "recover": simAcquire, "release": simRelease}
+	events, err := readLog(ctx, db, `select ts, operation, vniUid, namespace, '' from vni_allocs_log;`, ops)
+	if err != nil {
+		return nil, fmt.Errorf("reading vni_allocs_log: %w", err)
+	}
+	ops = map[string]int{"add": simAddUser, "recover": simAddUser, "remove": simRemoveUser}
+	users, err := readLog(ctx, db, `select ts, operation, vniUid, namespace, userId from vni_users_log;`, ops)
+	if err != nil {
+		return nil, fmt.Errorf("reading vni_users_log: %w", err)
+	}
+	events = append(events, users...)
+	sortEvents(events)
+	return events, nil
+}
+
+func readLog(ctx context.Context, db *sql.DB, query string, ops map[string]int) ([]simEvent, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []simEvent
+	for rows.Next() {
+		var event simEvent
+		var operation string
+		if err := rows.Scan(&event.ts, &operation, &event.vniUid, &event.namespace, &event.userId); err != nil {
+			return nil, err
+		}
+		op, ok := ops[operation]
+		if !ok {
+			continue
+		}
+		event.op = op
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// sortEvents orders events by time, and operations at the same time so that
+// allocations are joined after being acquired and released after being left.
+func sortEvents(events []simEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].ts.Equal(events[j].ts) {
+			return events[i].ts.Before(events[j].ts)
+		}
+		return events[i].op < events[j].op
+	})
+}
+
+// syntheticTrace returns the operations of config.Jobs jobs with Poisson
+// arrivals and exponential hold times, starting at start.
+func syntheticTrace(config SimulationConfig, start time.Time) []simEvent {
+	random := rand.New(rand.NewSource(config.Seed))
+	namespaces := config.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{"default"}
+	}
+	events := make([]simEvent, 0, 2*config.Jobs)
+	ts := start
+	for i := 0; i < config.Jobs; i++ {
+		ts = ts.Add(time.Duration(random.ExpFloat64() * float64(config.Interarrival)))
+		hold := time.Duration(random.ExpFloat64() * float64(config.Hold))
+		vniUid := fmt.Sprintf("vni-job-%d", i)
+		namespace := namespaces[random.Intn(len(namespaces))]
+		events = append(events,
+			simEvent{ts: ts, op: simAcquire, vniUid: vniUid, namespace: namespace},
+			simEvent{ts: ts.Add(hold), op: simRelease, vniUid: vniUid, namespace: namespace})
+	}
+	sortEvents(events)
+	return events
+}
+
+// loadPools reads the VniPool manifests in path into the pool registry.
+func loadPools(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := utilyaml.NewYAMLOrJSONDecoder(file, 4096)
+	for i := 0; ; i++ {
+		var object KubeObject
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if object.Kind == "" {
+			// empty document
+			continue
+		}
+		if object.Kind != "VniPool" {
+			return fmt.Errorf("%s %s is no VniPool", object.Kind, object.Metadata.Name)
+		}
+		pool, err := decodePool(object)
+		if err != nil {
+			return fmt.Errorf("VniPool %s: %w", object.Metadata.Name, err)
+		}
+		if pool.created.IsZero() {
+			// earlier manifests win overlaps, like older pools
+			pool.created = time.Unix(int64(i), 0)
+		}
+		if err := setPool(pool); err != nil {
+			return fmt.Errorf("VniPool %s: %w", object.Metadata.Name, err)
+		}
+	}
+}
+
+// quarantineOf returns the quarantine of vni.
+func quarantineOf(vni int) time.Duration {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	for _, pool := range vniPools.byName {
+		if pool.spec.contains(vni) {
+			return pool.spec.quarantine()
+		}
+	}
+	return defaultQuarantine
+}
+
+// poolOf returns the name of the pool of vni, or "" if there is none.
+func poolOf(vni int) string {
+	vniPools.Lock()
+	defer vniPools.Unlock()
+	for name, pool := range vniPools.byName {
+		if pool.spec.contains(vni) {
+			return name
+		}
+	}
+	return ""
+}
+
+// simReleased is a VNI released at ts, quarantined until ts + its quarantine.
+type simReleased struct {
+	vni int
+	ts  time.Time
+}
+
+// Simulate replays events against the allocator with the store and pools
+// in place. Allocations that find no free VNI are not retried.
+func Simulate(s *simStore, events []simEvent) (*SimulationReport, error) {
+	report := &SimulationReport{Events: len(events), PoolPeaks: make(map[string]int)}
+	if len(events) > 0 {
+		report.From, report.To = events[0].ts, events[len(events)-1].ts
+	}
+	// VNIs held by the simulation, by allocation
+	held := make(map[string]int)
+	poolUsage := make(map[string]int)
+	lastReleased := make(map[int]time.Time)
+	// released VNIs by quarantine, in order of release
+	quarantined := make(map[time.Duration][]simReleased)
+	quarantinedSum := 0
+
+	for _, event := range events {
+		s.now = event.ts
+		key := allocKey(event.vniUid, event.namespace)
+		switch event.op {
+		case simAcquire:
+			if _, ok := held[key]; ok {
+				report.Skipped++
+				continue
+			}
+			inQuarantine := 0
+			for q, released := range quarantined {
+				// Acquire skips VNIs released at most q ago
+				start := sort.Search(len(released), func(i int) bool { return s.now.Sub(released[i].ts) <= q })
+				quarantined[q] = released[start:]
+				inQuarantine += len(released) - start
+			}
+			report.PeakQuarantined = max(report.PeakQuarantined, inQuarantine)
+			quarantinedSum += inQuarantine
+
+			vni, err := acquireVni(event.vniUid, event.namespace)
+			switch {
+			case errors.Is(err, ErrNoFreeVNI):
+				report.Exhausted++
+				if inQuarantine > 0 {
+					report.ExhaustedQuarantined++
+				}
+				if report.FirstExhausted.IsZero() {
+					report.FirstExhausted = s.now
+				}
+				continue
+			case errors.Is(err, ErrNoPool):
+				report.NoPool++
+				continue
+			case err != nil:
+				return nil, err
+			}
+			report.Acquired++
+			held[key] = vni
+			if released, ok := lastReleased[vni]; ok {
+				report.ReuseIntervals = append(report.ReuseIntervals, s.now.Sub(released))
+			}
+			if len(held) > report.PeakAllocated {
+				report.PeakAllocated, report.PeakAt = len(held), s.now
+			}
+			pool := poolOf(vni)
+			poolUsage[pool]++
+			report.PoolPeaks[pool] = max(report.PoolPeaks[pool], poolUsage[pool])
+		case simAddUser, simRemoveUser:
+			if _, ok := held[key]; !ok {
+				report.Skipped++
+				continue
+			}
+			var err error
+			if event.op == simAddUser {
+				err = s.AddUser(event.vniUid, event.namespace, event.userId, false)
+			} else {
+				err = s.RemoveUser(event.vniUid, event.namespace, event.userId, false)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case simRelease:
+			vni, ok := held[key]
+			if !ok {
+				report.Skipped++
+				continue
+			}
+			// the release was logged, so its users had left even if their
+			// removal was not
+			users, err := allocationUsers(event.vniUid, event.namespace)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				if err := s.RemoveUser(event.vniUid, event.namespace, user, false); err != nil {
+					return nil, err
+				}
+			}
+			if err := s.ReleaseUserCheck(event.vniUid, event.namespace, false); err != nil {
+				return nil, err
+			}
+			report.Released++
+			delete(held, key)
+			poolUsage[poolOf(vni)]--
+			lastReleased[vni] = s.now
+			q := quarantineOf(vni)
+			quarantined[q] = append(quarantined[q], simReleased{vni, s.now})
+		}
+	}
+	if attempts := report.Acquired + report.Exhausted; attempts > 0 {
+		report.MeanQuarantined = float64(quarantinedSum) / float64(attempts)
+	}
+	if _, declared := poolsFor(""); !declared {
+		delete(report.PoolPeaks, "")
+	}
+	slices.Sort(report.ReuseIntervals)
+	return report, nil
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// RunSimulation replays the allocation history of the database at filePath,
+// or a synthetic trace, against config and logs the report.
+func RunSimulation(filePath *string, config SimulationConfig) error {
+	if config.PoolsFile != "" {
+		if err := loadPools(config.PoolsFile); err != nil {
+			return fmt.Errorf("loading VniPools: %w", err)
+		}
+	}
+
+	var events []simEvent
+	if config.Jobs > 0 {
+		events = syntheticTrace(config, time.Now())
+	} else {
+		// opening would create a missing database
+		if _, err := os.Stat(*filePath); err != nil {
+			return err
+		}
+		db, err := open(filePath)
+		if err != nil {
+			return err
+		}
+		events, err = readHistory(db)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return ErrNoHistory
+		}
+	}
+
+	s, err := newSimStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// the allocator works on the global store
+	store = s
+	report, err := Simulate(s, events)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Replayed %d operations from %s to %s\n", report.Events,
+		report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+	log.Printf("Allocations: %d acquired, %d released, %d operations on unknown allocations skipped\n",
+		report.Acquired, report.Released, report.Skipped)
+	log.Printf("Peak usage: %d VNIs at %s\n", report.PeakAllocated, report.PeakAt.Format(time.RFC3339))
+	pools := make([]string, 0, len(report.PoolPeaks))
+	for pool := range report.PoolPeaks {
+		pools = append(pools, pool)
+	}
+	slices.Sort(pools)
+	for _, pool := range pools {
+		name := pool
+		if name == "" {
+			name = "(no pool)"
+		}
+		log.Printf("Peak usage of VniPool %s: %d VNIs\n", name, report.PoolPeaks[pool])
+	}
+	if report.Exhausted > 0 {
+		log.Printf("Exhaustion: %d allocations found no free VNI, %d of them while VNIs were quarantined, first at %s\n",
+			report.Exhausted, report.ExhaustedQuarantined, report.FirstExhausted.Format(time.RFC3339))
+	} else {
+		log.Printf("Exhaustion: none\n")
+	}
+	if report.NoPool > 0 {
+		log.Printf("No VniPool: %d allocations\n", report.NoPool)
+	}
+	log.Printf("Quarantine pressure: %.1f VNIs quarantined per allocation on average, at most %d\n",
+		report.MeanQuarantined, report.PeakQuarantined)
+	if intervals := report.ReuseIntervals; len(intervals) > 0 {
+		log.Printf("Reuse intervals of %d reallocated VNIs: min %v, p50 %v, p90 %v, p99 %v, max %v\n", len(intervals),
+			intervals[0].Round(time.Second), percentile(intervals, 0.5).Round(time.Second), percentile(intervals, 0.9).Round(time.Second),
+			percentile(intervals, 0.99).Round(time.Second), intervals[len(intervals)-1].Round(time.Second))
+	} else {
+		log.Printf("Reuse intervals: no VNI was reallocated\n")
+	}
+	return nil
+}
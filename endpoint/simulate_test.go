@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReadHistory(t *testing.T) {
+	s := newTestStore(t)
+	at := func(seconds int) time.Time { return time.Date(2024, 5, 2, 9, 0, seconds, 0, time.UTC) }
+	_, err := s.db.Exec(`
+	insert into vni_allocs_log (vniUid, namespace, vni, operation, ts) values
+		('claim', 'vnitest', 100, 'recover', ?),
+		('vni-job', 'vnitest', 101, 'release', ?),
+		('vni-job', 'vnitest', 101, 'acquire', ?),
+		('vni-job', 'vnitest', 101, 'rename', ?);
+	insert into vni_users_log (vniUid, namespace, userId, operation, ts) values
+		('claim', 'vnitest', 'job-uid', 'recover', ?),
+		('vni-job', 'vnitest', 'node', 'remove', ?),
+		('vni-job', 'vnitest', 'node', 'add', ?);`,
+		at(0), at(20), at(10), at(15), at(0), at(20), at(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := readHistory(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// recovered allocations and users replay like acquisitions and joins,
+	// and operations at the same time in the order they can be applied
+	want := []simEvent{
+		{ts: at(0), op: simAcquire, vniUid: "claim", namespace: "vnitest"},
+		{ts: at(0), op: simAddUser, vniUid: "claim", namespace: "vnitest", userId: "job-uid"},
+		{ts: at(10), op: simAcquire, vniUid: "vni-job", namespace: "vnitest"},
+		{ts: at(10), op: simAddUser, vniUid: "vni-job", namespace: "vnitest", userId: "node"},
+		{ts: at(20), op: simRemoveUser, vniUid: "vni-job", namespace: "vnitest", userId: "node"},
+		{ts: at(20), op: simRelease, vniUid: "vni-job", namespace: "vnitest"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if !events[i].ts.Equal(want[i].ts) || events[i].op != want[i].op || events[i].vniUid != want[i].vniUid ||
+			events[i].userId != want[i].userId {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	newTestStore(t)
+	s, err := newSimStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store = s
+	minute := 60
+	small := newTestPool("small", 1, []string{"team-a"}, 100, 102)
+	small.spec.QuarantineSeconds = &minute
+	rest := newTestPool("rest", 2, []string{"team-a"}, 200, 201)
+	rest.spec.QuarantineSeconds = &minute
+	setTestPools(t, small, rest)
+
+	start := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	event := func(seconds int, op int, vniUid string, namespace string) simEvent {
+		return simEvent{ts: at(seconds), op: op, vniUid: vniUid, namespace: namespace}
+	}
+	events := []simEvent{
+		event(0, simAcquire, "j1", "team-a"),  // 100
+		event(0, simAcquire, "j2", "team-a"),  // 101
+		event(10, simAcquire, "j3", "team-a"), // 200, small is full
+		event(20, simAcquire, "j4", "team-a"), // exhausted
+		event(30, simRelease, "j1", "team-a"),
+		event(40, simAcquire, "j5", "team-a"), // exhausted, 100 is quarantined
+		event(45, simAcquire, "j6", "team-b"), // no pool
+		{ts: at(50), op: simAddUser, vniUid: "j3", namespace: "team-a", userId: "node"},
+		// skipped, never acquired
+		{ts: at(50), op: simAddUser, vniUid: "gone", namespace: "team-a", userId: "node"},
+		event(100, simAcquire, "j7", "team-a"), // 100 again, 70s after its release
+		event(110, simRelease, "j2", "team-a"),
+		event(120, simRelease, "unknown", "team-a"), // skipped
+		event(200, simAcquire, "j8", "team-a"),      // 101 again, 90s after its release
+		event(300, simRelease, "j3", "team-a"),      // leaves node attached
+	}
+
+	report, err := Simulate(s, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SimulationReport{
+		Events: len(events), From: at(0), To: at(300),
+		Acquired: 5, Released: 3, Skipped: 2,
+		PeakAllocated: 3, PeakAt: at(10),
+		PoolPeaks: map[string]int{"small": 2, "rest": 1},
+		Exhausted: 2, ExhaustedQuarantined: 1, FirstExhausted: at(20),
+		NoPool:          1,
+		PeakQuarantined: 1,
+		// j5 and j6 saw 100 in quarantine, out of 5 acquired and 2 exhausted
+		MeanQuarantined: 2.0 / 7,
+		ReuseIntervals:  []time.Duration{70 * time.Second, 90 * time.Second},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v,\nwant %+v", report, want)
+	}
+	if p50 := percentile(report.ReuseIntervals, 0.5); p50 != 70*time.Second {
+		t.Errorf("p50 = %v, want 70s", p50)
+	}
+	if p99 := percentile(report.ReuseIntervals, 0.99); p99 != 70*time.Second {
+		t.Errorf("p99 = %v, want 70s", p99)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 101; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Second)
+	}
+	for p, want := range map[float64]time.Duration{0: time.Second, 0.5: 51 * time.Second, 0.9: 91 * time.Second,
+		0.99: 100 * time.Second, 1: 101 * time.Second} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%v = %v, want %v", p*100, got, want)
+		}
+	}
+}
+
+func TestSyntheticTrace(t *testing.T) {
+	start := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	config := SimulationConfig{Jobs: 50, Interarrival: 10 * time.Second, Hold: time.Minute,
+		Namespaces: []string{"team-a", "team-b"}, Seed: 7}
+	events := syntheticTrace(config, start)
+	if again := syntheticTrace(config, start); !reflect.DeepEqual(events, again) {
+		t.Error("the same seed gave another trace")
+	}
+	config.Seed = 8
+	if other := syntheticTrace(config, start); reflect.DeepEqual(events, other) {
+		t.Error("another seed gave the same trace")
+	}
+
+	if len(events) != 2*config.Jobs {
+		t.Fatalf("%d events, want %d", len(events), 2*config.Jobs)
+	}
+	acquired := make(map[string]time.Time)
+	for i, event := range events {
+		if i > 0 && event.ts.Before(events[i-1].ts) {
+			t.Fatalf("event %d at %v before event %d at %v", i, event.ts, i-1, events[i-1].ts)
+		}
+		if !event.ts.After(start) || !slices.Contains(config.Namespaces, event.namespace) {
+			t.Errorf("event %+v", event)
+		}
+		switch event.op {
+		case simAcquire:
+			acquired[event.vniUid] = event.ts
+		case simRelease:
+			if _, ok := acquired[event.vniUid]; !ok {
+				t.Errorf("%s released before it was acquired", event.vniUid)
+			}
+		}
+	}
+
+	newTestStore(t)
+	s, err := newSimStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store = s
+	report, err := Simulate(s, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Acquired != config.Jobs || report.Released != config.Jobs || report.Exhausted != 0 ||
+		report.Skipped != 0 || len(report.PoolPeaks) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
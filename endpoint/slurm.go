@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// slurmOwner marks the VNIs imported from Slurm in available_vnis
+const slurmOwner = "slurm"
+
+// SlurmState is what a Slurm source reports: the VNI range of the
+// switch/hpe_slingshot plugin (0 if unknown) and the VNIs allocated to jobs,
+// one by one or as ranges.
+type SlurmState struct {
+	VniMin int        `json:"vniMin,omitempty"`
+	VniMax int        `json:"vniMax,omitempty"`
+	Vnis   []int      `json:"vnis"`
+	Ranges []VniRange `json:"ranges,omitempty"`
+	// Outside counts the VNIs of Ranges dropped by clampRanges
+	Outside int `json:"-"`
+}
+
+// VniRange is an inclusive range of VNIs, as Slurm writes them.
+type VniRange struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// clampRanges cuts the ranges down to [vniMin, vniMax), so that a source
+// cannot make the import expand an arbitrarily large range, and counts the
+// VNIs cut off in Outside.
+func (state *SlurmState) clampRanges() error {
+	var clamped []VniRange
+	for _, r := range state.Ranges {
+		if r.First < 0 || r.Last < r.First {
+			return fmt.Errorf("invalid range %d-%d", r.First, r.Last)
+		}
+		first, last := max(r.First, vniMin), min(r.Last, vniMax-1)
+		if first > last {
+			state.Outside += r.Last - r.First + 1
+			continue
+		}
+		state.Outside += (first - r.First) + (r.Last - last)
+		clamped = append(clamped, VniRange{first, last})
+	}
+	state.Ranges = clamped
+	return nil
+}
+
+// SlurmImportReport is the result of the last import, served on
+// /admin/slurm.
+type SlurmImportReport struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Error  string    `json:"error,omitempty"`
+	// SlurmRange is Slurm's VNI range, Overlap its overlap with ours
+	SlurmRange string `json:"slurmRange,omitempty"`
+	Overlap    string `json:"overlap,omitempty"`
+	// Imported VNIs are in our range and kept from being acquired; Outside
+	// counts the VNIs not in our range, which are ignored
+	Imported []int `json:"imported"`
+	Outside  int   `json:"outside,omitempty"`
+	// Conflicts are VNIs allocated by both Slurm and Kubernetes
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+var (
+	slurmImportedVnis = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vni_slurm_imported_vnis",
+		Help: "VNIs allocated by Slurm within the range of the endpoint.",
+	})
+	slurmConflicts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vni_slurm_conflicts",
+		Help: "VNIs allocated by both Slurm and Kubernetes.",
+	})
+	slurmImportErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vni_slurm_import_errors_total",
+		Help: "Failed imports from Slurm.",
+	})
+)
+
+var lastSlurmReport = struct {
+	mu     sync.Mutex
+	report *SlurmImportReport
+}{}
+
+// ReadSlurmState reads Slurm's VNIs from source, which is one of
+//
+//	file:<path>     a JSON SlurmState, or one VNI or range (a-b) per line,
+//	                with an optional line "range <min>-<max>" or Slurm's
+//	                "SwitchParameters=vnis=<min>-<max>,..."
+//	http(s)://...   a REST service answering a JSON SlurmState
+//	exec:<command>  a command printing either of the file formats
+//
+// Sources are read up to maxBodyBytes.
+func ReadSlurmState(ctx context.Context, source string) (SlurmState, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		file, err := os.Open(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return SlurmState{}, err
+		}
+		defer file.Close()
+		data, err := readLimited(file)
+		if err != nil {
+			return SlurmState{}, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		return parseSlurmState(data)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return SlurmState{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return SlurmState{}, err
+		}
+		defer resp.Body.Close()
+		data, err := readLimited(resp.Body)
+		if err != nil {
+			return SlurmState{}, fmt.Errorf("%s: %w", source, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return SlurmState{}, fmt.Errorf("%s answered %s: %s", source, resp.Status, bytes.TrimSpace(data))
+		}
+		return parseSlurmState(data)
+	case strings.HasPrefix(source, "exec:"):
+		args := strings.Fields(strings.TrimPrefix(source, "exec:"))
+		if len(args) == 0 {
+			return SlurmState{}, errors.New("no Slurm command given")
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return SlurmState{}, err
+		}
+		if err := cmd.Start(); err != nil {
+			return SlurmState{}, fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, readErr := readLimited(stdout)
+		if readErr != nil {
+			// do not wait for output nobody reads
+			cmd.Process.Kill()
+		}
+		if err := cmd.Wait(); err != nil && readErr == nil {
+			return SlurmState{}, fmt.Errorf("%s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if readErr != nil {
+			return SlurmState{}, fmt.Errorf("%s: %w", args[0], readErr)
+		}
+		return parseSlurmState(data)
+	default:
+		return SlurmState{}, fmt.Errorf("unknown Slurm source %q, expected file:, http(s):// or exec:", source)
+	}
+}
+
+// readLimited reads r up to maxBodyBytes. Unlike a truncated request body, a
+// truncated VNI list would silently drop VNIs, so it fails instead.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBodyBytes {
+		return nil, fmt.Errorf("larger than %d bytes", maxBodyBytes)
+	}
+	return data, nil
+}
+
+// parseSlurmState parses a Slurm source. Its ranges are clamped to our range.
+func parseSlurmState(data []byte) (SlurmState, error) {
+	var state SlurmState
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &state); err != nil {
+			return state, err
+		}
+		return state, state.clampRanges()
+	}
+
+	parseRange := func(value string) (VniRange, error) {
+		first, last, isRange := strings.Cut(value, "-")
+		min, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return VniRange{}, err
+		}
+		max := min
+		if isRange {
+			max, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil {
+				return VniRange{}, err
+			}
+		}
+		if min < 0 || max < min {
+			return VniRange{}, fmt.Errorf("invalid range %s", value)
+		}
+		return VniRange{min, max}, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		value, isRange := strings.CutPrefix(text, "range ")
+		if parameters, ok := strings.CutPrefix(text, "SwitchParameters"); ok {
+			// slurm.conf, or scontrol show config: "SwitchParameters = vnis=1024-2047,..."
+			parameters = strings.TrimLeft(parameters, " =")
+			value, isRange = "", false
+			for _, parameter := range strings.Split(parameters, ",") {
+				if vnis, ok := strings.CutPrefix(strings.TrimSpace(parameter), "vnis="); ok {
+					value, isRange = vnis, true
+				}
+			}
+			if !isRange {
+				continue
+			}
+		}
+		r, err := parseRange(value)
+		if err != nil {
+			return state, fmt.Errorf("line %d: %w", line, err)
+		}
+		if isRange {
+			// Slurm's range is inclusive, ours is not
+			state.VniMin, state.VniMax = r.First, r.Last+1
+			continue
+		}
+		state.Ranges = append(state.Ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return state, err
+	}
+	return state, state.clampRanges()
+}
+
+// ImportSlurm marks the VNIs Slurm allocated in our range as unavailable and
+// reports how Slurm's allocations relate to ours.
+func ImportSlurm(ctx context.Context, source string) SlurmImportReport {
+	report := SlurmImportReport{Time: time.Now(), Source: source, Imported: make([]int, 0)}
+	err := importSlurm(ctx, source, &report)
+	if err != nil {
+		report.Error = err.Error()
+		slurmImportErrors.Inc()
+	}
+	return report
+}
+
+func importSlurm(ctx context.Context, source string, report *SlurmImportReport) error {
+	state, err := ReadSlurmState(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	if state.VniMax > state.VniMin {
+		report.SlurmRange = fmt.Sprintf("%d-%d", state.VniMin, state.VniMax)
+		if overlapMin, overlapMax := max(state.VniMin, vniMin), min(state.VniMax, vniMax); overlapMin < overlapMax {
+			report.Overlap = fmt.Sprintf("%d-%d", overlapMin, overlapMax)
+		}
+	}
+
+	report.Outside = state.Outside
+	seen := make(map[int]bool)
+	for _, vni := range state.Vnis {
+		if seen[vni] {
+			continue
+		}
+		seen[vni] = true
+		if vni >= vniMin && vni < vniMax {
+			report.Imported = append(report.Imported, vni)
+		} else {
+			report.Outside++
+		}
+	}
+	// the ranges are clamped, so this is bounded by our range
+	for _, r := range state.Ranges {
+		for vni := r.First; vni <= r.Last; vni++ {
+			if !seen[vni] {
+				seen[vni] = true
+				report.Imported = append(report.Imported, vni)
+			}
+		}
+	}
+	sort.Ints(report.Imported)
+
+	if err := store.SetExternal(slurmOwner, report.Imported); err != nil {
+		return err
+	}
+
+	allocs, err := store.ListAllocations("")
+	if err != nil {
+		return err
+	}
+	for _, alloc := range allocs {
+		if seen[alloc.Vni] {
+			report.Conflicts = append(report.Conflicts,
+				fmt.Sprintf("VNI %d is allocated by Slurm and to %s", alloc.Vni, allocKey(alloc.VniUid, alloc.Namespace)))
+		}
+	}
+	slurmImportedVnis.Set(float64(len(report.Imported)))
+	slurmConflicts.Set(float64(len(report.Conflicts)))
+	return nil
+}
+
+// StartSlurmImport imports from source every interval on the leader until
+// ctx is done.
+func StartSlurmImport(ctx context.Context, source string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var previous *SlurmImportReport
+	for {
+		if leading() {
+			report := ImportSlurm(ctx, source)
+			logSlurmReport(report, previous)
+			previous = &report
+			lastSlurmReport.mu.Lock()
+			lastSlurmReport.report = &report
+			lastSlurmReport.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logSlurmReport logs errors and conflicts, and overlap and import counts
+// when they change.
+func logSlurmReport(report SlurmImportReport, previous *SlurmImportReport) {
+	if report.Error != "" {
+		log.Printf("Error importing VNIs from Slurm (%s): %s\n", report.Source, report.Error)
+		return
+	}
+	if previous == nil || previous.Overlap != report.Overlap || previous.SlurmRange != report.SlurmRange {
+		if report.Overlap != "" {
+			log.Printf("Slurm VNI range %s overlaps ours (%d-%d) in %s, sharing it\n",
+				report.SlurmRange, vniMin, vniMax, report.Overlap)
+		} else if report.SlurmRange != "" {
+			log.Printf("Slurm VNI range %s is disjoint from ours (%d-%d)\n", report.SlurmRange, vniMin, vniMax)
+		}
+	}
+	if previous == nil || len(previous.Imported) != len(report.Imported) {
+		log.Printf("Imported %d VNIs from Slurm, %d outside our range\n", len(report.Imported), report.Outside)
+	}
+	for _, conflict := range report.Conflicts {
+		log.Printf("Conflict with Slurm: %s\n", conflict)
+	}
+}
+
+// cSlurmReport serves the report of the last import.
+func cSlurmReport(w http.ResponseWriter, r *http.Request) {
+	lastSlurmReport.mu.Lock()
+	report := lastSlurmReport.report
+	lastSlurmReport.mu.Unlock()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no Slurm import on this replica yet"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error writing body: %v\n", err.Error())
+	}
+}
+
+// the report covers all namespaces
+func describeSlurm(r *http.Request) AdminRequest {
+	return AdminRequest{Verb: VerbGet, Subresource: "slurm"}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSlurmState(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    SlurmState
+		wantErr string
+	}{
+		{
+			name: "text",
+			data: "# allocated by Slurm\nrange 1024-2047\n100\n\n200-202\n",
+			want: SlurmState{VniMin: 1024, VniMax: 2048, Ranges: []VniRange{{100, 100}, {200, 202}}},
+		},
+		{
+			name: "scontrol show config",
+			data: "SwitchParameters        = vnis=32768-65535,tcs=BULK_DATA:BEST_EFFORT\n1030\n",
+			want: SlurmState{VniMin: 32768, VniMax: 65536, Ranges: []VniRange{{1030, 1030}}},
+		},
+		{
+			name: "slurm.conf without vnis",
+			data: "SwitchParameters=def_svc=1\n1030\n",
+			want: SlurmState{Ranges: []VniRange{{1030, 1030}}},
+		},
+		{
+			name: "clamped to our range",
+			data: "0-150\n65000-9223372036854775806\n",
+			want: SlurmState{Ranges: []VniRange{{100, 150}, {65000, 65534}},
+				Outside: 100 + (9223372036854775806 - 65534)},
+		},
+		{
+			name: "outside our range",
+			data: "1-99\n70000\n",
+			want: SlurmState{Outside: 100},
+		},
+		{
+			name: "json",
+			data: `{"vniMin": 1024, "vniMax": 2048, "vnis": [1030, 1031], "ranges": [{"first": 90, "last": 109}]}`,
+			want: SlurmState{VniMin: 1024, VniMax: 2048, Vnis: []int{1030, 1031}, Ranges: []VniRange{{100, 109}},
+				Outside: 10},
+		},
+		{name: "descending range", data: "200-100\n", wantErr: "line 1: invalid range 200-100"},
+		{name: "negative", data: "-5\n", wantErr: "line 1:"},
+		{name: "garbage", data: "100\nvni 7\n", wantErr: "line 2:"},
+		{name: "json descending range", data: `{"ranges": [{"first": 200, "last": 100}]}`, wantErr: "invalid range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := parseSlurmState([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state, tt.want) {
+				t.Errorf("state = %+v, want %+v", state, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSlurmStateLimit(t *testing.T) {
+	oldMax := maxBodyBytes
+	defer func() { maxBodyBytes = oldMax }()
+	maxBodyBytes = 16
+
+	path := filepath.Join(t.TempDir(), "vnis")
+	if err := os.WriteFile(path, []byte("100\n101\n102\n103\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSlurmState(context.TODO(), "file:"+path); err != nil {
+		t.Fatalf("reading %d bytes: %v", maxBodyBytes, err)
+	}
+	if err := os.WriteFile(path, []byte("100\n101\n102\n103\n104\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSlurmState(context.TODO(), "file:"+path); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("err = %v, want the size limit", err)
+	}
+	if _, err := ReadSlurmState(context.TODO(), "exec:yes 100"); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("exec: err = %v, want the size limit", err)
+	}
+}
+
+func TestImportSlurm(t *testing.T) {
+	newTestStore(t)
+	vni := acquireTestVni(t, "vni-"+jobUid, "vnitest")
+
+	path := filepath.Join(t.TempDir(), "vnis")
+	data := "range 0-70000\n1-99\n65530-70000\n101-103\n100\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	report := ImportSlurm(context.TODO(), "file:"+path)
+	if report.Error != "" {
+		t.Fatal(report.Error)
+	}
+	want := []int{100, 101, 102, 103, 65530, 65531, 65532, 65533, 65534}
+	if !reflect.DeepEqual(report.Imported, want) {
+		t.Errorf("imported %v, want %v", report.Imported, want)
+	}
+	if report.Outside != 99+(70000-65534) {
+		t.Errorf("outside = %d, want %d", report.Outside, 99+(70000-65534))
+	}
+	if report.SlurmRange != "0-70001" || report.Overlap != "100-65535" {
+		t.Errorf("range %s, overlap %s", report.SlurmRange, report.Overlap)
+	}
+	if vni != 100 || len(report.Conflicts) != 1 || !strings.Contains(report.Conflicts[0], "vnitest/vni-"+jobUid) {
+		t.Errorf("conflicts = %v, want VNI %d", report.Conflicts, vni)
+	}
+
+	// the imported VNIs are not handed out
+	next := acquireTestVni(t, "vni-"+deploymentUid, "vnitest")
+	if next != 104 {
+		t.Errorf("acquired %d after the import, want 104", next)
+	}
+}
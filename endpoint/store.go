@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store is the allocation database used by the hooks. Implementations must
+// uphold the same semantics as the SQLite store:
+//
+//   - Acquire returns the existing VNI for (vniUid, namespace) if there is one,
+//     otherwise a free VNI in [policy.Min, policy.Max) that has not been
+//     released within policy.Quarantine, chosen by policy.Strategy.
+//   - GetVni returns -1 and no error if there is no allocation.
+//   - ReleaseUserCheck returns ErrVNINotFound if there is no allocation and
+//     ErrVNIInUse if users are still attached.
+//   - AddUser returns ErrVNINotFound if there is no allocation and is a no-op
+//     for users that are already attached.
+//   - RemoveUser is a no-op for users that are not attached.
+//   - ListAllocations lists the allocations of a namespace, or of all
+//     namespaces if it is empty.
+//   - SetProfile returns ErrVNINotFound if there is no allocation. The profile
+//     is dropped when the allocation is released; GetProfile returns an empty
+//     profile if none was set.
+//   - SetExternal marks exactly vnis as held by the external allocator owner,
+//     so that Acquire skips them. VNIs owner gives up are quarantined. VNIs
+//     held by another owner are left to it.
+type Store interface {
+	Init() error
+	Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error)
+	GetVni(vniUid string, namespace string) (int, error)
+	ReleaseUserCheck(vniUid string, namespace string, doLog bool) error
+	AddUser(vniUid string, namespace string, userId string, doLog bool) error
+	RemoveUser(vniUid string, namespace string, userId string, doLog bool) error
+	ListAllocations(namespace string) ([]Allocation, error)
+	SetProfile(vniUid string, namespace string, profile CxiProfile) error
+	GetProfile(vniUid string, namespace string) (CxiProfile, error)
+	SetExternal(owner string, vnis []int) error
+	GetExternal() (map[string][]int, error)
+	Close() error
+}
+
+// Strategies of AllocationPolicy
+const (
+	// StrategyLowestFirst hands out the lowest free VNI.
+	StrategyLowestFirst = "LowestFirst"
+	// StrategyLeastRecentlyReleased hands out the free VNI released longest
+	// ago, VNIs never released first, so that VNIs are reused as late as
+	// possible.
+	StrategyLeastRecentlyReleased = "LeastRecentlyReleased"
+)
+
+// defaultQuarantine is the time a released VNI is kept from being
+// reallocated unless a VniPool sets another.
+const defaultQuarantine = 60 * time.Second
+
+// AllocationPolicy decides which VNI Acquire hands out.
+type AllocationPolicy struct {
+	// Min and Max bound the VNIs to [Min, Max)
+	Min        int           `json:"min"`
+	Max        int           `json:"max"`
+	Quarantine time.Duration `json:"quarantine"`
+	// Strategy is StrategyLowestFirst if empty
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// defaultPolicy allocates from the whole range without VniPools.
+func defaultPolicy() AllocationPolicy {
+	return AllocationPolicy{Min: vniMin, Max: vniMax, Quarantine: defaultQuarantine, Strategy: StrategyLowestFirst}
+}
+
+// Allocation is a VNI allocated to (VniUid, Namespace) and the users that
+// joined it.
+type Allocation struct {
+	VniUid    string   `json:"vniUid"`
+	Namespace string   `json:"namespace"`
+	Vni       int      `json:"vni"`
+	Users     []string `json:"users,omitempty"`
+}
+
+func allocKey(vniUid string, namespace string) string {
+	return namespace + "/" + vniUid
+}
+
+// SQLiteStore is the default Store, kept in a single SQLite file.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(filePath *string) (*SQLiteStore, error) {
+	db, err := open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Init() error {
+	return Init(s.db)
+}
+
+func (s *SQLiteStore) Acquire(vniUid string, namespace string, policy AllocationPolicy, doLog bool) (int, error) {
+	return Acquire(s.db, vniUid, namespace, policy, doLog)
+}
+
+func (s *SQLiteStore) GetVni(vniUid string, namespace string) (int, error) {
+	return GetVni(s.db, vniUid, namespace)
+}
+
+func (s *SQLiteStore) ReleaseUserCheck(vniUid string, namespace string, doLog bool) error {
+	return ReleaseUserCheck(s.db, vniUid, namespace, doLog)
+}
+
+func (s *SQLiteStore) AddUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return AddUser(s.db, vniUid, namespace, userId, doLog)
+}
+
+func (s *SQLiteStore) RemoveUser(vniUid string, namespace string, userId string, doLog bool) error {
+	return RemoveUser(s.db, vniUid, namespace, userId, doLog)
+}
+
+func (s *SQLiteStore) ListAllocations(namespace string) ([]Allocation, error) {
+	return ListAllocations(s.db, namespace)
+}
+
+func (s *SQLiteStore) SetProfile(vniUid string, namespace string, profile CxiProfile) error {
+	return SetProfile(s.db, vniUid, namespace, profile)
+}
+
+func (s *SQLiteStore) GetProfile(vniUid string, namespace string) (CxiProfile, error) {
+	return GetProfile(s.db, vniUid, namespace)
+}
+
+func (s *SQLiteStore) SetExternal(owner string, vnis []int) error {
+	return SetExternal(s.db, owner, vnis)
+}
+
+func (s *SQLiteStore) GetExternal() (map[string][]int, error) {
+	return GetExternal(s.db)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// StoreConfig selects and configures the Store used by the endpoint.
+type StoreConfig struct {
+	Kind           string // "sqlite", "postgres", "kube" or "raft"
+	FilePath       *string
+	PostgresDSN    string
+	Kubeconfig     string
+	KubeObjectName string
+	RaftID         string
+	RaftDir        string
+	RaftBind       string
+	RaftAdvertise  string
+	RaftPeers      string
+	RaftTLS        RaftTLS
+}
+
+// OpenStore opens the store described by config.
+func OpenStore(config StoreConfig) (Store, error) {
+	switch config.Kind {
+	case "sqlite":
+		return NewSQLiteStore(config.FilePath)
+	case "postgres":
+		return NewPostgresStore(config.PostgresDSN)
+	case "kube":
+		client, err := newDynamicClient(config.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewKubeStore(client, config.KubeObjectName), nil
+	case "raft":
+		raftConfig, err := NewRaftConfig(config.RaftID, config.RaftDir, config.RaftBind,
+			config.RaftAdvertise, config.RaftPeers, config.RaftTLS)
+		if err != nil {
+			return nil, err
+		}
+		return NewRaftStore(config.FilePath, raftConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown store: %s", config.Kind)
+	}
+}
+
+// MigrateStore applies the pending schema migrations of the store described
+// by config and returns the schema version it is at, for -migrate-only.
+func MigrateStore(config StoreConfig) (int, error) {
+	switch config.Kind {
+	case "sqlite":
+		return schemaVersion(), InitDB(config.FilePath)
+	case "postgres":
+		s, err := NewPostgresStore(config.PostgresDSN)
+		if err != nil {
+			return 0, err
+		}
+		defer s.Close()
+		return pgMigrations[len(pgMigrations)-1].version, s.Init()
+	case "kube":
+		return 0, errors.New("--store kube has no schema to migrate")
+	case "raft":
+		return 0, errors.New("--store raft rebuilds the database of each replica from the Raft log on startup, there is nothing to migrate")
+	default:
+		return 0, fmt.Errorf("unknown store: %s", config.Kind)
+	}
+}
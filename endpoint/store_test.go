@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// postgresDSNEnv names the variable holding the DSN of a scratch PostgreSQL
+// database for TestPostgresStore. The test drops the store's tables first.
+const postgresDSNEnv = "VNI_TEST_POSTGRES_DSN"
+
+func TestSQLiteStore(t *testing.T) {
+	storeConformance(t, newTestStore(t))
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	s, err := NewPostgresStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.Exec(`drop table if exists vni_profiles, vni_allocs, vni_allocs_log, vni_users, vni_users_log,
+		available_vnis, schema_version cascade;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storeConformance(t, s)
+}
+
+func TestKubeStore(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{vniRangeAllocationGVR: "VniRangeAllocationList"})
+	s := NewKubeStore(client, "vni-range")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storeConformance(t, s)
+}
+
+// TestDecodeRangeStateOutOfRange checks that a VniRangeAllocation edited to
+// hold a VNI outside the range is an error rather than a panic.
+func TestDecodeRangeStateOutOfRange(t *testing.T) {
+	for _, vni := range []int{vniMin - 1, vniMax, vniMax + 100000} {
+		status := vniRangeAllocationStatus{Allocations: []vniRangeAllocationEntry{
+			{Namespace: "vnitest", VniUid: "my-claim", Vni: int64(vni)}}}
+		if _, err := decodeRangeState(status, vniMin, vniMax); err == nil {
+			t.Errorf("VNI %d decoded", vni)
+		}
+	}
+}
+
+func TestRaftStore(t *testing.T) {
+	storeConformance(t, newTestRaftStore(t))
+}
+
+// newTestRaftStore returns a single-node RaftStore with in-memory Raft state
+// once it leads.
+func newTestRaftStore(t *testing.T) *RaftStore {
+	t.Helper()
+	id := raft.ServerID("http://127.0.0.1:8842")
+	address, transport := raft.NewInmemTransport("")
+	logStore := raft.NewInmemStore()
+	config := RaftConfig{
+		ID:            string(id),
+		Peers:         []raft.Server{{Suffrage: raft.Voter, ID: id, Address: address}},
+		Transport:     transport,
+		LogStore:      logStore,
+		StableStore:   logStore,
+		SnapshotStore: raft.NewInmemSnapshotStore(),
+	}
+	path := filepath.Join(t.TempDir(), "vni.db")
+	s := NewRaftStore(&path, config)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for deadline := time.Now().Add(10 * time.Second); !s.IsLeader(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no Raft leader")
+		}
+	}
+	return s
+}
+
+// storeConformance checks the semantics documented on Store against an
+// empty store s.
+func storeConformance(t *testing.T, s Store) {
+	const namespace = "conformance"
+	policy := AllocationPolicy{Min: 100, Max: 110, Quarantine: time.Hour, Strategy: StrategyLowestFirst}
+
+	acquire := func(vniUid string, policy AllocationPolicy, want int) {
+		t.Helper()
+		vni, err := s.Acquire(vniUid, namespace, policy, true)
+		if err != nil || vni != want {
+			t.Fatalf("Acquire(%s) = %d, %v, want %d", vniUid, vni, err, want)
+		}
+	}
+	getVni := func(vniUid string, want int) {
+		t.Helper()
+		vni, err := s.GetVni(vniUid, namespace)
+		if err != nil || vni != want {
+			t.Fatalf("GetVni(%s) = %d, %v, want %d", vniUid, vni, err, want)
+		}
+	}
+	expectError := func(name string, err error, want error) {
+		t.Helper()
+		if !errors.Is(err, want) {
+			t.Fatalf("%s: %v, want %v", name, err, want)
+		}
+	}
+
+	t.Run("acquire reuses the allocation", func(t *testing.T) {
+		acquire("a", policy, 100)
+		acquire("a", policy, 100)
+		getVni("a", 100)
+		getVni("missing", -1)
+	})
+
+	t.Run("users", func(t *testing.T) {
+		expectError("AddUser to a missing allocation", s.AddUser("missing", namespace, "job-1", true), ErrVNINotFound)
+		expectError("AddUser", s.AddUser("a", namespace, "job-1", true), nil)
+		expectError("AddUser again", s.AddUser("a", namespace, "job-1", true), nil)
+		expectError("ReleaseUserCheck in use", s.ReleaseUserCheck("a", namespace, true), ErrVNIInUse)
+
+		allocations, err := s.ListAllocations(namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Allocation{{VniUid: "a", Namespace: namespace, Vni: 100, Users: []string{"job-1"}}}
+		if !reflect.DeepEqual(allocations, want) {
+			t.Errorf("ListAllocations = %+v, want %+v", allocations, want)
+		}
+		if allocations, err := s.ListAllocations("other"); err != nil || len(allocations) != 0 {
+			t.Errorf("ListAllocations(other) = %+v, %v", allocations, err)
+		}
+
+		expectError("RemoveUser", s.RemoveUser("a", namespace, "job-1", true), nil)
+		expectError("RemoveUser again", s.RemoveUser("a", namespace, "job-1", true), nil)
+	})
+
+	t.Run("profiles", func(t *testing.T) {
+		profile := CxiProfile{TrafficClasses: []string{"LOW_LATENCY"}, Limits: map[string]int{"txqs": 16}}
+		expectError("SetProfile of a missing allocation", s.SetProfile("missing", namespace, profile), ErrVNINotFound)
+		expectError("SetProfile", s.SetProfile("a", namespace, profile), nil)
+		got, err := s.GetProfile("a", namespace)
+		if err != nil || !reflect.DeepEqual(got, profile) {
+			t.Errorf("GetProfile = %+v, %v, want %+v", got, err, profile)
+		}
+	})
+
+	t.Run("release quarantines the VNI", func(t *testing.T) {
+		expectError("ReleaseUserCheck", s.ReleaseUserCheck("a", namespace, true), nil)
+		expectError("ReleaseUserCheck again", s.ReleaseUserCheck("a", namespace, true), ErrVNINotFound)
+		getVni("a", -1)
+		if got, err := s.GetProfile("a", namespace); err != nil || !reflect.DeepEqual(got, CxiProfile{}) {
+			t.Errorf("GetProfile after release = %+v, %v", got, err)
+		}
+
+		acquire("b", policy, 101)
+		acquire("c", policy, 102)
+	})
+
+	t.Run("no free VNI", func(t *testing.T) {
+		full := AllocationPolicy{Min: 100, Max: 102, Quarantine: time.Hour, Strategy: StrategyLowestFirst}
+		_, err := s.Acquire("d", namespace, full, true)
+		expectError("Acquire from a full range", err, ErrNoFreeVNI)
+		getVni("d", -1)
+	})
+
+	t.Run("external VNIs", func(t *testing.T) {
+		expectError("SetExternal", s.SetExternal("slurm", []int{103, 104}), nil)
+		acquire("d", policy, 105)
+		external, err := s.GetExternal()
+		if want := map[string][]int{"slurm": {103, 104}}; err != nil || !reflect.DeepEqual(external, want) {
+			t.Errorf("GetExternal = %v, %v, want %v", external, err, want)
+		}
+
+		// 103 is given up and quarantined, 104 stays with slurm
+		expectError("SetExternal of another owner", s.SetExternal("other", []int{104, 106}), nil)
+		expectError("SetExternal", s.SetExternal("slurm", []int{104}), nil)
+		acquire("e", policy, 107)
+		external, err = s.GetExternal()
+		if want := map[string][]int{"slurm": {104}, "other": {106}}; err != nil || !reflect.DeepEqual(external, want) {
+			t.Errorf("GetExternal = %v, %v, want %v", external, err, want)
+		}
+
+		// an import that finds no VNIs gives up all of them
+		for _, none := range [][]int{{}, nil} {
+			expectError("SetExternal", s.SetExternal("other", []int{108, 109}), nil)
+			expectError("SetExternal none", s.SetExternal("other", none), nil)
+			external, err = s.GetExternal()
+			if want := map[string][]int{"slurm": {104}}; err != nil || !reflect.DeepEqual(external, want) {
+				t.Errorf("GetExternal after giving up %#v = %v, %v, want %v", none, external, err, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,56 @@
+-- A database as created by v1.0 of the endpoint, before schema_version
+-- existed: one allocation joined by a Job, and one VNI released recently.
+
+CREATE TABLE vni_allocs (
+	vniUid string not null,
+	namespace string not null,
+	vni integer not null,
+	unique (vniUid, namespace, vni),
+	primary key (vniUid, namespace)
+);
+create index vni_allocs_idx on vni_allocs(vni);
+create index vni_allocs_idx2 on vni_allocs(vniUid, namespace, vni);
+
+CREATE TABLE vni_allocs_log (
+	vniUid string not null,
+	namespace string not null,
+	vni integer not null,
+	operation text not null,
+	ts datetime not null
+);
+
+CREATE TABLE vni_users (
+	vniUid string not null,
+	namespace string not null,
+	userId text not null,
+	unique (vniUid, namespace, userId),
+	primary key (vniUid, namespace, userId)
+);
+create index vni_users_idx on vni_users(vniUid, namespace, userId);
+
+CREATE TABLE vni_users_log (
+	vniUid string not null,
+	namespace string not null,
+	userId text not null,
+	operation text not null,
+	ts datetime not null
+);
+
+CREATE TABLE available_vnis (
+	vni int not null primary key,
+	lastReleased datetime,
+	unique (vni),
+	check (vni >= 100 and vni < 65535)
+);
+
+insert into available_vnis (vni, lastReleased) values
+	(100, null),
+	(101, '2024-05-02 09:14:11'),
+	(102, null),
+	(103, null);
+insert into vni_allocs (vniUid, namespace, vni) values ('my-claim', 'vnitest', 100);
+insert into vni_users (vniUid, namespace, userId) values ('my-claim', 'vnitest', 'b7e4d1c2-9a3f-4c56-8e21-0f6a5b4c3d2e');
+insert into vni_allocs_log (vniUid, namespace, vni, operation, ts) values
+	('my-claim', 'vnitest', 100, 'acquire', '2024-05-02 09:10:00'),
+	('vni-old', 'vnitest', 101, 'acquire', '2024-05-02 08:00:00'),
+	('vni-old', 'vnitest', 101, 'release', '2024-05-02 09:14:11');
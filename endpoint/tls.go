@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// certReloader serves the certificate and client CA from disk and picks up
+// rotated files (e.g. from cert-manager) on the next handshake.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	clientCA *x509.CertPool
+	caMod    time.Time
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// reload reads the files again if they changed since the last load. If the
+// new files cannot be loaded, the previous ones stay in use.
+func (c *certReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certMod, err := modTime(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if keyMod.After(certMod) {
+		certMod = keyMod
+	}
+	if c.cert == nil || !certMod.Equal(c.certMod) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return err
+		}
+		if c.cert != nil {
+			log.Printf("Reloaded TLS certificate %s\n", c.certFile)
+		}
+		c.cert = &cert
+		c.certMod = certMod
+	}
+
+	if c.clientCAFile == "" {
+		return nil
+	}
+	caMod, err := modTime(c.clientCAFile)
+	if err != nil {
+		return err
+	}
+	if c.clientCA == nil || !caMod.Equal(c.caMod) {
+		pool, err := loadCertPool(c.clientCAFile)
+		if err != nil {
+			return err
+		}
+		if c.clientCA != nil {
+			log.Printf("Reloaded client CA %s\n", c.clientCAFile)
+		}
+		c.clientCA = pool
+		c.caMod = caMod
+	}
+	return nil
+}
+
+func (c *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := c.reload(); err != nil {
+		log.Printf("Error reloading TLS files, keeping previous ones: %v\n", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*c.cert},
+	}
+	if c.clientCA != nil {
+		config.ClientCAs = c.clientCA
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// newServerTLSConfig returns a TLS configuration that reloads certFile and
+// keyFile on rotation. If clientCAFile is set, clients must present a
+// certificate signed by it.
+func newServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.getConfigForClient,
+	}, nil
+}
+
+// newPeerTransport returns the transport used to reach other endpoint
+// replicas, trusting peerCAFile in addition to the system roots. If certFile
+// is set, it is presented as client certificate, for replicas that require
+// one.
+func newPeerTransport(peerCAFile string, certFile string, keyFile string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if peerCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(peerCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + peerCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+		if err := reloader.reload(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if err := reloader.reload(); err != nil {
+				log.Printf("Error reloading TLS files, keeping previous ones: %v\n", err)
+			}
+			reloader.mu.Lock()
+			defer reloader.mu.Unlock()
+			return reloader.cert, nil
+		}
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// raftStreamLayer carries Raft traffic over mutually authenticated TLS: both
+// ends present their certificate and verify the other's against the peer CA,
+// so only replicas can append to the Raft log.
+type raftStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	reloader  *certReloader
+}
+
+func newRaftStreamLayer(bind string, advertise net.Addr, certFile string, keyFile string,
+	peerCAFile string) (*raftStreamLayer, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: peerCAFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", bind, &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.getConfigForClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &raftStreamLayer{Listener: listener, advertise: advertise, reloader: reloader}, nil
+}
+
+// Addr returns the address the other peers reach this one at.
+func (l *raftStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	if err := l.reloader.reload(); err != nil {
+		log.Printf("Error reloading TLS files, keeping previous ones: %v\n", err)
+	}
+	l.reloader.mu.Lock()
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*l.reloader.cert},
+		RootCAs:      l.reloader.clientCA,
+	}
+	l.reloader.mu.Unlock()
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), config)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testCA signs certificates for 127.0.0.1 usable by servers and clients.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vni test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, "ca.crt")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate and key named name into dir and returns their
+// paths.
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestStreamLayer(t *testing.T, ca *testCA, dir string, name string) *raftStreamLayer {
+	t.Helper()
+	certFile, keyFile := ca.issue(t, dir, name, 2)
+	layer, err := newRaftStreamLayer("127.0.0.1:0", nil, certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.advertise = layer.Listener.Addr()
+	t.Cleanup(func() { layer.Close() })
+	return layer
+}
+
+// TestRaftStreamLayer checks that replicas reach each other over the Raft
+// port while clients without a certificate of the peer CA are refused.
+func TestRaftStreamLayer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	a := newTestStreamLayer(t, ca, dir, "replica-a")
+	b := newTestStreamLayer(t, ca, dir, "replica-b")
+
+	received := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := b.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := io.ReadAll(io.LimitReader(conn, 4))
+				if err != nil {
+					received <- "error: " + err.Error()
+					return
+				}
+				received <- string(data)
+			}()
+		}
+	}()
+
+	conn, err := a.Dial(raft.ServerAddress(b.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	conn.Close()
+	if got := <-received; got != "ping" {
+		t.Fatalf("received %q", got)
+	}
+
+	otherDir := t.TempDir()
+	other := newTestCA(t, otherDir)
+	otherCert, otherKey := other.issue(t, otherDir, "intruder", 3)
+	intruder, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	for name, certificates := range map[string][]tls.Certificate{"no certificate": nil, "other CA": {intruder}} {
+		conn, err := tls.Dial("tcp", b.Addr().String(), &tls.Config{RootCAs: pool, Certificates: certificates})
+		if err == nil {
+			// TLS 1.3 reports the rejected certificate on the first read
+			conn.Write([]byte("ping"))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: connected", name)
+		}
+		if got := <-received; got == "ping" {
+			t.Errorf("%s: received %q", name, got)
+		}
+	}
+}
+
+// serveTLS accepts TLS connections with config on a local port until the test
+// ends, and returns its address.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// servedSerial returns the serial number of the certificate served at address.
+func servedSerial(t *testing.T, address string, ca *testCA, certificates []tls.Certificate) (int64, error) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool, Certificates: certificates})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// TLS 1.3 reports a rejected client certificate on the first read
+	if _, err := conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+// touch moves the modification time of files forward, as a rotation that
+// happens within the resolution of the file system would not be seen.
+func touch(t *testing.T, offset time.Duration, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		ts := time.Now().Add(offset)
+		if err := os.Chtimes(file, ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10)
+	config, err := newServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serveTLS(t, config)
+	if serial, err := servedSerial(t, address, ca, nil); err != nil || serial != 10 {
+		t.Fatalf("serial %d, %v, want 10", serial, err)
+	}
+
+	// e.g. cert-manager renewing the certificate
+	ca.issue(t, dir, "server", 11)
+	touch(t, time.Minute, certFile, keyFile)
+	if serial, err := servedSerial(t, address, ca, nil); err != nil || serial != 11 {
+		t.Fatalf("after rotation: serial %d, %v, want 11", serial, err)
+	}
+
+	// a broken rotation keeps the previous certificate
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, 2*time.Minute, certFile)
+	if serial, err := servedSerial(t, address, ca, nil); err != nil || serial != 11 {
+		t.Fatalf("after a broken rotation: serial %d, %v, want 11", serial, err)
+	}
+}
+
+func TestServerTLSClientCAReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10)
+	clientCert, clientKey := ca.issue(t, dir, "client", 20)
+	client, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAFile := filepath.Join(dir, "client-ca.crt")
+	writePEM(t, clientCAFile, "CERTIFICATE", ca.cert.Raw)
+
+	config, err := newServerTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serveTLS(t, config)
+	if _, err := servedSerial(t, address, ca, nil); err == nil {
+		t.Error("connected without a client certificate")
+	}
+	if _, err := servedSerial(t, address, ca, []tls.Certificate{client}); err != nil {
+		t.Fatalf("client certificate refused: %v", err)
+	}
+
+	// a rotated client CA no longer admits clients of the previous one
+	otherDir := t.TempDir()
+	other := newTestCA(t, otherDir)
+	writePEM(t, clientCAFile, "CERTIFICATE", other.cert.Raw)
+	touch(t, time.Minute, clientCAFile)
+	if _, err := servedSerial(t, address, ca, []tls.Certificate{client}); err == nil {
+		t.Error("client of the previous CA admitted after rotation")
+	}
+	otherCert, otherKey := other.issue(t, otherDir, "client", 21)
+	otherClient, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := servedSerial(t, address, ca, []tls.Certificate{otherClient}); err != nil {
+		t.Errorf("client of the rotated CA refused: %v", err)
+	}
+}
@@ -1,52 +1,129 @@
 package main
 
-type DecoratorSyncHookRequest struct {
-	Controller  map[string]interface{} `json:"controller"`
-	Object      map[string]interface{} `json:"object"`
-	Attachments map[string]interface{} `json:"attachments"`
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The types below model the webhook contract of Metacontroller's
+// metacontroller.k8s.io/v1alpha1 DecoratorController and CompositeController.
+
+// KubeObject is a Kubernetes object in a hook request. Only the metadata is
+// decoded; spec and status depend on the resource.
+type KubeObject struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   metav1.ObjectMeta `json:"metadata"`
+	Spec       json.RawMessage   `json:"spec,omitempty"`
+	Status     json.RawMessage   `json:"status,omitempty"`
+}
+
+// RelatedObjects are objects by type ("Kind.apiVersion") and name, as
+// Metacontroller passes attachments, children and related objects.
+type RelatedObjects map[string]map[string]json.RawMessage
+
+// DecoratorHookRequest is the body of the sync and finalize hooks of a
+// DecoratorController.
+type DecoratorHookRequest struct {
+	Controller KubeObject `json:"controller"`
+	Object     KubeObject `json:"object"`
+	// Attachments holds the observed Vni attachments, the only type the VNI
+	// controller declares, by "Kind.apiVersion" and name
+	Attachments map[string]map[string]Vni `json:"attachments"`
+	Related     RelatedObjects            `json:"related,omitempty"`
+	// Finalizing is true for the finalize hook
+	Finalizing bool `json:"finalizing"`
 }
 
+// DecoratorSyncHookResponse answers the sync hook of a DecoratorController.
+// Labels and annotations are merged into the parent's; a nil value removes
+// one. A nil Status leaves the parent's status unchanged.
 type DecoratorSyncHookResponse struct {
-	Labels             interface{}   `json:"labels"`
-	Annotations        interface{}   `json:"annotations"`
-	Status             interface{}   `json:"status"`
-	Attachments        []interface{} `json:"attachments"`
-	ResyncAfterSeconds float32       `json:"resyncAfterSeconds"`
+	Labels             map[string]*string `json:"labels,omitempty"`
+	Annotations        map[string]*string `json:"annotations,omitempty"`
+	Status             *VniClaimStatus    `json:"status,omitempty"`
+	Attachments        []Vni              `json:"attachments"`
+	ResyncAfterSeconds float64            `json:"resyncAfterSeconds,omitempty"`
 }
 
+// DecoratorFinalizeHookResponse answers the finalize hook of a
+// DecoratorController. Metacontroller removes its finalizer once Finalized is
+// true.
 type DecoratorFinalizeHookResponse struct {
-	Labels             interface{}   `json:"labels"`
-	Annotations        interface{}   `json:"annotations"`
-	Status             interface{}   `json:"status"`
-	Attachments        []interface{} `json:"attachments"`
-	ResyncAfterSeconds float32       `json:"resyncAfterSeconds"`
-	Finalized          bool          `json:"finalized"`
+	DecoratorSyncHookResponse
+	Finalized bool `json:"finalized"`
 }
 
+// CompositeSyncHookRequest is the body of the sync and finalize hooks of a
+// CompositeController.
 type CompositeSyncHookRequest struct {
-	Controller map[string]interface{} `json:"controller"`
-	Parent     map[string]interface{} `json:"parent"`
-	Children   map[string]interface{} `json:"children"`
-	Related    map[string]interface{} `json:"related"`
-	Finalizing bool                   `json:"finalizing"`
+	Controller KubeObject     `json:"controller"`
+	Parent     KubeObject     `json:"parent"`
+	Children   RelatedObjects `json:"children"`
+	Related    RelatedObjects `json:"related,omitempty"`
+	Finalizing bool           `json:"finalizing"`
 }
 
+// CompositeSyncHookResponse answers the sync hook of a CompositeController.
+// Status replaces the parent's status.
 type CompositeSyncHookResponse struct {
-	Status             interface{}   `json:"status"`
-	Children           []interface{} `json:"object"`
-	ResyncAfterSeconds float32       `json:"resyncAfterSeconds"`
+	Status             json.RawMessage   `json:"status,omitempty"`
+	Children           []json.RawMessage `json:"children"`
+	ResyncAfterSeconds float64           `json:"resyncAfterSeconds,omitempty"`
 }
 
+// CompositeFinalizeHookResponse answers the finalize hook of a
+// CompositeController.
 type CompositeFinalizeHookResponse struct {
-	Status             interface{}   `json:"status"`
-	Children           []interface{} `json:"object"`
-	ResyncAfterSeconds float32       `json:"resyncAfterSeconds"`
-	Finalized          bool          `json:"finalized"`
+	CompositeSyncHookResponse
+	Finalized bool `json:"finalized"`
 }
 
 type Vni struct {
 	ApiVersion string            `json:"apiVersion"`
 	Kind       string            `json:"kind"`
-	Metadata   map[string]string `json:"metadata"`
-	Spec       map[string]int    `json:"spec"`
+	Metadata   metav1.ObjectMeta `json:"metadata"`
+	Spec       VniSpec           `json:"spec"`
+	Status     json.RawMessage   `json:"status,omitempty"`
+}
+
+type VniSpec struct {
+	Vni            int            `json:"vni"`
+	TrafficClasses []string       `json:"trafficClasses,omitempty"`
+	Limits         map[string]int `json:"limits,omitempty"`
+}
+
+// newVni returns the desired Vni attachment name in namespace.
+func newVni(name string, namespace string, spec VniSpec) Vni {
+	return Vni{
+		ApiVersion: vniApiVersion,
+		Kind:       "Vni",
+		Metadata:   metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       spec,
+	}
+}
+
+// decodeHookRequest decodes a hook request strictly: unknown fields in the
+// typed parts, or data after the request, are errors.
+func decodeHookRequest(body []byte, request interface{}) error {
+	if err := decodeStrict(body, request); err != nil {
+		return invalidRequest("%v", err)
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("data after the object")
+	}
+	return nil
 }
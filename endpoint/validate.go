@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+var ErrInvalidRequest = errors.New("invalid hook request")
+
+const vniAttachmentKey = "Vni.horizon-opencube.eu/v1"
+
+// ownedVniUidPattern matches the allocations vni-<uid> of annotated parents,
+// which a VniClaim must not take over by naming them.
+var ownedVniUidPattern = regexp.MustCompile(`^vni-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// allowedParents holds the parent resources the hooks accept, as
+// "Kind.apiVersion" like Metacontroller's attachment keys. It must match the
+// resources in config/vni-controller.yml and config/vni-controller-kubeflow.yml.
+var allowedParents = map[string]bool{}
+
+var defaultAllowedParents = []string{
+	"Deployment.apps/v1",
+	"DaemonSet.apps/v1",
+	"ReplicaSet.apps/v1",
+	"StatefulSet.apps/v1",
+	"Job.batch/v1",
+	"CronJob.batch/v1",
+	"Pod.v1",
+	"Job.batch.volcano.sh/v1alpha1",
+	"MPIJob.kubeflow.org/v2beta1",
+	"PyTorchJob.kubeflow.org/v1",
+	"VniClaim.horizon-opencube.eu/v1",
+}
+
+func invalidRequest(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// validateHookRequest checks a sync or finalize request before anything is
+// allocated or released: the parent must be one of the configured resources,
+// and every Vni attachment must be one the parent can own, in the parent's
+// namespace.
+func validateHookRequest(request DecoratorHookRequest) error {
+	object := request.Object
+	apiVersion := object.ApiVersion
+	kind := object.Kind
+	if !allowedParents[kind+"."+apiVersion] {
+		return invalidRequest("parent %s.%s is not a configured resource", kind, apiVersion)
+	}
+	uid := string(object.Metadata.UID)
+	if uid == "" {
+		return invalidRequest("parent has no metadata.uid")
+	}
+	namespace := object.Metadata.Namespace
+	if namespace == "" {
+		return invalidRequest("parent has no metadata.namespace")
+	}
+
+	owned := map[string]bool{fmt.Sprintf("vni-%s", uid): true}
+	if apiVersion == vniApiVersion && kind == "VniClaim" {
+		claimName := gjson.GetBytes(object.Spec, "name").String()
+		if claimName == "" {
+			return invalidRequest("VniClaim has no spec.name")
+		}
+		if ownedVniUidPattern.MatchString(claimName) {
+			return invalidRequest("VniClaim spec.name %s is reserved for the VNI of a parent", claimName)
+		}
+		owned = map[string]bool{claimName: true}
+	}
+
+	for key, vnis := range request.Attachments {
+		if key != vniAttachmentKey {
+			return invalidRequest("unexpected attachment type %s", key)
+		}
+		for name, vni := range vnis {
+			if !owned[name] {
+				return invalidRequest("attachment %s does not belong to %s %s/%s", name, kind, namespace, uid)
+			}
+			if vni.Metadata.Name != "" && vni.Metadata.Name != name {
+				return invalidRequest("attachment %s has metadata.name %v", name, vni.Metadata.Name)
+			}
+			if vni.Metadata.Namespace != namespace {
+				return invalidRequest("attachment %s is in namespace %q, parent in %q", name, vni.Metadata.Namespace, namespace)
+			}
+		}
+	}
+	return nil
+}
+
+func setAllowedParents(parents []string) error {
+	allowedParents = make(map[string]bool)
+	for _, parent := range parents {
+		kind, apiVersion, ok := strings.Cut(parent, ".")
+		if !ok || kind == "" || apiVersion == "" {
+			return fmt.Errorf("invalid parent resource %q, expected Kind.apiVersion", parent)
+		}
+		allowedParents[parent] = true
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateClaimName(t *testing.T) {
+	setAllowedParents(defaultAllowedParents)
+	tests := []struct {
+		name string
+		// err is a substring of the expected error, "" if valid
+		err string
+	}{
+		{name: "my-claim"},
+		{name: "vni-team-a"},
+		{name: "vni-" + deploymentUid, err: "is reserved for the VNI of a parent"},
+		{name: "", err: "VniClaim has no spec.name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request DecoratorHookRequest
+			if err := json.Unmarshal(readHook(t, "sync-vniclaim.json"), &request); err != nil {
+				t.Fatal(err)
+			}
+			spec, err := json.Marshal(map[string]string{"name": test.name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Object.Spec = spec
+			// its attachments are named after the old spec.name
+			request.Attachments = nil
+
+			err = validateHookRequest(request)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("spec.name %q: %v", test.name, err)
+			case test.err != "" && (!errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("spec.name %q: %v, want %q", test.name, err, test.err)
+			}
+		})
+	}
+}